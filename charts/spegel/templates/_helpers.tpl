@@ -80,3 +80,17 @@ Image reference
 {{- .Values.image.repository }}:{{ .Values.image.tag | default .Chart.AppVersion }}
 {{- end }}
 {{- end }}
+
+{{/*
+Scheme used to reach the registry
+*/}}
+{{- define "spegel.mirrorScheme" -}}
+{{- if .Values.spegel.tlsSecretName }}https{{ else }}http{{ end }}
+{{- end }}
+
+{{/*
+Host used to reach the registry on the node, TLS requires a host name which is in the certificate of every node
+*/}}
+{{- define "spegel.mirrorHost" -}}
+{{- if .Values.spegel.tlsSecretName }}{{ .Values.spegel.tlsMirrorHost }}{{ else }}$(NODE_IP){{ end }}
+{{- end }}
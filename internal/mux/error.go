@@ -0,0 +1,76 @@
+package mux
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrorCode is an error code returned in the response body as defined by the OCI distribution spec.
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#error-codes
+type ErrorCode string
+
+const (
+	ErrorCodeBlobUnknown     ErrorCode = "BLOB_UNKNOWN"
+	ErrorCodeDigestInvalid   ErrorCode = "DIGEST_INVALID"
+	ErrorCodeManifestUnknown ErrorCode = "MANIFEST_UNKNOWN"
+	ErrorCodeNameInvalid     ErrorCode = "NAME_INVALID"
+	ErrorCodeNameUnknown     ErrorCode = "NAME_UNKNOWN"
+	ErrorCodeUnsupported     ErrorCode = "UNSUPPORTED"
+	ErrorCodeTooManyRequests ErrorCode = "TOOMANYREQUESTS"
+	ErrorCodeUnauthorized    ErrorCode = "UNAUTHORIZED"
+	// ErrorCodePaginationNumberInvalid is returned when the number of requested results is invalid.
+	ErrorCodePaginationNumberInvalid ErrorCode = "PAGINATION_NUMBER_INVALID"
+	// ErrorCodeUnknown is used for errors without a code, it is not part of the spec.
+	ErrorCodeUnknown ErrorCode = "UNKNOWN"
+)
+
+type codedError struct {
+	err  error
+	code ErrorCode
+}
+
+// WithCode returns an error which will be returned with the given code in the response body.
+func WithCode(code ErrorCode, err error) error {
+	return &codedError{err: err, code: code}
+}
+
+func (c *codedError) Error() string {
+	return c.err.Error()
+}
+
+func (c *codedError) Unwrap() error {
+	return c.err
+}
+
+// CodeOf returns the error code of the error or unknown if the error does not have one.
+func CodeOf(err error) ErrorCode {
+	var cErr *codedError
+	if errors.As(err, &cErr) {
+		return cErr.code
+	}
+	return ErrorCodeUnknown
+}
+
+type errorResponse struct {
+	Errors []errorInfo `json:"errors"`
+}
+
+type errorInfo struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// newErrorResponse returns the response body for the error. The message of server errors is replaced
+// with the status text so that internal details are only logged and not returned to the client.
+func newErrorResponse(statusCode int, err error) errorResponse {
+	info := errorInfo{
+		Code: CodeOf(err),
+	}
+	switch {
+	case statusCode >= http.StatusInternalServerError:
+		info.Message = http.StatusText(statusCode)
+	case err != nil:
+		info.Message = err.Error()
+	}
+	return errorResponse{Errors: []errorInfo{info}}
+}
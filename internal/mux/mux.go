@@ -19,5 +19,5 @@ func NewServeMux(h Handler) (*ServeMux, error) {
 }
 
 func (s *ServeMux) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	s.h(&response{ResponseWriter: rw}, req)
+	s.h(&response{ResponseWriter: rw, req: req}, req)
 }
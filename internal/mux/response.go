@@ -2,9 +2,11 @@ package mux
 
 import (
 	"bufio"
+	"encoding/json"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 )
 
 type ResponseWriter interface {
@@ -25,6 +27,7 @@ var (
 type response struct {
 	http.ResponseWriter
 	error         error
+	req           *http.Request
 	status        int
 	size          int64
 	writtenHeader bool
@@ -45,9 +48,27 @@ func (r *response) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// WriteError writes the status code with the error in the response body as defined by the OCI distribution spec.
+// The error is only recorded if the response has already been written to. The body is omitted for HEAD requests.
+// Server errors are returned with a generic message, the recorded error should be logged instead.
 func (r *response) WriteError(statusCode int, err error) {
 	r.error = err
+	if r.writtenHeader {
+		return
+	}
+	b, jsonErr := json.Marshal(newErrorResponse(statusCode, err))
+	if jsonErr != nil {
+		r.WriteHeader(statusCode)
+		return
+	}
+	r.Header().Set("Content-Type", "application/json")
+	r.Header().Set("Content-Length", strconv.Itoa(len(b)))
 	r.WriteHeader(statusCode)
+	if r.req != nil && r.req.Method == http.MethodHead {
+		return
+	}
+	//nolint: errcheck // No method to throw the error.
+	r.Write(b)
 }
 
 func (r *response) Flush() {
@@ -46,6 +46,31 @@ func TestResponseWriter(t *testing.T) {
 	rw.WriteError(http.StatusInternalServerError, err)
 	require.Equal(t, err, rw.Error())
 	require.Equal(t, http.StatusInternalServerError, rw.Status())
+	recorder, ok := rw.ResponseWriter.(*httptest.ResponseRecorder)
+	require.True(t, ok)
+	require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	require.JSONEq(t, `{"errors":[{"code":"UNKNOWN","message":"Internal Server Error"}]}`, recorder.Body.String())
+
+	rw = &response{
+		ResponseWriter: httptest.NewRecorder(),
+	}
+	rw.WriteError(http.StatusNotFound, WithCode(ErrorCodeBlobUnknown, errors.New("blob not found")))
+	recorder, ok = rw.ResponseWriter.(*httptest.ResponseRecorder)
+	require.True(t, ok)
+	require.JSONEq(t, `{"errors":[{"code":"BLOB_UNKNOWN","message":"blob not found"}]}`, recorder.Body.String())
+
+	rw = &response{
+		ResponseWriter: httptest.NewRecorder(),
+		req:            httptest.NewRequest(http.MethodHead, "http://example.com", nil),
+	}
+	err = WithCode(ErrorCodeBlobUnknown, errors.New("blob not found"))
+	rw.WriteError(http.StatusNotFound, err)
+	require.Equal(t, http.StatusNotFound, rw.Status())
+	require.Equal(t, ErrorCodeBlobUnknown, CodeOf(rw.Error()))
+	recorder, ok = rw.ResponseWriter.(*httptest.ResponseRecorder)
+	require.True(t, ok)
+	require.NotEmpty(t, recorder.Header().Get("Content-Length"))
+	require.Empty(t, recorder.Body.String())
 
 	rw = &response{
 		ResponseWriter: httptest.NewRecorder(),
@@ -0,0 +1,133 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Reloader loads a certificate, key, and CA from files. The files are reloaded when
+// modified so that certificates can be rotated without restarting.
+type Reloader struct {
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	certFile string
+	keyFile  string
+	caFile   string
+	modTimes []time.Time
+	mx       sync.Mutex
+}
+
+func NewReloader(certFile, keyFile, caFile string) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ServerConfig returns a TLS config which serves the current certificate. Client certificates
+// are requested but not required, when presented they have to be signed by the current CA.
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequestClientCert,
+		GetCertificate: func(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return nil
+			}
+			_, pool := r.current()
+			return verifyChain(pool, cs.PeerCertificates, x509.ExtKeyUsageClientAuth)
+		},
+	}
+}
+
+// ClientConfig returns a TLS config which verifies servers against the current CA and presents
+// the current certificate as client certificate. Peers are addressed by IP, which is why only
+// the certificate chain is verified.
+func (r *Reloader) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Default verification is replaced by verifying against the CA in VerifyConnection.
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			_, pool := r.current()
+			return verifyChain(pool, cs.PeerCertificates, x509.ExtKeyUsageServerAuth)
+		},
+	}
+}
+
+// current returns the certificate and CA, reloading them if the files have been modified.
+func (r *Reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	// Files may be partially written during rotation, in which case the previous
+	// certificate is used until the new one can be loaded.
+	//nolint:errcheck // Load errors are returned when creating the reloader.
+	r.load()
+	return r.cert, r.pool
+}
+
+func (r *Reloader) load() error {
+	modTimes := []time.Time{}
+	for _, p := range []string{r.certFile, r.keyFile, r.caFile} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		modTimes = append(modTimes, fi.ModTime())
+	}
+	if r.cert != nil && slices.EqualFunc(modTimes, r.modTimes, time.Time.Equal) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load certificate: %w", err)
+	}
+	b, err := os.ReadFile(r.caFile)
+	if err != nil {
+		return fmt.Errorf("could not read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return errors.New("CA does not contain any certificates")
+	}
+	r.cert = &cert
+	r.pool = pool
+	r.modTimes = modTimes
+	return nil
+}
+
+func verifyChain(pool *x509.CertPool, certs []*x509.Certificate, usage x509.ExtKeyUsage) error {
+	if len(certs) == 0 {
+		return errors.New("peer did not present a certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,175 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloader(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	caFile := filepath.Join(dir, "ca.crt")
+	ca, caKey := writeCA(t, caFile)
+	writeCertificate(t, ca, caKey, 1, certFile, keyFile, time.Now())
+	reloader, err := NewReloader(certFile, keyFile, caFile)
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// Clients are expected to present their certificate.
+		if len(req.TLS.PeerCertificates) == 0 {
+			rw.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	srv.Listener = tls.NewListener(srv.Listener, reloader.ServerConfig())
+	srv.Start()
+	t.Cleanup(func() {
+		srv.Close()
+	})
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   reloader.ClientConfig(),
+			DisableKeepAlives: true,
+		},
+	}
+	requireSerial(t, client, srv.Listener.Addr().String(), 1)
+
+	// Rotated certificates are served for new connections.
+	writeCertificate(t, ca, caKey, 2, certFile, keyFile, time.Now().Add(time.Minute))
+	requireSerial(t, client, srv.Listener.Addr().String(), 2)
+
+	// Certificates which cannot be loaded are ignored until they are valid.
+	err = os.WriteFile(certFile, []byte("foo"), 0o600)
+	require.NoError(t, err)
+	err = os.Chtimes(certFile, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+	require.NoError(t, err)
+	requireSerial(t, client, srv.Listener.Addr().String(), 2)
+
+	// Servers with certificates from other CAs are rejected.
+	otherDir := t.TempDir()
+	otherCAFile := filepath.Join(otherDir, "ca.crt")
+	otherCA, otherCAKey := writeCA(t, otherCAFile)
+	writeCertificate(t, otherCA, otherCAKey, 3, filepath.Join(otherDir, "tls.crt"), filepath.Join(otherDir, "tls.key"), time.Now())
+	otherReloader, err := NewReloader(filepath.Join(otherDir, "tls.crt"), filepath.Join(otherDir, "tls.key"), otherCAFile)
+	require.NoError(t, err)
+	client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: otherReloader.ClientConfig(),
+		},
+	}
+	resp, err := client.Get("https://" + srv.Listener.Addr().String())
+	if err == nil {
+		resp.Body.Close()
+	}
+	require.ErrorContains(t, err, "certificate signed by unknown authority")
+
+	// Clients with certificates from other CAs are rejected.
+	otherCert, err := tls.LoadX509KeyPair(filepath.Join(otherDir, "tls.crt"), filepath.Join(otherDir, "tls.key"))
+	require.NoError(t, err)
+	client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				MinVersion:         tls.VersionTLS12,
+				InsecureSkipVerify: true,
+				Certificates:       []tls.Certificate{otherCert},
+			},
+		},
+	}
+	resp, err = client.Get("https://" + srv.Listener.Addr().String())
+	if err == nil {
+		resp.Body.Close()
+	}
+	require.Error(t, err)
+}
+
+func TestNewReloaderInvalidCA(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	caFile := filepath.Join(dir, "ca.crt")
+	ca, caKey := writeCA(t, caFile)
+	writeCertificate(t, ca, caKey, 1, certFile, keyFile, time.Now())
+	err := os.WriteFile(caFile, []byte("foo"), 0o600)
+	require.NoError(t, err)
+
+	_, err = NewReloader(certFile, keyFile, caFile)
+	require.EqualError(t, err, "CA does not contain any certificates")
+}
+
+func requireSerial(t *testing.T, client *http.Client, addr string, serial int64) {
+	t.Helper()
+
+	resp, err := client.Get("https://" + addr)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, big.NewInt(serial), resp.TLS.PeerCertificates[0].SerialNumber)
+}
+
+func writeCA(t *testing.T, caFile string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	b, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(b)
+	require.NoError(t, err)
+	err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b}), 0o600)
+	require.NoError(t, err)
+	return ca, key
+}
+
+func writeCertificate(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, serial int64, certFile, keyFile string, modTime time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "spegel"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	b, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	keyB, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b}), 0o600)
+	require.NoError(t, err)
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyB}), 0o600)
+	require.NoError(t, err)
+	for _, p := range []string{certFile, keyFile} {
+		err = os.Chtimes(p, modTime, modTime)
+		require.NoError(t, err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -23,16 +24,22 @@ import (
 	"k8s.io/klog/v2"
 
 	"github.com/spegel-org/spegel/internal/kubernetes"
+	"github.com/spegel-org/spegel/internal/tlsconfig"
+	"github.com/spegel-org/spegel/pkg/debug"
 	"github.com/spegel-org/spegel/pkg/metrics"
 	"github.com/spegel-org/spegel/pkg/oci"
 	"github.com/spegel-org/spegel/pkg/registry"
 	"github.com/spegel-org/spegel/pkg/routing"
 	"github.com/spegel-org/spegel/pkg/state"
 	"github.com/spegel-org/spegel/pkg/throttle"
+	"github.com/spegel-org/spegel/pkg/tracing"
 )
 
 type ConfigurationCmd struct {
 	ContainerdRegistryConfigPath string    `arg:"--containerd-registry-config-path,env:CONTAINERD_REGISTRY_CONFIG_PATH" default:"/etc/containerd/certs.d" help:"Directory where mirror configuration is written."`
+	TLSCAFile                    string    `arg:"--tls-ca-file,env:TLS_CA_FILE" help:"Path to CA certificate which Containerd uses to verify https mirrors."`
+	TLSCertFile                  string    `arg:"--tls-cert-file,env:TLS_CERT_FILE" help:"Path to client certificate which Containerd presents to https mirrors which authenticate peers."`
+	TLSKeyFile                   string    `arg:"--tls-key-file,env:TLS_KEY_FILE" help:"Path to client key which Containerd presents to https mirrors which authenticate peers."`
 	Registries                   []url.URL `arg:"--registries,required,env:REGISTRIES" help:"registries that are configured to be mirrored."`
 	MirrorRegistries             []url.URL `arg:"--mirror-registries,env:MIRROR_REGISTRIES,required" help:"registries that are configured to act as mirrors."`
 	ResolveTags                  bool      `arg:"--resolve-tags,env:RESOLVE_TAGS" default:"true" help:"When true Spegel will resolve tags to digests."`
@@ -51,18 +58,46 @@ type BootstrapConfig struct {
 type RegistryCmd struct {
 	BootstrapConfig
 	BlobSpeed                    *throttle.Byterate `arg:"--blob-speed,env:BLOB_SPEED" help:"Maximum write speed per request when serving blob layers. Should be an integer followed by unit Bps, KBps, MBps, GBps, or TBps."`
+	EgressSpeed                  *throttle.Byterate `arg:"--egress-speed,env:EGRESS_SPEED" help:"Maximum total write speed when serving blob layers, shared fairly between requesters. Should be an integer followed by unit Bps, KBps, MBps, GBps, or TBps."`
+	EgressWeights                map[string]float64 `arg:"--egress-weights,env:EGRESS_WEIGHTS" help:"Weights of requester IPs when sharing the egress speed, requesters have a weight of one by default. Should be a list of IP=weight."`
+	IngressSpeed                 *throttle.Byterate `arg:"--ingress-speed,env:INGRESS_SPEED" help:"Maximum total read speed when pulling content from peers. Should be an integer followed by unit Bps, KBps, MBps, GBps, or TBps."`
 	ContainerdRegistryConfigPath string             `arg:"--containerd-registry-config-path,env:CONTAINERD_REGISTRY_CONFIG_PATH" default:"/etc/containerd/certs.d" help:"Directory where mirror configuration is written."`
 	MetricsAddr                  string             `arg:"--metrics-addr,required,env:METRICS_ADDR" help:"address to serve metrics."`
 	LocalAddr                    string             `arg:"--local-addr,required,env:LOCAL_ADDR" help:"Address that the local Spegel instance will be reached at."`
+	LocalHosts                   []string           `arg:"--local-hosts,env:LOCAL_HOSTS" help:"Additional hosts including port that the local Spegel instance will be reached at, such as the mirror host used with TLS."`
+	TracingEndpoint              string             `arg:"--tracing-endpoint,env:TRACING_ENDPOINT" help:"URL of the OTLP HTTP endpoint which traces are exported to, for example http://otel-collector:4318. Tracing is disabled when empty."`
+	ContainerRuntime             string             `arg:"--container-runtime,env:CONTAINER_RUNTIME" default:"containerd" help:"Container runtime which images are read from. Should be containerd, crio, or oci-layout when images are only read from OCI image layouts."`
+	ContainersStorageRoot        string             `arg:"--containers-storage-root,env:CONTAINERS_STORAGE_ROOT" default:"/var/lib/containers/storage" help:"Root directory of the containers storage used by CRI-O."`
+	ContainersStorageDriver      string             `arg:"--containers-storage-driver,env:CONTAINERS_STORAGE_DRIVER" default:"overlay" help:"Driver of the containers storage used by CRI-O. Should be overlay or vfs."`
+	OCILayoutPaths               []string           `arg:"--oci-layout-paths,env:OCI_LAYOUT_PATHS" help:"Directories of OCI image layouts which images are served from in addition to the container runtime. The container runtime takes priority when content exists in both."`
 	ContainerdSock               string             `arg:"--containerd-sock,env:CONTAINERD_SOCK" default:"/run/containerd/containerd.sock" help:"Endpoint of containerd service."`
-	ContainerdNamespace          string             `arg:"--containerd-namespace,env:CONTAINERD_NAMESPACE" default:"k8s.io" help:"Containerd namespace to fetch images from."`
+	ContainerdNamespace          string             `arg:"--containerd-namespace,env:CONTAINERD_NAMESPACE" default:"k8s.io" help:"Comma separated Containerd namespaces to fetch images from, or * to fetch images from all namespaces."`
 	ContainerdContentPath        string             `arg:"--containerd-content-path,env:CONTAINERD_CONTENT_PATH" default:"/var/lib/containerd/io.containerd.content.v1.content" help:"Path to Containerd content store"`
 	RouterAddr                   string             `arg:"--router-addr,env:ROUTER_ADDR,required" help:"address to serve router."`
 	RegistryAddr                 string             `arg:"--registry-addr,env:REGISTRY_ADDR,required" help:"address to server image registry."`
+	TLSCertFile                  string             `arg:"--tls-cert-file,env:TLS_CERT_FILE" help:"Path to certificate used to serve the registry over TLS. Reloaded when modified."`
+	TLSKeyFile                   string             `arg:"--tls-key-file,env:TLS_KEY_FILE" help:"Path to key used to serve the registry over TLS. Reloaded when modified."`
+	TLSCAFile                    string             `arg:"--tls-ca-file,env:TLS_CA_FILE" help:"Path to CA certificate used to verify peers when TLS is enabled. Reloaded when modified."`
 	Registries                   []url.URL          `arg:"--registries,env:REGISTRIES,required" help:"registries that are configured to be mirrored."`
 	MirrorResolveTimeout         time.Duration      `arg:"--mirror-resolve-timeout,env:MIRROR_RESOLVE_TIMEOUT" default:"20ms" help:"Max duration spent finding a mirror."`
 	MirrorResolveRetries         int                `arg:"--mirror-resolve-retries,env:MIRROR_RESOLVE_RETRIES" default:"3" help:"Max amount of mirrors to attempt."`
+	MirrorHedgeDelay             time.Duration      `arg:"--mirror-hedge-delay,env:MIRROR_HEDGE_DELAY" default:"0s" help:"Duration to wait for response headers from a mirror before also sending the request to the next mirror. Hedging is disabled when zero."`
+	MirrorMaxHops                int                `arg:"--mirror-max-hops,env:MIRROR_MAX_HOPS" default:"1" help:"Max amount of nodes which may mirror a request. Requests from peers for content which is not available locally are mirrored again when below the max."`
+	MirrorParallelPeers          int                `arg:"--mirror-parallel-peers,env:MIRROR_PARALLEL_PEERS" default:"0" help:"Amount of peers to download large blobs from in parallel. Parallel downloads are disabled when less than two."`
+	PeerDialTimeout              time.Duration      `arg:"--peer-dial-timeout,env:PEER_DIAL_TIMEOUT" default:"30s" help:"Max duration spent connecting to a peer."`
+	PeerTLSHandshakeTimeout      time.Duration      `arg:"--peer-tls-handshake-timeout,env:PEER_TLS_HANDSHAKE_TIMEOUT" default:"10s" help:"Max duration spent on the TLS handshake with a peer."`
+	PeerResponseHeaderTimeout    time.Duration      `arg:"--peer-response-header-timeout,env:PEER_RESPONSE_HEADER_TIMEOUT" default:"0s" help:"Max duration spent waiting for response headers from a peer. Unlimited when zero."`
+	PeerKeepAlive                time.Duration      `arg:"--peer-keep-alive,env:PEER_KEEP_ALIVE" default:"30s" help:"Interval between keep-alive probes on connections to peers."`
+	PeerMaxIdleConns             int                `arg:"--peer-max-idle-conns,env:PEER_MAX_IDLE_CONNS" default:"2" help:"Max amount of idle connections kept open to each peer."`
+	MaxConcurrentUploads         int                `arg:"--max-concurrent-uploads,env:MAX_CONCURRENT_UPLOADS" default:"0" help:"Max amount of blobs served at the same time, requests above the limit are rejected so that another peer is tried. Unlimited when zero."`
+	MirrorChunkSize              int64              `arg:"--mirror-chunk-size,env:MIRROR_CHUNK_SIZE" default:"16777216" help:"Size in bytes of each byte range requested from peers during parallel downloads."`
+	MirrorParallelBufferSize     int64              `arg:"--mirror-parallel-buffer-size,env:MIRROR_PARALLEL_BUFFER_SIZE" default:"268435456" help:"Max total size in bytes of chunks buffered by all parallel downloads on the node. Blobs are downloaded from a single peer when the buffer is full. Unlimited when zero."`
 	ResolveLatestTag             bool               `arg:"--resolve-latest-tag,env:RESOLVE_LATEST_TAG" default:"true" help:"When true latest tags will be resolved to digests."`
+	PeerHTTP2                    bool               `arg:"--peer-http2,env:PEER_HTTP2" default:"false" help:"When true HTTP/2 is used for requests to peers, without TLS (h2c) if TLS is disabled."`
+	PullThrough                  bool               `arg:"--pull-through,env:PULL_THROUGH" default:"false" help:"When true content which no peer can serve is fetched from the original registry and stored locally. Only mirrored registries are pulled through from."`
+	CoalesceRequests             bool               `arg:"--mirror-coalesce-requests,env:MIRROR_COALESCE_REQUESTS" default:"false" help:"When true concurrent requests for the same blob share a single mirror request."`
+	TagsIncludePeers             bool               `arg:"--tags-include-peers,env:TAGS_INCLUDE_PEERS" default:"false" help:"When true tags advertised by peers are included when listing the tags of a repository."`
+	TLSPeerAuth                  bool               `arg:"--tls-peer-auth,env:TLS_PEER_AUTH" default:"false" help:"When true requests which are not sent from the node itself have to present a certificate signed by the CA. Requires TLS to be enabled."`
 }
 
 type Arguments struct {
@@ -107,7 +142,14 @@ func run(ctx context.Context, args *Arguments) error {
 
 func configurationCommand(ctx context.Context, args *ConfigurationCmd) error {
 	fs := afero.NewOsFs()
-	err := oci.AddMirrorConfiguration(ctx, fs, args.ContainerdRegistryConfigPath, args.Registries, args.MirrorRegistries, args.ResolveTags, args.AppendMirrors)
+	mirrorOpts := []oci.MirrorOption{}
+	if args.TLSCAFile != "" {
+		mirrorOpts = append(mirrorOpts, oci.WithMirrorCAFile(args.TLSCAFile))
+	}
+	if args.TLSCertFile != "" || args.TLSKeyFile != "" {
+		mirrorOpts = append(mirrorOpts, oci.WithMirrorClientCertificate(args.TLSCertFile, args.TLSKeyFile))
+	}
+	err := oci.AddMirrorConfiguration(ctx, fs, args.ContainerdRegistryConfigPath, args.Registries, args.MirrorRegistries, args.ResolveTags, args.AppendMirrors, mirrorOpts...)
 	if err != nil {
 		return err
 	}
@@ -118,8 +160,23 @@ func registryCommand(ctx context.Context, args *RegistryCmd) (err error) {
 	log := logr.FromContextOrDiscard(ctx)
 	g, ctx := errgroup.WithContext(ctx)
 
+	// Tracing
+	if args.TracingEndpoint != "" {
+		shutdownTracing, err := tracing.Setup(ctx, args.TracingEndpoint)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := shutdownTracing(shutdownCtx); err != nil {
+				log.Error(err, "could not flush traces")
+			}
+		}()
+	}
+
 	// OCI Client
-	ociClient, err := oci.NewContainerd(args.ContainerdSock, args.ContainerdNamespace, args.ContainerdRegistryConfigPath, args.Registries, oci.WithContentPath(args.ContainerdContentPath))
+	ociClient, err := getOCIClient(args)
 	if err != nil {
 		return err
 	}
@@ -179,9 +236,19 @@ func registryCommand(ctx context.Context, args *RegistryCmd) (err error) {
 		return router.Close()
 	})
 
+	// Debug
+	debugOpts := []debug.Option{
+		debug.WithBootstrapper(bootstrapper),
+		debug.WithResolveLatestTag(args.ResolveLatestTag),
+		debug.WithRepositoryKeys(args.TagsIncludePeers),
+		debug.WithLogger(log),
+	}
+	debug.NewDebug(ociClient, router, debugOpts...).Register(mux)
+
 	// State tracking
+	contentKeys := state.NewContentKeys()
 	g.Go(func() error {
-		err := state.Track(ctx, ociClient, router, args.ResolveLatestTag)
+		err := state.Track(ctx, ociClient, router, args.ResolveLatestTag, state.WithContentKeys(contentKeys), state.WithRepositoryKeys(args.TagsIncludePeers))
 		if err != nil {
 			return err
 		}
@@ -193,19 +260,67 @@ func registryCommand(ctx context.Context, args *RegistryCmd) (err error) {
 		registry.WithResolveLatestTag(args.ResolveLatestTag),
 		registry.WithResolveRetries(args.MirrorResolveRetries),
 		registry.WithResolveTimeout(args.MirrorResolveTimeout),
+		registry.WithHedgeDelay(args.MirrorHedgeDelay),
+		registry.WithMaxHops(args.MirrorMaxHops),
+		registry.WithParallelPeers(args.MirrorParallelPeers),
+		registry.WithChunkSize(args.MirrorChunkSize),
+		registry.WithParallelBufferSize(args.MirrorParallelBufferSize),
+		registry.WithPullThrough(args.PullThrough),
+		registry.WithPullThroughRegistries(args.Registries),
+		registry.WithContentKeys(contentKeys),
+		registry.WithCoalesceRequests(args.CoalesceRequests),
+		registry.WithPeerTags(args.TagsIncludePeers),
+		registry.WithMaxConcurrentUploads(args.MaxConcurrentUploads),
+		registry.WithDialTimeout(args.PeerDialTimeout),
+		registry.WithTLSHandshakeTimeout(args.PeerTLSHandshakeTimeout),
+		registry.WithResponseHeaderTimeout(args.PeerResponseHeaderTimeout),
+		registry.WithKeepAlive(args.PeerKeepAlive),
+		registry.WithMaxIdleConnsPerPeer(args.PeerMaxIdleConns),
+		registry.WithHTTP2(args.PeerHTTP2),
 		registry.WithLocalAddress(args.LocalAddr),
+		registry.WithLocalHosts(args.LocalHosts),
 		registry.WithLogger(log),
 	}
 	if args.BlobSpeed != nil {
 		registryOpts = append(registryOpts, registry.WithBlobSpeed(*args.BlobSpeed))
 	}
+	if args.EgressSpeed != nil {
+		registryOpts = append(registryOpts, registry.WithEgressSpeed(*args.EgressSpeed), registry.WithEgressWeights(args.EgressWeights))
+	}
+	if args.IngressSpeed != nil {
+		registryOpts = append(registryOpts, registry.WithIngressSpeed(*args.IngressSpeed))
+	}
+	if args.TLSCertFile != "" || args.TLSKeyFile != "" || args.TLSCAFile != "" {
+		if args.TLSCertFile == "" || args.TLSKeyFile == "" || args.TLSCAFile == "" {
+			return errors.New("tls cert, key, and CA files all have to be set to enable TLS")
+		}
+		reloader, err := tlsconfig.NewReloader(args.TLSCertFile, args.TLSKeyFile, args.TLSCAFile)
+		if err != nil {
+			return err
+		}
+		registryOpts = append(registryOpts, registry.WithTLSConfig(reloader.ServerConfig()), registry.WithPeerTLSConfig(reloader.ClientConfig()))
+	}
+	if args.TLSPeerAuth {
+		if args.TLSCertFile == "" {
+			return errors.New("TLS has to be enabled to authenticate peers")
+		}
+		registryOpts = append(registryOpts, registry.WithPeerAuthentication(true))
+	}
 	reg := registry.NewRegistry(ociClient, router, registryOpts...)
+	mux.HandleFunc("/debug/spegel/peers", reg.PeerHealthHandler)
 	regSrv, err := reg.Server(args.RegistryAddr)
 	if err != nil {
 		return err
 	}
 	g.Go(func() error {
-		if err := regSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		serve := regSrv.ListenAndServe
+		if regSrv.TLSConfig != nil {
+			// Certificates are provided by the TLS config.
+			serve = func() error {
+				return regSrv.ListenAndServeTLS("", "")
+			}
+		}
+		if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			return err
 		}
 		return nil
@@ -225,6 +340,39 @@ func registryCommand(ctx context.Context, args *RegistryCmd) (err error) {
 	return nil
 }
 
+func getOCIClient(args *RegistryCmd) (oci.Client, error) { //nolint: ireturn // Return type can be different structs.
+	clients := []oci.Client{}
+	switch args.ContainerRuntime {
+	case "containerd":
+		containerdClient, err := oci.NewContainerd(args.ContainerdSock, strings.Split(args.ContainerdNamespace, ","), args.ContainerdRegistryConfigPath, args.Registries, oci.WithContentPath(args.ContainerdContentPath))
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, containerdClient)
+	case "crio":
+		containersStorage, err := oci.NewContainersStorage(args.ContainersStorageRoot, args.ContainersStorageDriver, args.Registries)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, containersStorage)
+	case "oci-layout":
+	default:
+		return nil, fmt.Errorf("unknown container runtime %s", args.ContainerRuntime)
+	}
+	if len(args.OCILayoutPaths) > 0 || args.ContainerRuntime == "oci-layout" {
+		ociLayout, err := oci.NewOCILayout(args.OCILayoutPaths, args.Registries)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, ociLayout)
+	}
+	// Content of the container runtime takes priority over other sources.
+	if len(clients) == 1 {
+		return clients[0], nil
+	}
+	return oci.NewComposite(clients...)
+}
+
 func getBootstrapper(cfg BootstrapConfig) (routing.Bootstrapper, error) { //nolint: ireturn // Return type can be different structs.
 	switch cfg.BootstrapKind {
 	case "http":
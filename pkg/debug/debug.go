@@ -0,0 +1,218 @@
+package debug
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/spegel-org/spegel/pkg/oci"
+	"github.com/spegel-org/spegel/pkg/routing"
+	"github.com/spegel-org/spegel/pkg/state"
+)
+
+const (
+	defaultResolveTimeout = 2 * time.Second
+	bootstrapTimeout      = 5 * time.Second
+)
+
+// p2pRouter is implemented by routers which expose the state of the libp2p host.
+type p2pRouter interface {
+	Self() routing.PeerInfo
+	RoutingTable() []routing.PeerInfo
+	ConnectedPeers() []routing.PeerInfo
+}
+
+// Debug serves read only JSON endpoints describing the state of the node.
+type Debug struct {
+	ociClient        oci.Client
+	router           routing.Router
+	bootstrapper     routing.Bootstrapper
+	log              logr.Logger
+	resolveTimeout   time.Duration
+	resolveLatestTag bool
+	repositoryKeys   bool
+}
+
+type Option func(*Debug)
+
+func WithBootstrapper(bootstrapper routing.Bootstrapper) Option {
+	return func(d *Debug) {
+		d.bootstrapper = bootstrapper
+	}
+}
+
+func WithResolveLatestTag(resolveLatestTag bool) Option {
+	return func(d *Debug) {
+		d.resolveLatestTag = resolveLatestTag
+	}
+}
+
+func WithRepositoryKeys(repositoryKeys bool) Option {
+	return func(d *Debug) {
+		d.repositoryKeys = repositoryKeys
+	}
+}
+
+func WithResolveTimeout(resolveTimeout time.Duration) Option {
+	return func(d *Debug) {
+		d.resolveTimeout = resolveTimeout
+	}
+}
+
+func WithLogger(log logr.Logger) Option {
+	return func(d *Debug) {
+		d.log = log
+	}
+}
+
+func NewDebug(ociClient oci.Client, router routing.Router, opts ...Option) *Debug {
+	d := &Debug{
+		ociClient:        ociClient,
+		router:           router,
+		log:              logr.Discard(),
+		resolveTimeout:   defaultResolveTimeout,
+		resolveLatestTag: true,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Register adds the debug endpoints to the mux.
+func (d *Debug) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/spegel/keys", d.keysHandler)
+	mux.HandleFunc("GET /debug/spegel/resolve", d.resolveHandler)
+	mux.HandleFunc("GET /debug/spegel/p2p", d.p2pHandler)
+	mux.HandleFunc("GET /debug/spegel/bootstrap", d.bootstrapHandler)
+}
+
+func (d *Debug) keysHandler(rw http.ResponseWriter, req *http.Request) {
+	keys, err := state.Keys(req.Context(), d.ociClient, d.resolveLatestTag, d.repositoryKeys)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d.writeJSON(rw, keys)
+}
+
+// ResolveResult contains the peers which a key was resolved to.
+type ResolveResult struct {
+	Key   string           `json:"key"`
+	Peers []netip.AddrPort `json:"peers"`
+}
+
+func (d *Debug) resolveHandler(rw http.ResponseWriter, req *http.Request) {
+	ref := req.URL.Query().Get("ref")
+	if ref == "" {
+		http.Error(rw, "ref query parameter is required", http.StatusBadRequest)
+		return
+	}
+	// Image references containing a digest are resolved by their digest, everything else is resolved as is.
+	key := ref
+	if img, err := oci.Parse(ref, ""); err == nil {
+		key = img.Digest.String()
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), d.resolveTimeout)
+	defer cancel()
+	peerCh, err := d.router.Resolve(ctx, key, true, 0)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := ResolveResult{
+		Key:   key,
+		Peers: []netip.AddrPort{},
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			d.writeJSON(rw, result)
+			return
+		case peer, ok := <-peerCh:
+			if !ok {
+				d.writeJSON(rw, result)
+				return
+			}
+			result.Peers = append(result.Peers, peer)
+		}
+	}
+}
+
+// P2PResult contains the state of the libp2p host.
+type P2PResult struct {
+	Self           routing.PeerInfo   `json:"self"`
+	RoutingTable   []routing.PeerInfo `json:"routingTable"`
+	ConnectedPeers []routing.PeerInfo `json:"connectedPeers"`
+}
+
+func (d *Debug) p2pHandler(rw http.ResponseWriter, req *http.Request) {
+	p2p, ok := d.router.(p2pRouter)
+	if !ok {
+		http.Error(rw, "router does not use libp2p", http.StatusNotFound)
+		return
+	}
+	d.writeJSON(rw, P2PResult{
+		Self:           p2p.Self(),
+		RoutingTable:   p2p.RoutingTable(),
+		ConnectedPeers: p2p.ConnectedPeers(),
+	})
+}
+
+// BootstrapResult contains the current bootstrap leader.
+type BootstrapResult struct {
+	Leader routing.PeerInfo `json:"leader"`
+}
+
+func (d *Debug) bootstrapHandler(rw http.ResponseWriter, req *http.Request) {
+	if d.bootstrapper == nil {
+		http.Error(rw, "bootstrapper is not configured", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), bootstrapTimeout)
+	defer cancel()
+	addrInfo, err := getLeader(ctx, d.bootstrapper)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	d.writeJSON(rw, BootstrapResult{Leader: routing.NewPeerInfo(*addrInfo)})
+}
+
+// getLeader returns the bootstrap leader, giving up when the context is done as the bootstrapper may block until a leader is elected.
+func getLeader(ctx context.Context, bootstrapper routing.Bootstrapper) (*peer.AddrInfo, error) {
+	type result struct {
+		addrInfo *peer.AddrInfo
+		err      error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		addrInfo, err := bootstrapper.Get()
+		resultCh <- result{addrInfo: addrInfo, err: err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, errors.New("timed out waiting for bootstrap leader")
+	case res := <-resultCh:
+		return res.addrInfo, res.err
+	}
+}
+
+func (d *Debug) writeJSON(rw http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_, err = rw.Write(b)
+	if err != nil {
+		d.log.Error(err, "error occurred when writing debug response")
+	}
+}
@@ -0,0 +1,129 @@
+package debug
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spegel-org/spegel/pkg/oci"
+	"github.com/spegel-org/spegel/pkg/routing"
+)
+
+type staticBootstrapper struct {
+	addrInfo *peer.AddrInfo
+	err      error
+}
+
+func (s *staticBootstrapper) Run(ctx context.Context, id string) error {
+	return nil
+}
+
+func (s *staticBootstrapper) Get() (*peer.AddrInfo, error) {
+	return s.addrInfo, s.err
+}
+
+func TestDebug(t *testing.T) {
+	t.Parallel()
+
+	img, err := oci.Parse("ghcr.io/spegel-org/spegel:v0.0.9@sha256:fa32bd3bcd49a45a62cfc1b0fed6a0b63bf8af95db5bad7ec22865aee0a4b795", "")
+	require.NoError(t, err)
+	ociClient := oci.NewMockClient([]oci.Image{img})
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{
+		img.Digest.String():                {netip.MustParseAddrPort("10.0.0.1:5000")},
+		"ghcr.io/spegel-org/spegel:v0.0.9": {netip.MustParseAddrPort("10.0.0.2:5000")},
+	}, netip.AddrPort{})
+	addr, err := multiaddr.NewMultiaddr("/ip4/10.0.0.1/tcp/5001/p2p/12D3KooWEaKyH3GcKK9Tq5A1G5LQ2WKmLvWvjmRUrZo1FqRdJZt4")
+	require.NoError(t, err)
+	addrInfo, err := peer.AddrInfoFromP2pAddr(addr)
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	NewDebug(ociClient, router, WithBootstrapper(&staticBootstrapper{addrInfo: addrInfo}), WithRepositoryKeys(true), WithResolveTimeout(time.Second)).Register(mux)
+
+	tests := []struct {
+		name           string
+		target         string
+		expectedBody   string
+		expectedStatus int
+	}{
+		{
+			name:           "keys",
+			target:         "/debug/spegel/keys",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `[{"key":"ghcr.io/spegel-org/spegel:v0.0.9","images":["ghcr.io/spegel-org/spegel:v0.0.9@sha256:fa32bd3bcd49a45a62cfc1b0fed6a0b63bf8af95db5bad7ec22865aee0a4b795"]},{"key":"repository/ghcr.io/spegel-org/spegel","images":["ghcr.io/spegel-org/spegel:v0.0.9@sha256:fa32bd3bcd49a45a62cfc1b0fed6a0b63bf8af95db5bad7ec22865aee0a4b795"]},{"key":"sha256:fa32bd3bcd49a45a62cfc1b0fed6a0b63bf8af95db5bad7ec22865aee0a4b795","images":["ghcr.io/spegel-org/spegel:v0.0.9@sha256:fa32bd3bcd49a45a62cfc1b0fed6a0b63bf8af95db5bad7ec22865aee0a4b795"]}]`,
+		},
+		{
+			name:           "resolve digest image reference",
+			target:         "/debug/spegel/resolve?ref=ghcr.io/spegel-org/spegel:v0.0.9@sha256:fa32bd3bcd49a45a62cfc1b0fed6a0b63bf8af95db5bad7ec22865aee0a4b795",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"key":"sha256:fa32bd3bcd49a45a62cfc1b0fed6a0b63bf8af95db5bad7ec22865aee0a4b795","peers":["10.0.0.1:5000"]}`,
+		},
+		{
+			name:           "resolve tag image reference",
+			target:         "/debug/spegel/resolve?ref=ghcr.io/spegel-org/spegel:v0.0.9",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"key":"ghcr.io/spegel-org/spegel:v0.0.9","peers":["10.0.0.2:5000"]}`,
+		},
+		{
+			name:           "resolve unknown key",
+			target:         "/debug/spegel/resolve?ref=foo",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"key":"foo","peers":[]}`,
+		},
+		{
+			name:           "resolve without ref",
+			target:         "/debug/spegel/resolve",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "p2p with memory router",
+			target:         "/debug/spegel/p2p",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "bootstrap leader",
+			target:         "/debug/spegel/bootstrap",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"leader":{"id":"12D3KooWEaKyH3GcKK9Tq5A1G5LQ2WKmLvWvjmRUrZo1FqRdJZt4","addresses":["/ip4/10.0.0.1/tcp/5001"]}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			mux.ServeHTTP(rw, req)
+			require.Equal(t, tt.expectedStatus, rw.Code)
+			if tt.expectedBody == "" {
+				return
+			}
+			require.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+			require.JSONEq(t, tt.expectedBody, rw.Body.String())
+		})
+	}
+}
+
+func TestBootstrapError(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+	NewDebug(nil, nil, WithBootstrapper(&staticBootstrapper{err: errors.New("no leader")})).Register(mux)
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/debug/spegel/bootstrap", nil)
+	mux.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	require.Equal(t, "no leader\n", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/debug/spegel/bootstrap", nil)
+	mux.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+}
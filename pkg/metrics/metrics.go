@@ -19,6 +19,10 @@ var (
 		Name: "spegel_mirror_requests_total",
 		Help: "Total number of mirror requests.",
 	}, []string{"registry", "cache", "source"})
+	MirrorDigestMismatchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spegel_mirror_digest_mismatches_total",
+		Help: "Total number of mirror responses with content not matching the requested digest.",
+	}, []string{"registry"})
 	ResolveDurHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "spegel_resolve_duration_seconds",
 		Help: "The duration for router to resolve a peer.",
@@ -26,19 +30,63 @@ var (
 	AdvertisedImages = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "spegel_advertised_images",
 		Help: "Number of images advertised to be available.",
-	}, []string{"registry"})
+	}, []string{"registry", "namespace"})
 	AdvertisedImageTags = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "spegel_advertised_image_tags",
 		Help: "Number of image tags advertised to be available.",
-	}, []string{"registry"})
+	}, []string{"registry", "namespace"})
 	AdvertisedImageDigests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "spegel_advertised_image_digests",
 		Help: "Number of image digests advertised to be available.",
-	}, []string{"registry"})
+	}, []string{"registry", "namespace"})
 	AdvertisedKeys = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "spegel_advertised_keys",
 		Help: "Number of keys advertised to be available.",
-	}, []string{"registry"})
+	}, []string{"registry", "namespace"})
+	EgressQueuedBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "spegel_egress_queued_bytes",
+		Help: "Number of bytes waiting for bandwidth from the node egress limit.",
+	})
+	EgressWaitDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "spegel_egress_wait_duration_seconds",
+		Help: "The duration writes waited for bandwidth from the node egress limit.",
+	})
+	IngressThrottledBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "spegel_ingress_throttled_bytes_total",
+		Help: "Total number of bytes pulled from peers which were delayed by the ingress limit.",
+	})
+	BlobUploadsQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "spegel_blob_uploads_queued",
+		Help: "Number of blob requests waiting for a free upload slot.",
+	})
+	BlobUploadsRejectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "spegel_blob_uploads_rejected_total",
+		Help: "Total number of blob requests rejected because the max concurrent uploads was reached.",
+	})
+	PeerHealthScore = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "spegel_peer_health_score",
+		Help: "Health score of peers between zero and one, based on the success rate of mirror requests.",
+	}, []string{"peer"})
+	PeerCircuitOpenedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "spegel_peer_circuit_opened_total",
+		Help: "Total number of times a peer was skipped after repeatedly failing mirror requests.",
+	})
+	MirrorHedgedRequestsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "spegel_mirror_hedged_requests_total",
+		Help: "Total number of mirror requests sent to another peer because the first peer was slow to respond.",
+	})
+	MirrorHedgeWinsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "spegel_mirror_hedge_wins_total",
+		Help: "Total number of hedged mirror requests where the response from the other peer was used.",
+	})
+	MirrorResumesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "spegel_mirror_resumes_total",
+		Help: "Total number of blob transfers resumed from another peer after the peer failed during the transfer.",
+	})
+	PeerConnectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spegel_peer_connections_total",
+		Help: "Total number of connections used for requests to peers, by whether an idle connection was reused.",
+	}, []string{"reused"})
 	HttpRequestDurHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Subsystem: "http",
 		Name:      "request_duration_seconds",
@@ -58,11 +106,23 @@ var (
 
 func Register() {
 	DefaultRegisterer.MustRegister(MirrorRequestsTotal)
+	DefaultRegisterer.MustRegister(MirrorDigestMismatchesTotal)
 	DefaultRegisterer.MustRegister(ResolveDurHistogram)
 	DefaultRegisterer.MustRegister(AdvertisedImages)
 	DefaultRegisterer.MustRegister(AdvertisedImageTags)
 	DefaultRegisterer.MustRegister(AdvertisedImageDigests)
 	DefaultRegisterer.MustRegister(AdvertisedKeys)
+	DefaultRegisterer.MustRegister(EgressQueuedBytes)
+	DefaultRegisterer.MustRegister(EgressWaitDuration)
+	DefaultRegisterer.MustRegister(IngressThrottledBytesTotal)
+	DefaultRegisterer.MustRegister(BlobUploadsQueued)
+	DefaultRegisterer.MustRegister(BlobUploadsRejectedTotal)
+	DefaultRegisterer.MustRegister(PeerHealthScore)
+	DefaultRegisterer.MustRegister(PeerCircuitOpenedTotal)
+	DefaultRegisterer.MustRegister(MirrorHedgedRequestsTotal)
+	DefaultRegisterer.MustRegister(MirrorHedgeWinsTotal)
+	DefaultRegisterer.MustRegister(MirrorResumesTotal)
+	DefaultRegisterer.MustRegister(PeerConnectionsTotal)
 	DefaultRegisterer.MustRegister(HttpRequestDurHistogram)
 	DefaultRegisterer.MustRegister(HttpResponseSizeHistogram)
 	DefaultRegisterer.MustRegister(HttpRequestsInflight)
@@ -0,0 +1,250 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/spegel-org/spegel/internal/channel"
+)
+
+var (
+	_ Client        = &Composite{}
+	_ ContentWriter = &Composite{}
+)
+
+// Composite combines multiple clients into one. The order of the clients is their priority, content
+// is read from the first client which has it and image names are resolved by the first client which
+// contains the name.
+type Composite struct {
+	clients []Client
+}
+
+func NewComposite(clients ...Client) (*Composite, error) {
+	if len(clients) == 0 {
+		return nil, errors.New("at least one client is required")
+	}
+	return &Composite{
+		clients: clients,
+	}, nil
+}
+
+func (c *Composite) Name() string {
+	names := []string{}
+	for _, client := range c.clients {
+		names = append(names, client.Name())
+	}
+	return strings.Join(names, "+")
+}
+
+func (c *Composite) Verify(ctx context.Context) error {
+	errs := []error{}
+	for _, client := range c.clients {
+		err := client.Verify(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", client.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Ready returns true when all clients are ready.
+func (c *Composite) Ready(ctx context.Context) (bool, error) {
+	for _, client := range c.clients {
+		ok, err := client.Ready(ctx)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", client.Name(), err)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Subscribe merges the events and errors of all clients. Events are passed on as is, an image removed
+// from one client may still be served by another.
+func (c *Composite) Subscribe(ctx context.Context) (<-chan ImageEvent, <-chan error, error) {
+	imgChs := []<-chan ImageEvent{}
+	errChs := []<-chan error{}
+	for _, client := range c.clients {
+		imgCh, errCh, err := client.Subscribe(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not subscribe to %s: %w", client.Name(), err)
+		}
+		// Clients which do not produce events return nil channels.
+		if imgCh != nil {
+			imgChs = append(imgChs, imgCh)
+		}
+		if errCh != nil {
+			errChs = append(errChs, errCh)
+		}
+	}
+	return channel.Merge(imgChs...), channel.Merge(errChs...), nil
+}
+
+// ListImages returns the images of all clients. An image name which exists in multiple clients is
+// only returned once, with the digest of the client with the highest priority.
+func (c *Composite) ListImages(ctx context.Context) (_ []Image, err error) {
+	ctx, span := startSpan(ctx, "Composite.ListImages")
+	defer func() {
+		endSpan(span, err)
+	}()
+	seen := map[string]struct{}{}
+	imgs := []Image{}
+	for _, client := range c.clients {
+		clientImgs, err := client.ListImages(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not list images from %s: %w", client.Name(), err)
+		}
+		for _, img := range clientImgs {
+			if _, ok := seen[img.Name]; ok {
+				continue
+			}
+			seen[img.Name] = struct{}{}
+			imgs = append(imgs, img)
+		}
+	}
+	return imgs, nil
+}
+
+// AllIdentifiers returns the identifiers of the image from all clients, as the content of an image
+// may be spread across them. An error is only returned if no client is able to walk the image.
+func (c *Composite) AllIdentifiers(ctx context.Context, img Image) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "Composite.AllIdentifiers", attribute.String("image", img.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	errs := []error{}
+	seen := map[string]struct{}{}
+	keys := []string{}
+	for _, client := range c.clients {
+		clientKeys, err := client.AllIdentifiers(ctx, img)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", client.Name(), err))
+			continue
+		}
+		for _, key := range clientKeys {
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	if len(errs) == len(c.clients) {
+		return nil, errors.Join(errs...)
+	}
+	return keys, nil
+}
+
+func (c *Composite) Resolve(ctx context.Context, ref string) (_ digest.Digest, err error) {
+	ctx, span := startSpan(ctx, "Composite.Resolve", attribute.String("ref", ref))
+	defer func() {
+		endSpan(span, err)
+	}()
+	errs := []error{}
+	for _, client := range c.clients {
+		dgst, err := client.Resolve(ctx, ref)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", client.Name(), err))
+			continue
+		}
+		return dgst, nil
+	}
+	return "", errors.Join(errs...)
+}
+
+func (c *Composite) Size(ctx context.Context, dgst digest.Digest) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "Composite.Size", attribute.String("digest", dgst.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	errs := []error{}
+	for _, client := range c.clients {
+		size, err := client.Size(ctx, dgst)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", client.Name(), err))
+			continue
+		}
+		return size, nil
+	}
+	return 0, errors.Join(errs...)
+}
+
+func (c *Composite) GetManifest(ctx context.Context, dgst digest.Digest) (_ []byte, _ string, err error) {
+	ctx, span := startSpan(ctx, "Composite.GetManifest", attribute.String("digest", dgst.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	errs := []error{}
+	for _, client := range c.clients {
+		b, mediaType, err := client.GetManifest(ctx, dgst)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", client.Name(), err))
+			continue
+		}
+		return b, mediaType, nil
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+func (c *Composite) GetBlob(ctx context.Context, dgst digest.Digest) (_ io.ReadSeekCloser, err error) {
+	ctx, span := startSpan(ctx, "Composite.GetBlob", attribute.String("digest", dgst.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	errs := []error{}
+	for _, client := range c.clients {
+		rc, err := client.GetBlob(ctx, dgst)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", client.Name(), err))
+			continue
+		}
+		return rc, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// ListReferrers returns the referrers from all clients.
+func (c *Composite) ListReferrers(ctx context.Context, dgst digest.Digest) (_ []ocispec.Descriptor, err error) {
+	ctx, span := startSpan(ctx, "Composite.ListReferrers", attribute.String("digest", dgst.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	seen := map[digest.Digest]struct{}{}
+	referrers := []ocispec.Descriptor{}
+	for _, client := range c.clients {
+		clientReferrers, err := client.ListReferrers(ctx, dgst)
+		if err != nil {
+			return nil, fmt.Errorf("could not list referrers from %s: %w", client.Name(), err)
+		}
+		for _, referrer := range clientReferrers {
+			if _, ok := seen[referrer.Digest]; ok {
+				continue
+			}
+			seen[referrer.Digest] = struct{}{}
+			referrers = append(referrers, referrer)
+		}
+	}
+	return referrers, nil
+}
+
+// NewBlobWriter writes content to the first client which supports writing content.
+func (c *Composite) NewBlobWriter(ctx context.Context, desc ocispec.Descriptor) (BlobWriter, error) { //nolint: ireturn // Implements the ContentWriter interface.
+	for _, client := range c.clients {
+		cw, ok := client.(ContentWriter)
+		if !ok {
+			continue
+		}
+		return cw.NewBlobWriter(ctx, desc)
+	}
+	return nil, fmt.Errorf("none of the clients %s support writing content: %w", c.Name(), errdefs.ErrNotImplemented)
+}
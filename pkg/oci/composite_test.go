@@ -0,0 +1,139 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComposite(t *testing.T) {
+	t.Parallel()
+
+	fixture := writeLayoutFixture(t)
+	ol, err := NewOCILayout([]string{fixture.path}, []url.URL{{Host: "docker.io"}})
+	require.NoError(t, err)
+	mockImgs := []Image{
+		{Name: "docker.io/library/test:1.0", Registry: "docker.io", Repository: "library/test", Tag: "1.0", Digest: digest.FromString("older")},
+		{Name: "docker.io/library/other:1.0", Registry: "docker.io", Repository: "library/other", Tag: "1.0", Digest: digest.FromString("other")},
+	}
+	mock := NewMockClient(mockImgs)
+	mockBlob := mock.AddBlob([]byte("mock content"))
+	b, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.DescriptorEmptyJSON,
+		Subject:   &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: fixture.manifest},
+	})
+	require.NoError(t, err)
+	mockReferrer := mock.AddBlob(b)
+	composite, err := NewComposite(ol, mock)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.Equal(t, "oci-layout+mock", composite.Name())
+	require.NoError(t, composite.Verify(ctx))
+	ready, err := composite.Ready(ctx)
+	require.NoError(t, err)
+	require.True(t, ready)
+
+	imgs, err := composite.ListImages(ctx)
+	require.NoError(t, err)
+	require.Len(t, imgs, 2)
+	require.Equal(t, "docker.io/library/test:1.0", imgs[0].Name)
+	require.Equal(t, fixture.index, imgs[0].Digest)
+	require.Equal(t, mockImgs[1], imgs[1])
+
+	dgst, err := composite.Resolve(ctx, "docker.io/library/test:1.0")
+	require.NoError(t, err)
+	require.Equal(t, fixture.index, dgst)
+
+	keys, err := composite.AllIdentifiers(ctx, imgs[0])
+	require.NoError(t, err)
+	require.Equal(t, []string{fixture.index.String(), fixture.manifest.String(), fixture.config.String(), fixture.layer.String()}, keys)
+	keys, err = composite.AllIdentifiers(ctx, imgs[1])
+	require.NoError(t, err)
+	require.Equal(t, []string{mockImgs[1].Digest.String()}, keys)
+
+	_, mediaType, err := composite.GetManifest(ctx, fixture.manifest)
+	require.NoError(t, err)
+	require.Equal(t, ocispec.MediaTypeImageManifest, mediaType)
+
+	for _, dgst := range []digest.Digest{fixture.layer, mockBlob} {
+		rc, err := composite.GetBlob(ctx, dgst)
+		require.NoError(t, err)
+		b, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		require.Equal(t, dgst, digest.FromBytes(b))
+		size, err := composite.Size(ctx, dgst)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(b)), size)
+	}
+	_, err = composite.Size(ctx, digest.FromString("missing"))
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+	_, err = composite.GetBlob(ctx, digest.FromString("missing"))
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+
+	referrers, err := composite.ListReferrers(ctx, fixture.manifest)
+	require.NoError(t, err)
+	require.Len(t, referrers, 2)
+	require.Equal(t, fixture.referrer, referrers[0].Digest)
+	require.Equal(t, mockReferrer, referrers[1].Digest)
+
+	content := []byte("written content")
+	w, err := composite.NewBlobWriter(ctx, ocispec.Descriptor{Digest: digest.FromBytes(content), Size: int64(len(content))})
+	require.NoError(t, err)
+	_, err = w.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, w.Commit(ctx))
+	require.NoError(t, w.Close())
+	_, err = mock.Size(ctx, digest.FromBytes(content))
+	require.NoError(t, err)
+
+	composite, err = NewComposite(ol)
+	require.NoError(t, err)
+	_, err = composite.NewBlobWriter(ctx, ocispec.Descriptor{})
+	require.ErrorIs(t, err, errdefs.ErrNotImplemented)
+}
+
+func TestCompositeSubscribe(t *testing.T) {
+	t.Parallel()
+
+	fixture := writeLayoutFixture(t)
+	ol, err := NewOCILayout([]string{fixture.path}, []url.URL{{Host: "docker.io"}})
+	require.NoError(t, err)
+	composite, err := NewComposite(NewMockClient(nil), ol)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	imgCh, _, err := composite.Subscribe(ctx)
+	require.NoError(t, err)
+
+	indexPath := filepath.Join(fixture.path, ocispec.ImageIndexFile)
+	b, err := os.ReadFile(indexPath)
+	require.NoError(t, err)
+	var index ocispec.Index
+	require.NoError(t, json.Unmarshal(b, &index))
+	index.Manifests = append(index.Manifests, ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Digest:      fixture.manifest,
+		Annotations: map[string]string{images.AnnotationImageName: "docker.io/library/test:2.0"},
+	})
+	b, err = json.Marshal(index)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(indexPath, b, 0o644))
+
+	event := <-imgCh
+	require.Equal(t, CreateEvent, event.Type)
+	require.Equal(t, "docker.io/library/test:2.0", event.Image.Name)
+	require.Equal(t, fixture.manifest, event.Image.Digest)
+}
@@ -6,40 +6,72 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/containerd/containerd"
 	eventtypes "github.com/containerd/containerd/api/events"
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/typeurl/v2"
 	"github.com/go-logr/logr"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pelletier/go-toml/v2"
 	"github.com/spf13/afero"
+	"go.opentelemetry.io/otel/attribute"
 	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
-
-	"github.com/spegel-org/spegel/internal/channel"
 )
 
 const (
 	backupDir = "_backup"
+	// contentLeaseExpiration is how long written content is protected from garbage collection.
+	// Content which is not referenced by an image before the lease expires will be removed.
+	contentLeaseExpiration = 24 * time.Hour
+	// namespaceWildcard selects all Containerd namespaces, including those created after startup.
+	namespaceWildcard = "*"
+	// criNamespace is the namespace used by the Kubernetes CRI plugin.
+	criNamespace = "k8s.io"
+	// Delays between attempts to reconnect to Containerd after the event stream has ended.
+	reconnectMinDelay = 1 * time.Second
+	reconnectMaxDelay = 30 * time.Second
 )
 
-var _ Client = &Containerd{}
+var (
+	_ Client        = &Containerd{}
+	_ ContentWriter = &Containerd{}
+)
 
 type Containerd struct {
-	contentPath        string
-	client             *containerd.Client
 	clientGetter       func() (*containerd.Client, error)
+	client             *containerd.Client
+	contentPath        string
 	listFilter         string
 	eventFilter        string
 	registryConfigPath string
+	referrers          map[digest.Digest]referrerEntry
+	namespaces         []string
+	mx                 sync.Mutex
+	referrersMx        sync.Mutex
+	disconnected       atomic.Bool
+}
+
+// referrerEntry is the parsed referrer of an image target, ok is false if it does not have a subject.
+type referrerEntry struct {
+	subject  digest.Digest
+	referrer ocispec.Descriptor
+	ok       bool
 }
 
 type Option func(*Containerd)
@@ -50,15 +82,25 @@ func WithContentPath(path string) Option {
 	}
 }
 
-func NewContainerd(sock, namespace, registryConfigPath string, registries []url.URL, opts ...Option) (*Containerd, error) {
+// NewContainerd creates a client which reads images from the namespaces, or all namespaces if it contains the wildcard.
+// Written content is stored in the first namespace, or the CRI namespace when all namespaces are read.
+func NewContainerd(sock string, namespaces []string, registryConfigPath string, registries []url.URL, opts ...Option) (*Containerd, error) {
+	if len(namespaces) == 0 {
+		return nil, errors.New("at least one Containerd namespace is required")
+	}
+	defaultNamespace := namespaces[0]
+	if slices.Contains(namespaces, namespaceWildcard) {
+		defaultNamespace = criNamespace
+	}
 	listFilter, eventFilter := createFilters(registries)
 	c := &Containerd{
 		clientGetter: func() (*containerd.Client, error) {
-			return containerd.New(sock, containerd.WithDefaultNamespace(namespace))
+			return containerd.New(sock, containerd.WithDefaultNamespace(defaultNamespace))
 		},
 		listFilter:         listFilter,
 		eventFilter:        eventFilter,
 		registryConfigPath: registryConfigPath,
+		namespaces:         namespaces,
 	}
 	for _, opt := range opts {
 		opt(c)
@@ -67,6 +109,8 @@ func NewContainerd(sock, namespace, registryConfigPath string, registries []url.
 }
 
 func (c *Containerd) Client() (*containerd.Client, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
 	var err error
 	if c.client == nil {
 		c.client, err = c.clientGetter()
@@ -136,6 +180,14 @@ func verifyStatusResponse(resp *runtimeapi.StatusResponse, configPath string) er
 	return fmt.Errorf("Containerd registry config path is %s but needs to contain path %s for mirror configuration to take effect", cfg.Registry.ConfigPath, configPath)
 }
 
+// Ready returns false while the connection to Containerd is lost.
+func (c *Containerd) Ready(ctx context.Context) (bool, error) {
+	return !c.disconnected.Load(), nil
+}
+
+// Subscribe streams image events until the context is cancelled. When the event stream ends, for example because
+// Containerd is restarted, the client reconnects and subscribes again. ErrResyncRequired is sent on the error channel
+// after subscribing again as events may have been missed while disconnected.
 func (c *Containerd) Subscribe(ctx context.Context) (<-chan ImageEvent, <-chan error, error) {
 	imgCh := make(chan ImageEvent)
 	errCh := make(chan error)
@@ -143,70 +195,146 @@ func (c *Containerd) Subscribe(ctx context.Context) (<-chan ImageEvent, <-chan e
 	if err != nil {
 		return nil, nil, err
 	}
-	envelopeCh, cErrCh := client.EventService().Subscribe(ctx, c.eventFilter)
 	go func() {
 		defer func() {
 			close(imgCh)
 			close(errCh)
 		}()
-		for envelope := range envelopeCh {
-			var img Image
-			imageName, eventType, err := getEventImage(envelope.Event)
+		resync := false
+		for {
+			err := c.streamEvents(ctx, client, imgCh, errCh, resync)
+			if ctx.Err() != nil {
+				return
+			}
+			c.disconnected.Store(true)
+			select {
+			case errCh <- fmt.Errorf("Containerd event stream ended: %w", err):
+			case <-ctx.Done():
+				return
+			}
+			client, err = c.reconnect(ctx)
 			if err != nil {
-				errCh <- err
+				return
+			}
+			c.disconnected.Store(false)
+			resync = true
+		}
+	}()
+	return imgCh, errCh, nil
+}
+
+// streamEvents subscribes to image events and forwards them until the event stream ends.
+func (c *Containerd) streamEvents(ctx context.Context, client *containerd.Client, imgCh chan<- ImageEvent, errCh chan<- error, resync bool) error {
+	envelopeCh, cErrCh := client.EventService().Subscribe(ctx, c.eventFilter)
+	if resync {
+		select {
+		case errCh <- fmt.Errorf("subscribed to Containerd events again: %w", ErrResyncRequired):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err, ok := <-cErrCh:
+			if !ok {
+				return errors.New("event error channel closed")
+			}
+			return err
+		case envelope := <-envelopeCh:
+			// Events are received from all namespaces.
+			if !slices.Contains(c.namespaces, namespaceWildcard) && !slices.Contains(c.namespaces, envelope.Namespace) {
 				continue
 			}
-			switch eventType {
-			case CreateEvent, UpdateEvent:
-				cImg, err := client.GetImage(ctx, imageName)
-				if err != nil {
-					errCh <- err
-					continue
-				}
-				img, err = Parse(cImg.Name(), cImg.Target().Digest)
-				if err != nil {
-					errCh <- err
-					continue
-				}
-			case DeleteEvent:
-				img, err = Parse(imageName, "")
-				if err != nil {
-					errCh <- err
-					continue
+			event, err := getImageEvent(namespaces.WithNamespace(ctx, envelope.Namespace), client, envelope.Event)
+			if err != nil {
+				select {
+				case errCh <- err:
+				case <-ctx.Done():
+					return ctx.Err()
 				}
+				continue
+			}
+			event.Image.Namespace = envelope.Namespace
+			select {
+			case imgCh <- event:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
-			imgCh <- ImageEvent{Image: img, Type: eventType}
 		}
-	}()
-	return imgCh, channel.Merge(errCh, cErrCh), nil
+	}
 }
 
-func (c *Containerd) ListImages(ctx context.Context) ([]Image, error) {
+// reconnect replaces the client with a new connection, backing off exponentially until Containerd is reachable.
+func (c *Containerd) reconnect(ctx context.Context) (*containerd.Client, error) {
+	log := logr.FromContextOrDiscard(ctx)
+	delay := reconnectMinDelay
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		client, err := c.clientGetter()
+		if err != nil {
+			delay = min(delay*2, reconnectMaxDelay)
+			log.Error(err, "could not reconnect to Containerd", "retryDelay", delay.String())
+			continue
+		}
+		c.mx.Lock()
+		oldClient := c.client
+		c.client = client
+		c.mx.Unlock()
+		if oldClient != nil && oldClient != client {
+			oldClient.Close()
+		}
+		log.Info("reconnected to Containerd")
+		return client, nil
+	}
+}
+
+func (c *Containerd) ListImages(ctx context.Context) (_ []Image, err error) {
+	ctx, span := startSpan(ctx, "Containerd.ListImages")
+	defer func() {
+		endSpan(span, err)
+	}()
 	client, err := c.Client()
 	if err != nil {
 		return nil, err
 	}
-	cImgs, err := client.ListImages(ctx, c.listFilter)
+	nss, err := c.listNamespaces(ctx, client)
 	if err != nil {
 		return nil, err
 	}
 	imgs := []Image{}
-	for _, cImg := range cImgs {
-		img, err := Parse(cImg.Name(), cImg.Target().Digest)
+	for _, ns := range nss {
+		cImgs, err := client.ListImages(namespaces.WithNamespace(ctx, ns), c.listFilter)
 		if err != nil {
 			return nil, err
 		}
-		imgs = append(imgs, img)
+		for _, cImg := range cImgs {
+			img, err := Parse(cImg.Name(), cImg.Target().Digest)
+			if err != nil {
+				return nil, err
+			}
+			img.Namespace = ns
+			imgs = append(imgs, img)
+		}
 	}
 	return imgs, nil
 }
 
-func (c *Containerd) AllIdentifiers(ctx context.Context, img Image) ([]string, error) {
+func (c *Containerd) AllIdentifiers(ctx context.Context, img Image) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "Containerd.AllIdentifiers", attribute.String("image", img.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
 	client, err := c.Client()
 	if err != nil {
 		return nil, err
 	}
-	cImg, err := client.ImageService().Get(ctx, img.Name)
+	ctx, cImg, err := c.findImage(ctx, client, img.Name, img.Namespace)
 	if err != nil {
 		return nil, err
 	}
@@ -234,6 +362,9 @@ func (c *Containerd) AllIdentifiers(ctx context.Context, img Image) ([]string, e
 			if len(descs) == 0 {
 				return nil, fmt.Errorf("could not find any platforms with local content in manifest list: %v", desc.Digest)
 			}
+			if idx.Subject != nil {
+				keys = append(keys, ReferrersKey(idx.Subject.Digest))
+			}
 			return descs, nil
 		case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
 			var manifest ocispec.Manifest
@@ -248,6 +379,9 @@ func (c *Containerd) AllIdentifiers(ctx context.Context, img Image) ([]string, e
 			for _, layer := range manifest.Layers {
 				keys = append(keys, layer.Digest.String())
 			}
+			if manifest.Subject != nil {
+				keys = append(keys, ReferrersKey(manifest.Subject.Digest))
+			}
 			return nil, nil
 		default:
 			return nil, fmt.Errorf("unexpected media type %v for digest: %v", desc.MediaType, desc.Digest)
@@ -262,35 +396,51 @@ func (c *Containerd) AllIdentifiers(ctx context.Context, img Image) ([]string, e
 	return keys, nil
 }
 
-func (c *Containerd) Resolve(ctx context.Context, ref string) (digest.Digest, error) {
+func (c *Containerd) Resolve(ctx context.Context, ref string) (_ digest.Digest, err error) {
+	ctx, span := startSpan(ctx, "Containerd.Resolve", attribute.String("ref", ref))
+	defer func() {
+		endSpan(span, err)
+	}()
 	client, err := c.Client()
 	if err != nil {
 		return "", err
 	}
-	cImg, err := client.GetImage(ctx, ref)
+	_, cImg, err := c.findImage(ctx, client, ref, "")
 	if err != nil {
 		return "", err
 	}
-	return cImg.Target().Digest, nil
+	return cImg.Target.Digest, nil
 }
 
-func (c *Containerd) Size(ctx context.Context, dgst digest.Digest) (int64, error) {
+func (c *Containerd) Size(ctx context.Context, dgst digest.Digest) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "Containerd.Size", attribute.String("digest", dgst.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
 	client, err := c.Client()
 	if err != nil {
 		return 0, err
 	}
-	info, err := client.ContentStore().Info(ctx, dgst)
+	_, info, err := c.findContent(ctx, client, dgst)
 	if err != nil {
 		return 0, err
 	}
 	return info.Size, nil
 }
 
-func (c *Containerd) GetManifest(ctx context.Context, dgst digest.Digest) ([]byte, string, error) {
+func (c *Containerd) GetManifest(ctx context.Context, dgst digest.Digest) (_ []byte, _ string, err error) {
+	ctx, span := startSpan(ctx, "Containerd.GetManifest", attribute.String("digest", dgst.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
 	client, err := c.Client()
 	if err != nil {
 		return nil, "", err
 	}
+	ctx, _, err = c.findContent(ctx, client, dgst)
+	if err != nil {
+		return nil, "", err
+	}
 	b, err := content.ReadBlob(ctx, client.ContentStore(), ocispec.Descriptor{Digest: dgst})
 	if err != nil {
 		return nil, "", err
@@ -317,10 +467,17 @@ func (c *Containerd) GetManifest(ctx context.Context, dgst digest.Digest) ([]byt
 	return b, mt, nil
 }
 
-func (c *Containerd) GetBlob(ctx context.Context, dgst digest.Digest) (io.ReadCloser, error) {
+func (c *Containerd) GetBlob(ctx context.Context, dgst digest.Digest) (_ io.ReadSeekCloser, err error) {
+	ctx, span := startSpan(ctx, "Containerd.GetBlob", attribute.String("digest", dgst.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
 	if c.contentPath != "" {
 		path := filepath.Join(c.contentPath, "blobs", dgst.Algorithm().String(), dgst.Encoded())
 		file, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %w", errdefs.ErrNotFound, err)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -330,19 +487,183 @@ func (c *Containerd) GetBlob(ctx context.Context, dgst digest.Digest) (io.ReadCl
 	if err != nil {
 		return nil, err
 	}
+	ctx, _, err = c.findContent(ctx, client, dgst)
+	if err != nil {
+		return nil, err
+	}
 	ra, err := client.ContentStore().ReaderAt(ctx, ocispec.Descriptor{Digest: dgst})
 	if err != nil {
 		return nil, err
 	}
 	return struct {
-		io.Reader
+		io.ReadSeeker
 		io.Closer
 	}{
-		Reader: content.NewReader(ra),
-		Closer: ra,
+		ReadSeeker: io.NewSectionReader(ra, 0, ra.Size()),
+		Closer:     ra,
 	}, nil
 }
 
+// ListReferrers returns the images which have the digest as subject.
+func (c *Containerd) ListReferrers(ctx context.Context, dgst digest.Digest) (_ []ocispec.Descriptor, err error) {
+	ctx, span := startSpan(ctx, "Containerd.ListReferrers", attribute.String("digest", dgst.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	client, err := c.Client()
+	if err != nil {
+		return nil, err
+	}
+	nss, err := c.listNamespaces(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	// Image targets are content addressed so the parsed referrers can be reused between calls. Only the
+	// targets of current images are kept so that the cache does not grow with removed images. The images
+	// are listed and read without holding the lock so that concurrent calls are not serialized.
+	c.referrersMx.Lock()
+	cached := c.referrers
+	c.referrersMx.Unlock()
+	entries := map[digest.Digest]referrerEntry{}
+	referrers := []ocispec.Descriptor{}
+	for _, ns := range nss {
+		nsCtx := namespaces.WithNamespace(ctx, ns)
+		cImgs, err := client.ListImages(nsCtx, c.listFilter)
+		if err != nil {
+			return nil, err
+		}
+		for _, cImg := range cImgs {
+			target := cImg.Target()
+			if _, ok := entries[target.Digest]; ok {
+				continue
+			}
+			entry, ok := cached[target.Digest]
+			if !ok {
+				entry, err = readReferrerEntry(nsCtx, client.ContentStore(), target)
+				if err != nil {
+					return nil, err
+				}
+			}
+			entries[target.Digest] = entry
+			if !entry.ok || entry.subject != dgst {
+				continue
+			}
+			referrers = append(referrers, entry.referrer)
+		}
+	}
+	c.referrersMx.Lock()
+	c.referrers = entries
+	c.referrersMx.Unlock()
+	return referrers, nil
+}
+
+func readReferrerEntry(ctx context.Context, store content.Provider, target ocispec.Descriptor) (referrerEntry, error) {
+	switch target.MediaType {
+	case ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageIndex:
+	default:
+		return referrerEntry{}, nil
+	}
+	b, err := content.ReadBlob(ctx, store, target)
+	if err != nil {
+		return referrerEntry{}, err
+	}
+	subject, referrer, ok := parseReferrer(target, b)
+	return referrerEntry{subject: subject, referrer: referrer, ok: ok}, nil
+}
+
+func (c *Containerd) NewBlobWriter(ctx context.Context, desc ocispec.Descriptor) (BlobWriter, error) { //nolint: ireturn // Implements the ContentWriter interface.
+	client, err := c.Client()
+	if err != nil {
+		return nil, err
+	}
+	lease, err := client.LeasesService().Create(ctx, leases.WithRandomID(), leases.WithExpiration(contentLeaseExpiration))
+	if err != nil {
+		return nil, err
+	}
+	ctx = leases.WithLease(ctx, lease.ID)
+	// Opening the writer directly instead of using content.OpenWriter avoids waiting for ingests with the same ref to complete.
+	w, err := client.ContentStore().Writer(ctx, content.WithRef(fmt.Sprintf("spegel-%s", desc.Digest.String())), content.WithDescriptor(desc))
+	if err != nil {
+		return nil, err
+	}
+	return &containerdBlobWriter{
+		Writer:  w,
+		desc:    desc,
+		leaseID: lease.ID,
+	}, nil
+}
+
+type containerdBlobWriter struct {
+	content.Writer
+	desc    ocispec.Descriptor
+	leaseID string
+}
+
+func (c *containerdBlobWriter) Commit(ctx context.Context) error {
+	ctx = leases.WithLease(ctx, c.leaseID)
+	return c.Writer.Commit(ctx, c.desc.Size, c.desc.Digest)
+}
+
+// listNamespaces returns the namespaces which images are read from.
+func (c *Containerd) listNamespaces(ctx context.Context, client *containerd.Client) ([]string, error) {
+	if !slices.Contains(c.namespaces, namespaceWildcard) {
+		return c.namespaces, nil
+	}
+	nss, err := client.NamespaceService().List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list Containerd namespaces: %w", err)
+	}
+	slices.Sort(nss)
+	return nss, nil
+}
+
+// findImage returns the image and a context with the namespace of the image. All namespaces are searched
+// in order when the namespace is not known.
+func (c *Containerd) findImage(ctx context.Context, client *containerd.Client, name, namespace string) (context.Context, images.Image, error) {
+	nss := []string{namespace}
+	if namespace == "" {
+		var err error
+		nss, err = c.listNamespaces(ctx, client)
+		if err != nil {
+			return nil, images.Image{}, err
+		}
+	}
+	for _, ns := range nss {
+		nsCtx := namespaces.WithNamespace(ctx, ns)
+		cImg, err := client.ImageService().Get(nsCtx, name)
+		if errdefs.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, images.Image{}, err
+		}
+		return nsCtx, cImg, nil
+	}
+	return nil, images.Image{}, fmt.Errorf("image %s: %w", name, errdefs.ErrNotFound)
+}
+
+// findContent returns the content info and a context with the first namespace which references the content.
+// Content is stored once in the shared content store, but is only visible in namespaces which reference it.
+func (c *Containerd) findContent(ctx context.Context, client *containerd.Client, dgst digest.Digest) (context.Context, content.Info, error) {
+	nss, err := c.listNamespaces(ctx, client)
+	if err != nil {
+		return nil, content.Info{}, err
+	}
+	for _, ns := range nss {
+		nsCtx := namespaces.WithNamespace(ctx, ns)
+		info, err := client.ContentStore().Info(nsCtx, dgst)
+		if errdefs.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, content.Info{}, err
+		}
+		return nsCtx, info, nil
+	}
+	return nil, content.Info{}, fmt.Errorf("content with digest %s: %w", dgst.String(), errdefs.ErrNotFound)
+}
+
 // lookupMediaType will resolve the media type for a digest without looking at the content.
 // Only use this as a fallback method as it is a lot slower than reading it from the file.
 // TODO: A cache would be helpful to speed up lookups for the same digets.
@@ -422,6 +743,32 @@ func getContentFilter(labels map[string]string) (string, error) {
 	return "", errors.New("could not find distribution label to create content filter")
 }
 
+// getImageEvent returns the image event for the Containerd event, the image is fetched for create and update events.
+func getImageEvent(ctx context.Context, client *containerd.Client, e typeurl.Any) (ImageEvent, error) {
+	imageName, eventType, err := getEventImage(e)
+	if err != nil {
+		return ImageEvent{}, err
+	}
+	var img Image
+	switch eventType {
+	case CreateEvent, UpdateEvent:
+		cImg, err := client.GetImage(ctx, imageName)
+		if err != nil {
+			return ImageEvent{}, err
+		}
+		img, err = Parse(cImg.Name(), cImg.Target().Digest)
+		if err != nil {
+			return ImageEvent{}, err
+		}
+	case DeleteEvent:
+		img, err = Parse(imageName, "")
+		if err != nil {
+			return ImageEvent{}, err
+		}
+	}
+	return ImageEvent{Image: img, Type: eventType}, nil
+}
+
 func getEventImage(e typeurl.Any) (string, EventType, error) {
 	if e == nil {
 		return "", "", errors.New("any cannot be nil")
@@ -479,15 +826,72 @@ type hostConfig struct {
 	Capabilities []string               `toml:"capabilities"`
 }
 
+// Names of the files written next to the host configuration. Containerd resolves
+// relative CA and client certificate paths from the directory of the host configuration.
+const (
+	mirrorCAFile         = "spegel-ca.crt"
+	mirrorClientCertFile = "spegel-client.crt"
+	mirrorClientKeyFile  = "spegel-client.key"
+)
+
+type mirrorConfig struct {
+	caFile         string
+	clientCertFile string
+	clientKeyFile  string
+}
+
+type MirrorOption func(*mirrorConfig)
+
+// WithMirrorCAFile copies the CA file into the configuration so that it is used to verify https mirrors.
+func WithMirrorCAFile(caFile string) MirrorOption {
+	return func(cfg *mirrorConfig) {
+		cfg.caFile = caFile
+	}
+}
+
+// WithMirrorClientCertificate copies the certificate and key into the configuration so that
+// Containerd presents them to https mirrors which authenticate clients.
+func WithMirrorClientCertificate(certFile, keyFile string) MirrorOption {
+	return func(cfg *mirrorConfig) {
+		cfg.clientCertFile = certFile
+		cfg.clientKeyFile = keyFile
+	}
+}
+
 // Refer to containerd registry configuration documentation for mor information about required configuration.
 // https://github.com/containerd/containerd/blob/main/docs/cri/config.md#registry-configuration
 // https://github.com/containerd/containerd/blob/main/docs/hosts.md#registry-configuration---examples
-func AddMirrorConfiguration(ctx context.Context, fs afero.Fs, configPath string, registryURLs, mirrorURLs []url.URL, resolveTags, appendToBackup bool) error {
+func AddMirrorConfiguration(ctx context.Context, fs afero.Fs, configPath string, registryURLs, mirrorURLs []url.URL, resolveTags, appendToBackup bool, opts ...MirrorOption) error {
 	log := logr.FromContextOrDiscard(ctx)
+	cfg := mirrorConfig{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 	err := validateRegistries(registryURLs)
 	if err != nil {
 		return err
 	}
+	var ca []byte
+	if cfg.caFile != "" {
+		ca, err = afero.ReadFile(fs, cfg.caFile)
+		if err != nil {
+			return fmt.Errorf("could not read mirror CA file: %w", err)
+		}
+	}
+	var clientCert, clientKey []byte
+	if cfg.clientCertFile != "" || cfg.clientKeyFile != "" {
+		if cfg.clientCertFile == "" || cfg.clientKeyFile == "" {
+			return errors.New("mirror client certificate and key have to both be set")
+		}
+		clientCert, err = afero.ReadFile(fs, cfg.clientCertFile)
+		if err != nil {
+			return fmt.Errorf("could not read mirror client certificate file: %w", err)
+		}
+		clientKey, err = afero.ReadFile(fs, cfg.clientKeyFile)
+		if err != nil {
+			return fmt.Errorf("could not read mirror client key file: %w", err)
+		}
+	}
 	err = fs.MkdirAll(configPath, 0o755)
 	if err != nil {
 		return err
@@ -512,7 +916,14 @@ func AddMirrorConfiguration(ctx context.Context, fs afero.Fs, configPath string,
 			return err
 		}
 		for _, u := range mirrorURLs {
-			hf.HostConfigs[u.String()] = hostConfig{Capabilities: capabilities}
+			hc := hostConfig{Capabilities: capabilities}
+			if ca != nil && u.Scheme == "https" {
+				hc.CACert = mirrorCAFile
+			}
+			if clientCert != nil && u.Scheme == "https" {
+				hc.Client = []string{mirrorClientCertFile, mirrorClientKeyFile}
+			}
+			hf.HostConfigs[u.String()] = hc
 		}
 		b, err := toml.Marshal(&hf)
 		if err != nil {
@@ -527,6 +938,22 @@ func AddMirrorConfiguration(ctx context.Context, fs afero.Fs, configPath string,
 		if err != nil {
 			return err
 		}
+		if ca != nil {
+			err = afero.WriteFile(fs, path.Join(path.Dir(fp), mirrorCAFile), ca, 0o644)
+			if err != nil {
+				return err
+			}
+		}
+		if clientCert != nil {
+			err = afero.WriteFile(fs, path.Join(path.Dir(fp), mirrorClientCertFile), clientCert, 0o644)
+			if err != nil {
+				return err
+			}
+			err = afero.WriteFile(fs, path.Join(path.Dir(fp), mirrorClientKeyFile), clientKey, 0o600)
+			if err != nil {
+				return err
+			}
+		}
 		if appending {
 			log.Info("appending to existing Containerd mirror configuration", "registry", registryURL.String(), "path", fp)
 		} else {
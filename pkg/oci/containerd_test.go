@@ -1,32 +1,52 @@
 package oci
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	iofs "io/fs"
 	"net/url"
+	"path"
+	"strings"
 	"testing"
 
+	"github.com/containerd/containerd"
 	eventtypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/metadata"
+	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/typeurl/v2"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
 	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
 func TestNewContainerd(t *testing.T) {
 	t.Parallel()
 
-	c, err := NewContainerd("socket", "namespace", "foo", nil)
+	c, err := NewContainerd("socket", []string{"namespace"}, "foo", nil)
 	require.NoError(t, err)
 	require.Empty(t, c.contentPath)
 	require.Nil(t, c.client)
 	require.Equal(t, "foo", c.registryConfigPath)
+	require.Equal(t, []string{"namespace"}, c.namespaces)
 
-	c, err = NewContainerd("socket", "namespace", "foo", nil, WithContentPath("local"))
+	c, err = NewContainerd("socket", []string{"namespace"}, "foo", nil, WithContentPath("local"))
 	require.NoError(t, err)
 	require.Equal(t, "local", c.contentPath)
+
+	_, err = NewContainerd("socket", nil, "foo", nil)
+	require.EqualError(t, err, "at least one Containerd namespace is required")
 }
 
 func TestVerifyStatusResponse(t *testing.T) {
@@ -92,6 +112,298 @@ func TestVerifyStatusResponse(t *testing.T) {
 	}
 }
 
+func TestContainerdBlobWriter(t *testing.T) {
+	t.Parallel()
+
+	contentStore, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	boltDB, err := bolt.Open(path.Join(t.TempDir(), "bolt.db"), 0o644, nil)
+	require.NoError(t, err)
+	db := metadata.NewDB(boltDB, contentStore, nil)
+	containerdClient, err := containerd.New("", containerd.WithServices(containerd.WithContentStore(db.ContentStore()), containerd.WithLeasesService(metadata.NewLeaseManager(db))))
+	require.NoError(t, err)
+	c := &Containerd{
+		client:     containerdClient,
+		namespaces: []string{"k8s.io"},
+	}
+	ctx := namespaces.WithNamespace(context.TODO(), "k8s.io")
+
+	b := []byte("hello world")
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	w, err := c.NewBlobWriter(ctx, desc)
+	require.NoError(t, err)
+	_, err = w.Write(b)
+	require.NoError(t, err)
+	err = w.Commit(ctx)
+	require.NoError(t, err)
+	err = w.Close()
+	require.NoError(t, err)
+
+	size, err := c.Size(ctx, desc.Digest)
+	require.NoError(t, err)
+	require.Equal(t, desc.Size, size)
+	rc, err := c.GetBlob(ctx, desc.Digest)
+	require.NoError(t, err)
+	defer rc.Close()
+	stored, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.Equal(t, b, stored)
+
+	invalidDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromString("foo"),
+		Size:      int64(len(b)),
+	}
+	w, err = c.NewBlobWriter(ctx, invalidDesc)
+	require.NoError(t, err)
+	_, err = w.Write(b)
+	require.NoError(t, err)
+	err = w.Commit(ctx)
+	require.Error(t, err)
+	err = w.Close()
+	require.NoError(t, err)
+}
+
+func TestContainerdReferrers(t *testing.T) {
+	t.Parallel()
+
+	contentStore, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	boltDB, err := bolt.Open(path.Join(t.TempDir(), "bolt.db"), 0o644, nil)
+	require.NoError(t, err)
+	db := metadata.NewDB(boltDB, contentStore, nil)
+	imageStore := metadata.NewImageStore(db)
+	containerdClient, err := containerd.New("", containerd.WithServices(containerd.WithImageStore(imageStore), containerd.WithContentStore(db.ContentStore())))
+	require.NoError(t, err)
+	c := &Containerd{
+		client:     containerdClient,
+		namespaces: []string{"k8s.io"},
+	}
+	ctx := namespaces.WithNamespace(context.TODO(), "k8s.io")
+
+	addImage := func(name string, manifest ocispec.Manifest) ocispec.Descriptor {
+		b, err := json.Marshal(manifest)
+		require.NoError(t, err)
+		desc := ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromBytes(b),
+			Size:      int64(len(b)),
+		}
+		err = content.WriteBlob(ctx, db.ContentStore(), desc.Digest.String(), bytes.NewReader(b), desc)
+		require.NoError(t, err)
+		_, err = imageStore.Create(ctx, images.Image{Name: name, Target: desc})
+		require.NoError(t, err)
+		return desc
+	}
+	emptyConfig := ocispec.Descriptor{
+		MediaType: "application/vnd.oci.empty.v1+json",
+		Digest:    digest.FromString("{}"),
+		Size:      2,
+	}
+	err = content.WriteBlob(ctx, db.ContentStore(), emptyConfig.Digest.String(), strings.NewReader("{}"), emptyConfig)
+	require.NoError(t, err)
+	subject := addImage("example.com/foo/bar:v1", ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    emptyConfig,
+	})
+	signature := addImage("example.com/foo/bar:sha256-sig", ocispec.Manifest{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.dev.cosign.artifact.sig.v1+json",
+		Config:       emptyConfig,
+		Subject:      &subject,
+	})
+
+	referrers, err := c.ListReferrers(ctx, subject.Digest)
+	require.NoError(t, err)
+	require.Len(t, referrers, 1)
+	require.Equal(t, signature.Digest, referrers[0].Digest)
+	require.Equal(t, signature.Size, referrers[0].Size)
+	require.Equal(t, "application/vnd.dev.cosign.artifact.sig.v1+json", referrers[0].ArtifactType)
+	referrers, err = c.ListReferrers(ctx, signature.Digest)
+	require.NoError(t, err)
+	require.Empty(t, referrers)
+
+	keys, err := c.AllIdentifiers(ctx, Image{Name: "example.com/foo/bar:sha256-sig"})
+	require.NoError(t, err)
+	require.Contains(t, keys, ReferrersKey(subject.Digest))
+	keys, err = c.AllIdentifiers(ctx, Image{Name: "example.com/foo/bar:v1"})
+	require.NoError(t, err)
+	require.NotContains(t, keys, ReferrersKey(subject.Digest))
+
+	// Parsed referrers are cached and removed with the image.
+	err = db.ContentStore().Delete(ctx, signature.Digest)
+	require.NoError(t, err)
+	referrers, err = c.ListReferrers(ctx, subject.Digest)
+	require.NoError(t, err)
+	require.Len(t, referrers, 1)
+	err = imageStore.Delete(ctx, "example.com/foo/bar:sha256-sig")
+	require.NoError(t, err)
+	referrers, err = c.ListReferrers(ctx, subject.Digest)
+	require.NoError(t, err)
+	require.Empty(t, referrers)
+	require.NotContains(t, c.referrers, signature.Digest)
+}
+
+func TestContainerdNamespaces(t *testing.T) {
+	t.Parallel()
+
+	contentStore, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	boltDB, err := bolt.Open(path.Join(t.TempDir(), "bolt.db"), 0o644, nil)
+	require.NoError(t, err)
+	db := metadata.NewDB(boltDB, contentStore, nil)
+	imageStore := metadata.NewImageStore(db)
+	containerdClient, err := containerd.New("", containerd.WithServices(containerd.WithImageStore(imageStore), containerd.WithContentStore(db.ContentStore())))
+	require.NoError(t, err)
+	c := &Containerd{
+		client:     containerdClient,
+		namespaces: []string{"k8s.io", "moby"},
+	}
+	ctx := context.TODO()
+
+	addImage := func(ns, name string, b []byte) ocispec.Descriptor {
+		nsCtx := namespaces.WithNamespace(ctx, ns)
+		desc := ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromBytes(b),
+			Size:      int64(len(b)),
+		}
+		err = content.WriteBlob(nsCtx, db.ContentStore(), desc.Digest.String(), bytes.NewReader(b), desc)
+		require.NoError(t, err)
+		_, err = imageStore.Create(nsCtx, images.Image{Name: name, Target: desc})
+		require.NoError(t, err)
+		return desc
+	}
+	criDesc := addImage("k8s.io", "example.com/foo/cri:v1", []byte(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`))
+	mobyDesc := addImage("moby", "example.com/foo/moby:v1", []byte(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[],"annotations":{"a":"b"}}`))
+	otherDesc := addImage("other", "example.com/foo/other:v1", []byte(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[],"annotations":{"c":"d"}}`))
+
+	imgs, err := c.ListImages(ctx)
+	require.NoError(t, err)
+	require.Len(t, imgs, 2)
+	require.Equal(t, "example.com/foo/cri:v1", imgs[0].Name)
+	require.Equal(t, "k8s.io", imgs[0].Namespace)
+	require.Equal(t, "example.com/foo/moby:v1", imgs[1].Name)
+	require.Equal(t, "moby", imgs[1].Namespace)
+
+	dgst, err := c.Resolve(ctx, "example.com/foo/moby:v1")
+	require.NoError(t, err)
+	require.Equal(t, mobyDesc.Digest, dgst)
+	_, err = c.Resolve(ctx, "example.com/foo/other:v1")
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+
+	keys, err := c.AllIdentifiers(ctx, Image{Name: "example.com/foo/moby:v1"})
+	require.NoError(t, err)
+	require.Contains(t, keys, mobyDesc.Digest.String())
+	_, err = c.AllIdentifiers(ctx, Image{Name: "example.com/foo/moby:v1", Namespace: "k8s.io"})
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+
+	for _, desc := range []ocispec.Descriptor{criDesc, mobyDesc} {
+		size, err := c.Size(ctx, desc.Digest)
+		require.NoError(t, err)
+		require.Equal(t, desc.Size, size)
+		b, mediaType, err := c.GetManifest(ctx, desc.Digest)
+		require.NoError(t, err)
+		require.Equal(t, ocispec.MediaTypeImageManifest, mediaType)
+		require.Equal(t, desc.Digest, digest.FromBytes(b))
+	}
+	_, err = c.Size(ctx, otherDesc.Digest)
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+	_, err = c.GetBlob(ctx, otherDesc.Digest)
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+}
+
+type eventSubscription struct {
+	envelopeCh chan *events.Envelope
+	errCh      chan error
+}
+
+type subscriptionEventService struct {
+	subCh chan eventSubscription
+}
+
+func (s *subscriptionEventService) Publish(ctx context.Context, topic string, event events.Event) error {
+	return nil
+}
+
+func (s *subscriptionEventService) Forward(ctx context.Context, envelope *events.Envelope) error {
+	return nil
+}
+
+func (s *subscriptionEventService) Subscribe(ctx context.Context, filters ...string) (<-chan *events.Envelope, <-chan error) {
+	sub := eventSubscription{
+		envelopeCh: make(chan *events.Envelope),
+		errCh:      make(chan error, 1),
+	}
+	s.subCh <- sub
+	return sub.envelopeCh, sub.errCh
+}
+
+func TestContainerdSubscribeReconnect(t *testing.T) {
+	t.Parallel()
+
+	contentStore, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	boltDB, err := bolt.Open(path.Join(t.TempDir(), "bolt.db"), 0o644, nil)
+	require.NoError(t, err)
+	db := metadata.NewDB(boltDB, contentStore, nil)
+	imageStore := metadata.NewImageStore(db)
+	eventService := &subscriptionEventService{subCh: make(chan eventSubscription, 1)}
+	containerdClient, err := containerd.New("", containerd.WithServices(containerd.WithImageStore(imageStore), containerd.WithEventService(eventService)))
+	require.NoError(t, err)
+	c := &Containerd{
+		client: containerdClient,
+		clientGetter: func() (*containerd.Client, error) {
+			return containerdClient, nil
+		},
+		namespaces: []string{"k8s.io"},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dgst := digest.FromString("manifest")
+	_, err = imageStore.Create(namespaces.WithNamespace(ctx, "k8s.io"), images.Image{Name: "example.com/foo/bar:v1", Target: ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: dgst, Size: 10}})
+	require.NoError(t, err)
+	sendCreate := func(sub eventSubscription, ns string) {
+		evt, err := typeurl.MarshalAny(&eventtypes.ImageCreate{Name: "example.com/foo/bar:v1"})
+		require.NoError(t, err)
+		sub.envelopeCh <- &events.Envelope{Namespace: ns, Topic: "/images/create", Event: evt}
+	}
+
+	imgCh, errCh, err := c.Subscribe(ctx)
+	require.NoError(t, err)
+	sub := <-eventService.subCh
+	sendCreate(sub, "moby")
+	sendCreate(sub, "k8s.io")
+	event := <-imgCh
+	require.Equal(t, CreateEvent, event.Type)
+	require.Equal(t, dgst, event.Image.Digest)
+	require.Equal(t, "k8s.io", event.Image.Namespace)
+	ready, err := c.Ready(ctx)
+	require.NoError(t, err)
+	require.True(t, ready)
+
+	// Ending the event stream should mark the client as not ready until it has subscribed again.
+	sub.errCh <- errors.New("connection lost")
+	err = <-errCh
+	require.EqualError(t, err, "Containerd event stream ended: connection lost")
+	ready, err = c.Ready(ctx)
+	require.NoError(t, err)
+	require.False(t, ready)
+	sub = <-eventService.subCh
+	err = <-errCh
+	require.ErrorIs(t, err, ErrResyncRequired)
+	ready, err = c.Ready(ctx)
+	require.NoError(t, err)
+	require.True(t, ready)
+	sendCreate(sub, "k8s.io")
+	event = <-imgCh
+	require.Equal(t, "example.com/foo/bar:v1", event.Image.Name)
+}
+
 func TestCreateFilter(t *testing.T) {
 	t.Parallel()
 
@@ -240,6 +552,9 @@ func TestMirrorConfiguration(t *testing.T) {
 		existingFiles       map[string]string
 		expectedFiles       map[string]string
 		name                string
+		caFile              string
+		clientCertFile      string
+		clientKeyFile       string
 		registries          []url.URL
 		mirrors             []url.URL
 		resolveTags         bool
@@ -263,6 +578,59 @@ capabilities = ['pull', 'resolve']
 `,
 			},
 		},
+		{
+			name:        "https mirror with CA",
+			resolveTags: true,
+			caFile:      "/etc/spegel/tls/ca.crt",
+			existingFiles: map[string]string{
+				"/etc/spegel/tls/ca.crt": "ca",
+			},
+			registries: stringListToUrlList(t, []string{"https://docker.io"}),
+			mirrors:    stringListToUrlList(t, []string{"https://127.0.0.1:5000", "http://127.0.0.1:5001"}),
+			expectedFiles: map[string]string{
+				"/etc/containerd/certs.d/docker.io/hosts.toml": `server = 'https://registry-1.docker.io'
+
+[host]
+[host.'http://127.0.0.1:5001']
+capabilities = ['pull', 'resolve']
+
+[host.'https://127.0.0.1:5000']
+ca = 'spegel-ca.crt'
+capabilities = ['pull', 'resolve']
+`,
+				"/etc/containerd/certs.d/docker.io/spegel-ca.crt": "ca",
+			},
+		},
+		{
+			name:           "https mirror with client certificate",
+			resolveTags:    true,
+			caFile:         "/etc/spegel/tls/ca.crt",
+			clientCertFile: "/etc/spegel/tls/tls.crt",
+			clientKeyFile:  "/etc/spegel/tls/tls.key",
+			existingFiles: map[string]string{
+				"/etc/spegel/tls/ca.crt":  "ca",
+				"/etc/spegel/tls/tls.crt": "cert",
+				"/etc/spegel/tls/tls.key": "key",
+			},
+			registries: stringListToUrlList(t, []string{"https://docker.io"}),
+			mirrors:    stringListToUrlList(t, []string{"https://localhost:5000", "http://127.0.0.1:5001"}),
+			expectedFiles: map[string]string{
+				"/etc/containerd/certs.d/docker.io/hosts.toml": `server = 'https://registry-1.docker.io'
+
+[host]
+[host.'http://127.0.0.1:5001']
+capabilities = ['pull', 'resolve']
+
+[host.'https://localhost:5000']
+ca = 'spegel-ca.crt'
+client = ['spegel-client.crt', 'spegel-client.key']
+capabilities = ['pull', 'resolve']
+`,
+				"/etc/containerd/certs.d/docker.io/spegel-ca.crt":     "ca",
+				"/etc/containerd/certs.d/docker.io/spegel-client.crt": "cert",
+				"/etc/containerd/certs.d/docker.io/spegel-client.key": "key",
+			},
+		},
 		{
 			name:        "resolve tags disabled",
 			resolveTags: false,
@@ -449,7 +817,7 @@ capabilities = ['pull', 'resolve']
 				err := afero.WriteFile(fs, k, []byte(v), 0o644)
 				require.NoError(t, err)
 			}
-			err := AddMirrorConfiguration(context.TODO(), fs, registryConfigPath, tt.registries, tt.mirrors, tt.resolveTags, tt.appendToBackup)
+			err := AddMirrorConfiguration(context.TODO(), fs, registryConfigPath, tt.registries, tt.mirrors, tt.resolveTags, tt.appendToBackup, WithMirrorCAFile(tt.caFile), WithMirrorClientCertificate(tt.clientCertFile, tt.clientKeyFile))
 			require.NoError(t, err)
 			if len(tt.existingFiles) == 0 {
 				ok, err := afero.DirExists(fs, "/etc/containerd/certs.d/_backup")
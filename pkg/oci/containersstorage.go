@@ -0,0 +1,645 @@
+package oci
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/fsnotify/fsnotify"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/tar-split/tar/asm"
+	"github.com/vbatts/tar-split/tar/storage"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	imagesFile             = "images.json"
+	layersFile             = "layers.json"
+	manifestBigDataPrefix  = "manifest-"
+	manifestBigDataDefault = "manifest"
+)
+
+var _ Client = &ContainersStorage{}
+
+// ContainersStorage reads images from the containers/storage directory used by CRI-O and Podman.
+// Manifests and configs are served as stored. Layers are only stored unpacked, which means that
+// only uncompressed layers can be reassembled with a digest matching the manifest.
+type ContainersStorage struct {
+	diffPath   func(layerID string) string
+	root       string
+	driver     string
+	registries []string
+}
+
+func NewContainersStorage(root, driver string, registries []url.URL) (*ContainersStorage, error) {
+	var diffPath func(layerID string) string
+	switch driver {
+	case "overlay":
+		diffPath = func(layerID string) string {
+			return filepath.Join(root, driver, layerID, "diff")
+		}
+	case "vfs":
+		diffPath = func(layerID string) string {
+			return filepath.Join(root, driver, "dir", layerID)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported containers storage driver %s", driver)
+	}
+	registryHosts := []string{}
+	for _, registry := range registries {
+		registryHosts = append(registryHosts, registry.Host)
+	}
+	return &ContainersStorage{
+		diffPath:   diffPath,
+		root:       root,
+		driver:     driver,
+		registries: registryHosts,
+	}, nil
+}
+
+func (c *ContainersStorage) Name() string {
+	return "crio"
+}
+
+func (c *ContainersStorage) Verify(ctx context.Context) error {
+	_, err := c.readImages()
+	if err != nil {
+		return fmt.Errorf("could not read containers storage images: %w", err)
+	}
+	return nil
+}
+
+// Ready returns true when the images of the containers storage can be read, which is not the case
+// before CRI-O has initialized the storage.
+func (c *ContainersStorage) Ready(ctx context.Context) (bool, error) {
+	_, err := c.readImages()
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Subscribe watches the images directory as the image list is replaced whenever images are changed.
+func (c *ContainersStorage) Subscribe(ctx context.Context) (<-chan ImageEvent, <-chan error, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = watcher.Add(c.imagesDir())
+	if err != nil {
+		watcher.Close()
+		return nil, nil, err
+	}
+	current, err := c.ListImages(ctx)
+	if err != nil {
+		watcher.Close()
+		return nil, nil, err
+	}
+	imgCh := make(chan ImageEvent)
+	errCh := make(chan error)
+	go func() {
+		defer func() {
+			watcher.Close()
+			close(imgCh)
+			close(errCh)
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Base(event.Name) != imagesFile || !(event.Has(fsnotify.Create) || event.Has(fsnotify.Write)) {
+					continue
+				}
+				imgs, err := c.ListImages(ctx)
+				if err != nil {
+					select {
+					case errCh <- err:
+					case <-ctx.Done():
+						return
+					}
+					continue
+				}
+				for _, imgEvent := range diffImages(current, imgs) {
+					select {
+					case imgCh <- imgEvent:
+					case <-ctx.Done():
+						return
+					}
+				}
+				current = imgs
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				select {
+				case errCh <- err:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return imgCh, errCh, nil
+}
+
+func (c *ContainersStorage) ListImages(ctx context.Context) (_ []Image, err error) {
+	_, span := startSpan(ctx, "ContainersStorage.ListImages")
+	defer func() {
+		endSpan(span, err)
+	}()
+	records, err := c.readImages()
+	if err != nil {
+		return nil, err
+	}
+	imgs := []Image{}
+	for _, record := range records {
+		target, err := c.targetDigest(record)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range record.Names {
+			img, err := parseStorageName(name, target)
+			if err != nil {
+				return nil, err
+			}
+			if !slices.Contains(c.registries, img.Registry) {
+				continue
+			}
+			imgs = append(imgs, img)
+		}
+	}
+	return imgs, nil
+}
+
+// AllIdentifiers returns the digests of the image which can be served. Layers which cannot be
+// reassembled with a matching digest are left out so that peers do not attempt to fetch them.
+func (c *ContainersStorage) AllIdentifiers(ctx context.Context, img Image) (_ []string, err error) {
+	_, span := startSpan(ctx, "ContainersStorage.AllIdentifiers", attribute.String("image", img.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	records, err := c.readImages()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := c.readLayers()
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if !slices.Contains(record.Names, img.Name) {
+			continue
+		}
+		keys := []string{}
+		err := c.walk(record, layers, img.Digest, &keys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to walk image manifests: %w", err)
+		}
+		return keys, nil
+	}
+	return nil, fmt.Errorf("image %s: %w", img.Name, errdefs.ErrNotFound)
+}
+
+func (c *ContainersStorage) Resolve(ctx context.Context, ref string) (_ digest.Digest, err error) {
+	_, span := startSpan(ctx, "ContainersStorage.Resolve", attribute.String("ref", ref))
+	defer func() {
+		endSpan(span, err)
+	}()
+	records, err := c.readImages()
+	if err != nil {
+		return "", err
+	}
+	for _, record := range records {
+		if !slices.Contains(record.Names, ref) {
+			continue
+		}
+		return c.targetDigest(record)
+	}
+	return "", fmt.Errorf("image %s: %w", ref, errdefs.ErrNotFound)
+}
+
+func (c *ContainersStorage) Size(ctx context.Context, dgst digest.Digest) (_ int64, err error) {
+	_, span := startSpan(ctx, "ContainersStorage.Size", attribute.String("digest", dgst.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	records, err := c.readImages()
+	if err != nil {
+		return 0, err
+	}
+	for _, record := range records {
+		key, ok := record.bigDataKey(dgst)
+		if !ok {
+			continue
+		}
+		return record.BigDataSizes[key], nil
+	}
+	layer, err := c.findLayer(dgst)
+	if err != nil {
+		return 0, err
+	}
+	return layer.UncompressedSize, nil
+}
+
+func (c *ContainersStorage) GetManifest(ctx context.Context, dgst digest.Digest) (_ []byte, _ string, err error) {
+	_, span := startSpan(ctx, "ContainersStorage.GetManifest", attribute.String("digest", dgst.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	records, err := c.readImages()
+	if err != nil {
+		return nil, "", err
+	}
+	for _, record := range records {
+		key, ok := record.bigDataKey(dgst)
+		if !ok {
+			continue
+		}
+		b, err := c.readBigData(record, key)
+		if err != nil {
+			return nil, "", err
+		}
+		var ud UnknownDocument
+		if err := json.Unmarshal(b, &ud); err != nil {
+			return nil, "", err
+		}
+		if ud.MediaType != "" {
+			return b, ud.MediaType, nil
+		}
+		var ic ocispec.Image
+		if err := json.Unmarshal(b, &ic); err != nil {
+			return nil, "", err
+		}
+		if isImageConfig(ic) {
+			return b, ocispec.MediaTypeImageConfig, nil
+		}
+		return nil, "", fmt.Errorf("could not determine media type for %s", dgst.String())
+	}
+	return nil, "", fmt.Errorf("manifest with digest %s: %w", dgst.String(), errdefs.ErrNotFound)
+}
+
+func (c *ContainersStorage) GetBlob(ctx context.Context, dgst digest.Digest) (_ io.ReadSeekCloser, err error) {
+	_, span := startSpan(ctx, "ContainersStorage.GetBlob", attribute.String("digest", dgst.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	records, err := c.readImages()
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		key, ok := record.bigDataKey(dgst)
+		if !ok {
+			continue
+		}
+		f, err := c.openBigData(record, key)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	layer, err := c.findLayer(dgst)
+	if err != nil {
+		return nil, err
+	}
+	return &layerReader{
+		open: func() (io.ReadCloser, error) {
+			return c.assembleLayer(layer)
+		},
+		size: layer.UncompressedSize,
+	}, nil
+}
+
+func (c *ContainersStorage) ListReferrers(ctx context.Context, dgst digest.Digest) (_ []ocispec.Descriptor, err error) {
+	_, span := startSpan(ctx, "ContainersStorage.ListReferrers", attribute.String("digest", dgst.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	records, err := c.readImages()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[digest.Digest]struct{}{}
+	referrers := []ocispec.Descriptor{}
+	for _, record := range records {
+		for key, manifestDgst := range record.BigDataDigests {
+			if !strings.HasPrefix(key, manifestBigDataPrefix) {
+				continue
+			}
+			if _, ok := seen[manifestDgst]; ok {
+				continue
+			}
+			seen[manifestDgst] = struct{}{}
+			b, err := os.ReadFile(c.bigDataPath(record, key))
+			if err != nil {
+				return nil, err
+			}
+			desc := ocispec.Descriptor{Digest: manifestDgst, Size: record.BigDataSizes[key]}
+			subject, referrer, ok := parseReferrer(desc, b)
+			if !ok || subject != dgst {
+				continue
+			}
+			referrers = append(referrers, referrer)
+		}
+	}
+	return referrers, nil
+}
+
+// walk appends the digests which can be served for the manifest or index and its children.
+func (c *ContainersStorage) walk(record storageImage, layers []storageLayer, dgst digest.Digest, keys *[]string) error {
+	read := func(dgst digest.Digest) ([]byte, error) {
+		key, ok := record.bigDataKey(dgst)
+		if !ok {
+			return nil, fmt.Errorf("manifest with digest %s: %w", dgst.String(), errdefs.ErrNotFound)
+		}
+		return c.readBigData(record, key)
+	}
+	exists := func(dgst digest.Digest) bool {
+		if _, ok := record.bigDataKey(dgst); ok {
+			return true
+		}
+		return slices.ContainsFunc(layers, func(l storageLayer) bool { return c.canAssemble(l, dgst) })
+	}
+	return walkManifests(dgst, read, exists, keys)
+}
+
+// targetDigest returns the digest of the top level manifest of the image, which is the index if it has been stored.
+func (c *ContainersStorage) targetDigest(record storageImage) (digest.Digest, error) {
+	for key, dgst := range record.BigDataDigests {
+		if !strings.HasPrefix(key, manifestBigDataPrefix) {
+			continue
+		}
+		b, err := os.ReadFile(c.bigDataPath(record, key))
+		if err != nil {
+			return "", err
+		}
+		var ud UnknownDocument
+		if err := json.Unmarshal(b, &ud); err != nil {
+			return "", err
+		}
+		if ud.MediaType == images.MediaTypeDockerSchema2ManifestList || ud.MediaType == ocispec.MediaTypeImageIndex {
+			return dgst, nil
+		}
+	}
+	if record.Digest == "" {
+		return "", fmt.Errorf("image %s does not have a digest", record.ID)
+	}
+	return record.Digest, nil
+}
+
+func (c *ContainersStorage) findLayer(dgst digest.Digest) (storageLayer, error) {
+	layers, err := c.readLayers()
+	if err != nil {
+		return storageLayer{}, err
+	}
+	for _, layer := range layers {
+		if c.canAssemble(layer, dgst) {
+			return layer, nil
+		}
+	}
+	return storageLayer{}, fmt.Errorf("blob with digest %s: %w", dgst.String(), errdefs.ErrNotFound)
+}
+
+// canAssemble returns true if the layer content matching the digest can be reassembled. This is only
+// the case for uncompressed layers as the compressed content is not kept. The size has to be known
+// and both the tar metadata and the unpacked files have to exist, otherwise the layer can not be served.
+func (c *ContainersStorage) canAssemble(layer storageLayer, dgst digest.Digest) bool {
+	if layer.UncompressedDigest != dgst || layer.UncompressedSize <= 0 {
+		return false
+	}
+	if layer.CompressedDigest != "" && layer.CompressedDigest != layer.UncompressedDigest {
+		return false
+	}
+	for _, p := range []string{c.tarSplitPath(layer), c.diffPath(layer.ID)} {
+		if _, err := os.Stat(p); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// assembleLayer returns the uncompressed tar stream of the layer, which is recreated from the
+// unpacked files and the tar metadata stored when the layer was pulled.
+func (c *ContainersStorage) assembleLayer(layer storageLayer) (io.ReadCloser, error) {
+	f, err := os.Open(c.tarSplitPath(layer))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("layer %s: %w", layer.ID, errdefs.ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	rc := asm.NewOutputTarStream(storage.NewPathFileGetter(c.diffPath(layer.ID)), storage.NewJSONUnpacker(gzr))
+	return &multiCloser{
+		Reader:  rc,
+		closers: []io.Closer{rc, gzr, f},
+	}, nil
+}
+
+func (c *ContainersStorage) readImages() ([]storageImage, error) {
+	b, err := os.ReadFile(filepath.Join(c.imagesDir(), imagesFile))
+	if err != nil {
+		return nil, err
+	}
+	records := []storageImage{}
+	err = json.Unmarshal(b, &records)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (c *ContainersStorage) readLayers() ([]storageLayer, error) {
+	b, err := os.ReadFile(filepath.Join(c.root, c.driver+"-layers", layersFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return []storageLayer{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	layers := []storageLayer{}
+	err = json.Unmarshal(b, &layers)
+	if err != nil {
+		return nil, err
+	}
+	return layers, nil
+}
+
+func (c *ContainersStorage) imagesDir() string {
+	return filepath.Join(c.root, c.driver+"-images")
+}
+
+func (c *ContainersStorage) bigDataPath(record storageImage, key string) string {
+	return filepath.Join(c.imagesDir(), record.ID, bigDataFileName(key))
+}
+
+// openBigData opens the big data item of the image. Items removed since the image list was read are not found.
+func (c *ContainersStorage) openBigData(record storageImage, key string) (*os.File, error) {
+	f, err := os.Open(c.bigDataPath(record, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("big data %s of image %s: %w", key, record.ID, errdefs.ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (c *ContainersStorage) readBigData(record storageImage, key string) ([]byte, error) {
+	f, err := c.openBigData(record, key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (c *ContainersStorage) tarSplitPath(layer storageLayer) string {
+	return filepath.Join(c.root, c.driver+"-layers", layer.ID+".tar-split.gz")
+}
+
+// storageImage is an image record in the images.json file of containers/storage.
+type storageImage struct {
+	BigDataSizes   map[string]int64         `json:"big-data-sizes,omitempty"`
+	BigDataDigests map[string]digest.Digest `json:"big-data-digests,omitempty"`
+	ID             string                   `json:"id"`
+	Digest         digest.Digest            `json:"digest,omitempty"`
+	Names          []string                 `json:"names,omitempty"`
+}
+
+// bigDataKey returns the key of the big data item with the digest.
+func (s storageImage) bigDataKey(dgst digest.Digest) (string, bool) {
+	// The default manifest key duplicates one of the digest specific keys.
+	for key, v := range s.BigDataDigests {
+		if v == dgst && key != manifestBigDataDefault {
+			return key, true
+		}
+	}
+	if s.BigDataDigests[manifestBigDataDefault] == dgst && dgst != "" {
+		return manifestBigDataDefault, true
+	}
+	return "", false
+}
+
+// storageLayer is a layer record in the layers.json file of containers/storage.
+type storageLayer struct {
+	ID                 string        `json:"id"`
+	CompressedDigest   digest.Digest `json:"compressed-diff-digest,omitempty"`
+	UncompressedDigest digest.Digest `json:"diff-digest,omitempty"`
+	UncompressedSize   int64         `json:"diff-size,omitempty"`
+}
+
+// bigDataFileName returns the file name which containers/storage stores the big data key in.
+// Keys which contain characters other than lower case letters, digits and dots are base64 encoded.
+func bigDataFileName(key string) string {
+	for _, ch := range key {
+		if ch != '.' && (ch < '0' || ch > '9') && (ch < 'a' || ch > 'z') {
+			return "=" + base64.StdEncoding.EncodeToString([]byte(key))
+		}
+	}
+	return key
+}
+
+// parseStorageName parses an image name, which references the target digest unless it contains a digest.
+func parseStorageName(name string, target digest.Digest) (Image, error) {
+	if strings.Contains(name, "@") {
+		return Parse(name, "")
+	}
+	return Parse(name, target)
+}
+
+// layerReader reassembles a layer on demand. Seeking restarts the assembly, with the content
+// before the offset discarded, which is enough to serve range requests.
+type layerReader struct {
+	open   func() (io.ReadCloser, error)
+	rc     io.ReadCloser
+	size   int64
+	offset int64
+}
+
+func (l *layerReader) Read(p []byte) (int, error) {
+	if l.rc == nil {
+		rc, err := l.open()
+		if err != nil {
+			return 0, err
+		}
+		_, err = io.CopyN(io.Discard, rc, l.offset)
+		if err != nil {
+			rc.Close()
+			return 0, err
+		}
+		l.rc = rc
+	}
+	n, err := l.rc.Read(p)
+	l.offset += int64(n)
+	return n, err
+}
+
+func (l *layerReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += l.offset
+	case io.SeekEnd:
+		offset += l.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset == l.offset {
+		return offset, nil
+	}
+	err := l.Close()
+	if err != nil {
+		return 0, err
+	}
+	l.offset = offset
+	return offset, nil
+}
+
+func (l *layerReader) Close() error {
+	if l.rc == nil {
+		return nil
+	}
+	err := l.rc.Close()
+	l.rc = nil
+	return err
+}
+
+type multiCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m *multiCloser) Close() error {
+	errs := []error{}
+	for _, c := range m.closers {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
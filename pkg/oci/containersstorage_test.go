@@ -0,0 +1,301 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+	"github.com/vbatts/tar-split/tar/asm"
+	"github.com/vbatts/tar-split/tar/storage"
+)
+
+type storageFixture struct {
+	root         string
+	index        digest.Digest
+	manifest     digest.Digest
+	config       digest.Digest
+	layer        digest.Digest
+	gzipLayer    digest.Digest
+	layerContent []byte
+}
+
+// writeStorageFixture writes a containers/storage tree with an image index containing a single
+// manifest with an uncompressed and a compressed layer.
+func writeStorageFixture(t *testing.T) storageFixture {
+	t.Helper()
+
+	root := t.TempDir()
+	imagesDir := filepath.Join(root, "overlay-images")
+	layersDir := filepath.Join(root, "overlay-layers")
+
+	// Uncompressed layer which is stored as tar-split metadata and unpacked files.
+	layerID := "layer1"
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	content := []byte("hello world")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0o644, Size: int64(len(content)), ModTime: time.Unix(0, 0)}))
+	_, err := tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	layerContent := buf.Bytes()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "overlay", layerID, "diff"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "overlay", layerID, "diff", "hello.txt"), content, 0o644))
+	require.NoError(t, os.MkdirAll(layersDir, 0o755))
+	tsf, err := os.Create(filepath.Join(layersDir, layerID+".tar-split.gz"))
+	require.NoError(t, err)
+	gzw := gzip.NewWriter(tsf)
+	its, err := asm.NewInputTarStream(bytes.NewReader(layerContent), storage.NewJSONPacker(gzw), storage.NewDiscardFilePutter())
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, its)
+	require.NoError(t, err)
+	require.NoError(t, gzw.Close())
+	require.NoError(t, tsf.Close())
+	layerDgst := digest.FromBytes(layerContent)
+	gzipLayerDgst := digest.FromString("compressed")
+	layers := []storageLayer{
+		{ID: layerID, UncompressedDigest: layerDgst, UncompressedSize: int64(len(layerContent))},
+		{ID: "layer2", CompressedDigest: gzipLayerDgst, UncompressedDigest: digest.FromString("uncompressed"), UncompressedSize: 10},
+	}
+	b, err := json.Marshal(layers)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(layersDir, layersFile), b, 0o644))
+
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers"}}`)
+	configDgst := digest.FromBytes(config)
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: configDgst, Size: int64(len(config))},
+		Layers: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageLayer, Digest: layerDgst, Size: int64(len(layerContent))},
+			{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: gzipLayerDgst, Size: 10},
+		},
+	})
+	require.NoError(t, err)
+	manifestDgst := digest.FromBytes(manifest)
+	index, err := json.Marshal(ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: manifestDgst, Size: int64(len(manifest))},
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("other platform"), Size: 10},
+		},
+	})
+	require.NoError(t, err)
+	indexDgst := digest.FromBytes(index)
+
+	imageID := "image1"
+	bigData := map[string][]byte{
+		manifestBigDataPrefix + indexDgst.String():    index,
+		manifestBigDataPrefix + manifestDgst.String(): manifest,
+		manifestBigDataDefault:                        manifest,
+		configDgst.String():                           config,
+	}
+	record := storageImage{
+		ID:             imageID,
+		Digest:         manifestDgst,
+		Names:          []string{"docker.io/library/test:1.0", "example.com/library/test:1.0"},
+		BigDataSizes:   map[string]int64{},
+		BigDataDigests: map[string]digest.Digest{},
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(imagesDir, imageID), 0o755))
+	for key, v := range bigData {
+		record.BigDataSizes[key] = int64(len(v))
+		record.BigDataDigests[key] = digest.FromBytes(v)
+		require.NoError(t, os.WriteFile(filepath.Join(imagesDir, imageID, bigDataFileName(key)), v, 0o644))
+	}
+	b, err = json.Marshal([]storageImage{record})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(imagesDir, imagesFile), b, 0o644))
+
+	return storageFixture{
+		root:         root,
+		index:        indexDgst,
+		manifest:     manifestDgst,
+		config:       configDgst,
+		layer:        layerDgst,
+		gzipLayer:    gzipLayerDgst,
+		layerContent: layerContent,
+	}
+}
+
+func TestContainersStorage(t *testing.T) {
+	t.Parallel()
+
+	fixture := writeStorageFixture(t)
+	cs, err := NewContainersStorage(fixture.root, "overlay", []url.URL{{Host: "docker.io"}})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, cs.Verify(ctx))
+	ready, err := cs.Ready(ctx)
+	require.NoError(t, err)
+	require.True(t, ready)
+
+	imgs, err := cs.ListImages(ctx)
+	require.NoError(t, err)
+	require.Len(t, imgs, 1)
+	require.Equal(t, "docker.io/library/test:1.0", imgs[0].Name)
+	require.Equal(t, fixture.index, imgs[0].Digest)
+
+	dgst, err := cs.Resolve(ctx, "docker.io/library/test:1.0")
+	require.NoError(t, err)
+	require.Equal(t, fixture.index, dgst)
+	_, err = cs.Resolve(ctx, "docker.io/library/missing:1.0")
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+
+	// The compressed layer is not advertised as it can not be reassembled.
+	keys, err := cs.AllIdentifiers(ctx, imgs[0])
+	require.NoError(t, err)
+	require.Equal(t, []string{fixture.index.String(), fixture.manifest.String(), fixture.config.String(), fixture.layer.String()}, keys)
+
+	b, mediaType, err := cs.GetManifest(ctx, fixture.index)
+	require.NoError(t, err)
+	require.Equal(t, ocispec.MediaTypeImageIndex, mediaType)
+	require.Equal(t, fixture.index, digest.FromBytes(b))
+	_, mediaType, err = cs.GetManifest(ctx, fixture.config)
+	require.NoError(t, err)
+	require.Equal(t, ocispec.MediaTypeImageConfig, mediaType)
+
+	size, err := cs.Size(ctx, fixture.manifest)
+	require.NoError(t, err)
+	_, err = cs.GetBlob(ctx, fixture.manifest)
+	require.NoError(t, err)
+	b, _, err = cs.GetManifest(ctx, fixture.manifest)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(b)), size)
+
+	size, err = cs.Size(ctx, fixture.layer)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(fixture.layerContent)), size)
+	rc, err := cs.GetBlob(ctx, fixture.layer)
+	require.NoError(t, err)
+	b, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	require.Equal(t, fixture.layerContent, b)
+	offset, err := rc.Seek(512, io.SeekStart)
+	require.NoError(t, err)
+	require.Equal(t, int64(512), offset)
+	b, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	require.Equal(t, fixture.layerContent[512:], b)
+	require.NoError(t, rc.Close())
+
+	_, err = cs.Size(ctx, fixture.gzipLayer)
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+	_, err = cs.GetBlob(ctx, fixture.gzipLayer)
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+
+	referrers, err := cs.ListReferrers(ctx, fixture.manifest)
+	require.NoError(t, err)
+	require.Empty(t, referrers)
+}
+
+func TestContainersStorageMissingContent(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cs, err := NewContainersStorage(t.TempDir(), "overlay", []url.URL{{Host: "docker.io"}})
+	require.NoError(t, err)
+	ready, err := cs.Ready(ctx)
+	require.NoError(t, err)
+	require.False(t, ready)
+
+	fixture := writeStorageFixture(t)
+	cs, err = NewContainersStorage(fixture.root, "overlay", []url.URL{{Host: "docker.io"}})
+	require.NoError(t, err)
+
+	// Layers without unpacked files can not be reassembled and are not advertised.
+	require.NoError(t, os.RemoveAll(filepath.Join(fixture.root, "overlay", "layer1", "diff")))
+	imgs, err := cs.ListImages(ctx)
+	require.NoError(t, err)
+	require.Len(t, imgs, 1)
+	keys, err := cs.AllIdentifiers(ctx, imgs[0])
+	require.NoError(t, err)
+	require.Equal(t, []string{fixture.index.String(), fixture.manifest.String(), fixture.config.String()}, keys)
+	_, err = cs.GetBlob(ctx, fixture.layer)
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+
+	// Big data removed after the image list was read is not found.
+	require.NoError(t, os.Remove(filepath.Join(fixture.root, "overlay-images", "image1", bigDataFileName(fixture.config.String()))))
+	_, err = cs.GetBlob(ctx, fixture.config)
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+	_, _, err = cs.GetManifest(ctx, fixture.config)
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+}
+
+func TestContainersStorageSubscribe(t *testing.T) {
+	t.Parallel()
+
+	fixture := writeStorageFixture(t)
+	cs, err := NewContainersStorage(fixture.root, "overlay", []url.URL{{Host: "docker.io"}})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	imgCh, _, err := cs.Subscribe(ctx)
+	require.NoError(t, err)
+
+	imagesPath := filepath.Join(fixture.root, "overlay-images", imagesFile)
+	b, err := os.ReadFile(imagesPath)
+	require.NoError(t, err)
+	records := []storageImage{}
+	require.NoError(t, json.Unmarshal(b, &records))
+	records[0].Names = []string{"docker.io/library/test:2.0"}
+	b, err = json.Marshal(records)
+	require.NoError(t, err)
+	// Images are written to a temporary file which replaces the image list.
+	tmpPath := filepath.Join(fixture.root, "images.json.tmp")
+	require.NoError(t, os.WriteFile(tmpPath, b, 0o644))
+	require.NoError(t, os.Rename(tmpPath, imagesPath))
+
+	events := []ImageEvent{<-imgCh, <-imgCh}
+	require.ElementsMatch(t, []string{"docker.io/library/test:2.0", "docker.io/library/test:1.0"}, []string{events[0].Image.Name, events[1].Image.Name})
+	for _, event := range events {
+		switch event.Image.Name {
+		case "docker.io/library/test:2.0":
+			require.Equal(t, CreateEvent, event.Type)
+		case "docker.io/library/test:1.0":
+			require.Equal(t, DeleteEvent, event.Type)
+		}
+	}
+}
+
+func TestBigDataFileName(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{
+			key:      "manifest",
+			expected: "manifest",
+		},
+		{
+			key:      "manifest-sha256:abc",
+			expected: "=bWFuaWZlc3Qtc2hhMjU2OmFiYw==",
+		},
+		{
+			key:      "sha256:abc",
+			expected: "=c2hhMjU2OmFiYw==",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tt.expected, bigDataFileName(tt.key))
+		})
+	}
+}
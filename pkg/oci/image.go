@@ -16,6 +16,8 @@ type Image struct {
 	Repository string
 	Tag        string
 	Digest     digest.Digest
+	// Namespace is the Containerd namespace of the image, empty for other clients.
+	Namespace string
 }
 
 type EventType string
@@ -72,6 +74,11 @@ func (i Image) TagName() (string, bool) {
 	return fmt.Sprintf("%s/%s:%s", i.Registry, i.Repository, i.Tag), true
 }
 
+// RepositoryKey returns the key used to advertise that tags of the repository are available.
+func RepositoryKey(registry, repository string) string {
+	return fmt.Sprintf("repository/%s/%s", registry, repository)
+}
+
 var splitRe = regexp.MustCompile(`[:@]`)
 
 func Parse(s string, extraDgst digest.Digest) (Image, error) {
@@ -122,3 +129,29 @@ func splitObject(obj string) (tag string, dgst digest.Digest) {
 	}
 	return parts[0], digest.Digest(parts[1])
 }
+
+// diffImages returns the events which changes the images from the old to the new list.
+func diffImages(oldImgs, newImgs []Image) []ImageEvent {
+	oldByName := map[string]Image{}
+	for _, img := range oldImgs {
+		oldByName[img.Name] = img
+	}
+	events := []ImageEvent{}
+	for _, img := range newImgs {
+		oldImg, ok := oldByName[img.Name]
+		delete(oldByName, img.Name)
+		switch {
+		case !ok:
+			events = append(events, ImageEvent{Image: img, Type: CreateEvent})
+		case oldImg.Digest != img.Digest:
+			events = append(events, ImageEvent{Image: img, Type: UpdateEvent})
+		}
+	}
+	for _, img := range oldImgs {
+		if _, ok := oldByName[img.Name]; !ok {
+			continue
+		}
+		events = append(events, ImageEvent{Image: img, Type: DeleteEvent})
+	}
+	return events
+}
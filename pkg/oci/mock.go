@@ -1,24 +1,47 @@
 package oci
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
+	"slices"
+	"strings"
+	"sync"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-var _ Client = &MockClient{}
+var (
+	_ Client        = &MockClient{}
+	_ ContentWriter = &MockClient{}
+)
 
 type MockClient struct {
+	blobs  map[digest.Digest][]byte
 	images []Image
+	mx     sync.RWMutex
 }
 
 func NewMockClient(images []Image) *MockClient {
 	return &MockClient{
 		images: images,
+		blobs:  map[digest.Digest][]byte{},
 	}
 }
 
+// AddBlob stores content in the mock client and returns its digest.
+func (m *MockClient) AddBlob(b []byte) digest.Digest {
+	dgst := digest.FromBytes(b)
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.blobs[dgst] = b
+	return dgst
+}
+
 func (m *MockClient) Name() string {
 	return "mock"
 }
@@ -27,6 +50,10 @@ func (m *MockClient) Verify(ctx context.Context) error {
 	return nil
 }
 
+func (m *MockClient) Ready(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
 func (m *MockClient) Subscribe(ctx context.Context) (<-chan ImageEvent, <-chan error, error) {
 	return nil, nil, nil
 }
@@ -44,13 +71,89 @@ func (m *MockClient) Resolve(ctx context.Context, ref string) (digest.Digest, er
 }
 
 func (m *MockClient) Size(ctx context.Context, dgst digest.Digest) (int64, error) {
-	return 0, nil
+	b, ok := m.getBlob(dgst)
+	if !ok {
+		return 0, fmt.Errorf("blob with digest %s: %w", dgst.String(), errdefs.ErrNotFound)
+	}
+	return int64(len(b)), nil
 }
 
 func (m *MockClient) GetManifest(ctx context.Context, dgst digest.Digest) ([]byte, string, error) {
-	return nil, "", nil
+	b, ok := m.getBlob(dgst)
+	if !ok {
+		return nil, "", fmt.Errorf("manifest with digest %s: %w", dgst.String(), errdefs.ErrNotFound)
+	}
+	var ud UnknownDocument
+	if err := json.Unmarshal(b, &ud); err != nil {
+		return nil, "", err
+	}
+	return b, ud.MediaType, nil
+}
+
+func (m *MockClient) GetBlob(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
+	b, ok := m.getBlob(dgst)
+	if !ok {
+		return nil, fmt.Errorf("blob with digest %s: %w", dgst.String(), errdefs.ErrNotFound)
+	}
+	return struct {
+		io.ReadSeeker
+		io.Closer
+	}{
+		ReadSeeker: bytes.NewReader(b),
+		Closer:     io.NopCloser(nil),
+	}, nil
+}
+
+func (m *MockClient) ListReferrers(ctx context.Context, dgst digest.Digest) ([]ocispec.Descriptor, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	referrers := []ocispec.Descriptor{}
+	for blobDgst, b := range m.blobs {
+		desc := ocispec.Descriptor{Digest: blobDgst, Size: int64(len(b))}
+		subject, referrer, ok := parseReferrer(desc, b)
+		if !ok || subject != dgst {
+			continue
+		}
+		referrers = append(referrers, referrer)
+	}
+	slices.SortFunc(referrers, func(a, b ocispec.Descriptor) int {
+		return strings.Compare(a.Digest.String(), b.Digest.String())
+	})
+	return referrers, nil
 }
 
-func (m *MockClient) GetBlob(ctx context.Context, dgst digest.Digest) (io.ReadCloser, error) {
-	return nil, nil
+func (m *MockClient) NewBlobWriter(ctx context.Context, desc ocispec.Descriptor) (BlobWriter, error) { //nolint: ireturn // Implements the ContentWriter interface.
+	return &mockBlobWriter{client: m, desc: desc}, nil
+}
+
+func (m *MockClient) getBlob(dgst digest.Digest) ([]byte, bool) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	b, ok := m.blobs[dgst]
+	return b, ok
+}
+
+type mockBlobWriter struct {
+	client *MockClient
+	desc   ocispec.Descriptor
+	buf    bytes.Buffer
+}
+
+func (m *mockBlobWriter) Write(b []byte) (int, error) {
+	return m.buf.Write(b)
+}
+
+func (m *mockBlobWriter) Commit(ctx context.Context) error {
+	if int64(m.buf.Len()) != m.desc.Size {
+		return fmt.Errorf("unexpected commit size %d, expected %d", m.buf.Len(), m.desc.Size)
+	}
+	if dgst := digest.FromBytes(m.buf.Bytes()); dgst != m.desc.Digest {
+		return fmt.Errorf("unexpected commit digest %s, expected %s", dgst, m.desc.Digest)
+	}
+	m.client.AddBlob(m.buf.Bytes())
+	return nil
+}
+
+func (m *mockBlobWriter) Close() error {
+	return nil
 }
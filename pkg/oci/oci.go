@@ -2,11 +2,26 @@ package oci
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 
+	"github.com/containerd/containerd/images"
 	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/spegel-org/spegel/pkg/oci")
+
+// ErrResyncRequired is sent on the error channel of Subscribe when image events may have been missed,
+// for example after reconnecting, which means that all images have to be synced again.
+var ErrResyncRequired = errors.New("image events may have been missed")
+
 type UnknownDocument struct {
 	MediaType string `json:"mediaType,omitempty"`
 }
@@ -14,11 +29,96 @@ type UnknownDocument struct {
 type Client interface {
 	Name() string
 	Verify(ctx context.Context) error
+	Ready(ctx context.Context) (bool, error)
 	Subscribe(ctx context.Context) (<-chan ImageEvent, <-chan error, error)
 	ListImages(ctx context.Context) ([]Image, error)
 	AllIdentifiers(ctx context.Context, img Image) ([]string, error)
 	Resolve(ctx context.Context, ref string) (digest.Digest, error)
 	Size(ctx context.Context, dgst digest.Digest) (int64, error)
 	GetManifest(ctx context.Context, dgst digest.Digest) ([]byte, string, error)
-	GetBlob(ctx context.Context, dgst digest.Digest) (io.ReadCloser, error)
+	GetBlob(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error)
+	ListReferrers(ctx context.Context, dgst digest.Digest) ([]ocispec.Descriptor, error)
+}
+
+// ContentWriter is implemented by clients which are able to store content fetched from another source.
+type ContentWriter interface {
+	NewBlobWriter(ctx context.Context, desc ocispec.Descriptor) (BlobWriter, error)
+}
+
+// BlobWriter writes the content of a blob which is only stored once committed.
+type BlobWriter interface {
+	io.WriteCloser
+	Commit(ctx context.Context) error
+}
+
+// startSpan starts a span for a call to the client.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the error returned by the call, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// manifestDocument contains the fields of manifests and indexes needed to walk an image.
+type manifestDocument struct {
+	Subject   *ocispec.Descriptor  `json:"subject,omitempty"`
+	MediaType string               `json:"mediaType,omitempty"`
+	Config    ocispec.Descriptor   `json:"config"`
+	Manifests []ocispec.Descriptor `json:"manifests,omitempty"`
+	Layers    []ocispec.Descriptor `json:"layers,omitempty"`
+}
+
+// walkManifests appends the digests of the manifest or index and its children which exist locally.
+// Clients which store content as files use this instead of the containerd image walker.
+func walkManifests(dgst digest.Digest, read func(digest.Digest) ([]byte, error), exists func(digest.Digest) bool, keys *[]string) error {
+	b, err := read(dgst)
+	if err != nil {
+		return err
+	}
+	var doc manifestDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	*keys = append(*keys, dgst.String())
+	if doc.Subject != nil {
+		*keys = append(*keys, ReferrersKey(doc.Subject.Digest))
+	}
+	switch doc.MediaType {
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		found := false
+		for _, m := range doc.Manifests {
+			// Skip manifests that do not exist locally.
+			if !exists(m.Digest) {
+				continue
+			}
+			found = true
+			err := walkManifests(m.Digest, read, exists, keys)
+			if err != nil {
+				return err
+			}
+		}
+		if !found {
+			return fmt.Errorf("could not find any platforms with local content in manifest list: %v", dgst)
+		}
+		return nil
+	case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+		if exists(doc.Config.Digest) {
+			*keys = append(*keys, doc.Config.Digest.String())
+		}
+		for _, layer := range doc.Layers {
+			if !exists(layer.Digest) {
+				continue
+			}
+			*keys = append(*keys, layer.Digest.String())
+		}
+		return nil
+	default:
+		return fmt.Errorf("unexpected media type %v for digest: %v", doc.MediaType, dgst)
+	}
 }
@@ -0,0 +1,417 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/fsnotify/fsnotify"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var _ Client = &OCILayout{}
+
+// OCILayout reads images from one or more OCI image layout directories. Images are named by the
+// containerd image name or ref name annotations in the index, ref names which are only a tag are ignored
+// as the registry and repository are unknown.
+type OCILayout struct {
+	paths      []string
+	registries []string
+}
+
+func NewOCILayout(paths []string, registries []url.URL) (*OCILayout, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("at least one OCI layout path is required")
+	}
+	registryHosts := []string{}
+	for _, registry := range registries {
+		registryHosts = append(registryHosts, registry.Host)
+	}
+	return &OCILayout{
+		paths:      paths,
+		registries: registryHosts,
+	}, nil
+}
+
+func (o *OCILayout) Name() string {
+	return "oci-layout"
+}
+
+func (o *OCILayout) Verify(ctx context.Context) error {
+	errs := []error{}
+	for _, path := range o.paths {
+		b, err := os.ReadFile(filepath.Join(path, ocispec.ImageLayoutFile))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not read OCI layout %s: %w", path, err))
+			continue
+		}
+		var layout ocispec.ImageLayout
+		if err := json.Unmarshal(b, &layout); err != nil {
+			errs = append(errs, fmt.Errorf("could not parse OCI layout %s: %w", path, err))
+			continue
+		}
+		if layout.Version != ocispec.ImageLayoutVersion {
+			errs = append(errs, fmt.Errorf("unsupported OCI layout version %s in %s", layout.Version, path))
+			continue
+		}
+		_, err = o.readIndex(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not read OCI layout index %s: %w", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (o *OCILayout) Ready(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+// Subscribe watches the layout directories as the index is written or replaced whenever images are changed.
+func (o *OCILayout) Subscribe(ctx context.Context) (<-chan ImageEvent, <-chan error, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, path := range o.paths {
+		err = watcher.Add(path)
+		if err != nil {
+			watcher.Close()
+			return nil, nil, err
+		}
+	}
+	current, err := o.ListImages(ctx)
+	if err != nil {
+		watcher.Close()
+		return nil, nil, err
+	}
+	imgCh := make(chan ImageEvent)
+	errCh := make(chan error)
+	go func() {
+		defer func() {
+			watcher.Close()
+			close(imgCh)
+			close(errCh)
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Base(event.Name) != ocispec.ImageIndexFile || !(event.Has(fsnotify.Create) || event.Has(fsnotify.Write)) {
+					continue
+				}
+				imgs, err := o.ListImages(ctx)
+				if err != nil {
+					select {
+					case errCh <- err:
+					case <-ctx.Done():
+						return
+					}
+					continue
+				}
+				for _, imgEvent := range diffImages(current, imgs) {
+					select {
+					case imgCh <- imgEvent:
+					case <-ctx.Done():
+						return
+					}
+				}
+				current = imgs
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				select {
+				case errCh <- err:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return imgCh, errCh, nil
+}
+
+// ListImages returns the images in all layouts. An image name which exists in multiple layouts
+// is only returned from the first layout.
+func (o *OCILayout) ListImages(ctx context.Context) (_ []Image, err error) {
+	_, span := startSpan(ctx, "OCILayout.ListImages")
+	defer func() {
+		endSpan(span, err)
+	}()
+	seen := map[string]struct{}{}
+	imgs := []Image{}
+	for _, path := range o.paths {
+		index, err := o.readIndex(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, desc := range index.Manifests {
+			name, ok := layoutImageName(desc)
+			if !ok {
+				continue
+			}
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			img, err := parseStorageName(name, desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if !slices.Contains(o.registries, img.Registry) {
+				continue
+			}
+			seen[name] = struct{}{}
+			imgs = append(imgs, img)
+		}
+	}
+	return imgs, nil
+}
+
+func (o *OCILayout) AllIdentifiers(ctx context.Context, img Image) (_ []string, err error) {
+	_, span := startSpan(ctx, "OCILayout.AllIdentifiers", attribute.String("image", img.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	read := func(dgst digest.Digest) ([]byte, error) {
+		path, err := o.blobPath(dgst)
+		if err != nil {
+			return nil, err
+		}
+		return os.ReadFile(path)
+	}
+	exists := func(dgst digest.Digest) bool {
+		_, err := o.blobPath(dgst)
+		return err == nil
+	}
+	keys := []string{}
+	err = walkManifests(img.Digest, read, exists, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk image manifests: %w", err)
+	}
+	return keys, nil
+}
+
+func (o *OCILayout) Resolve(ctx context.Context, ref string) (_ digest.Digest, err error) {
+	_, span := startSpan(ctx, "OCILayout.Resolve", attribute.String("ref", ref))
+	defer func() {
+		endSpan(span, err)
+	}()
+	for _, path := range o.paths {
+		index, err := o.readIndex(path)
+		if err != nil {
+			return "", err
+		}
+		for _, desc := range index.Manifests {
+			name, ok := layoutImageName(desc)
+			if !ok || name != ref {
+				continue
+			}
+			return desc.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("image %s: %w", ref, errdefs.ErrNotFound)
+}
+
+func (o *OCILayout) Size(ctx context.Context, dgst digest.Digest) (_ int64, err error) {
+	_, span := startSpan(ctx, "OCILayout.Size", attribute.String("digest", dgst.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	path, err := o.blobPath(dgst)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (o *OCILayout) GetManifest(ctx context.Context, dgst digest.Digest) (_ []byte, _ string, err error) {
+	_, span := startSpan(ctx, "OCILayout.GetManifest", attribute.String("digest", dgst.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	path, err := o.blobPath(dgst)
+	if err != nil {
+		return nil, "", err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	var ud UnknownDocument
+	if err := json.Unmarshal(b, &ud); err != nil {
+		return nil, "", err
+	}
+	if ud.MediaType != "" {
+		return b, ud.MediaType, nil
+	}
+	var ic ocispec.Image
+	if err := json.Unmarshal(b, &ic); err != nil {
+		return nil, "", err
+	}
+	if isImageConfig(ic) {
+		return b, ocispec.MediaTypeImageConfig, nil
+	}
+	// Fall back to the media type of the descriptor as the field is optional in manifests.
+	descs, err := o.descriptors()
+	if err != nil {
+		return nil, "", err
+	}
+	for _, desc := range descs {
+		if desc.Digest == dgst && desc.MediaType != "" {
+			return b, desc.MediaType, nil
+		}
+	}
+	return nil, "", fmt.Errorf("could not determine media type for %s", dgst.String())
+}
+
+func (o *OCILayout) GetBlob(ctx context.Context, dgst digest.Digest) (_ io.ReadSeekCloser, err error) {
+	_, span := startSpan(ctx, "OCILayout.GetBlob", attribute.String("digest", dgst.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	path, err := o.blobPath(dgst)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (o *OCILayout) ListReferrers(ctx context.Context, dgst digest.Digest) (_ []ocispec.Descriptor, err error) {
+	_, span := startSpan(ctx, "OCILayout.ListReferrers", attribute.String("digest", dgst.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	descs, err := o.descriptors()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[digest.Digest]struct{}{}
+	referrers := []ocispec.Descriptor{}
+	for _, desc := range descs {
+		if _, ok := seen[desc.Digest]; ok {
+			continue
+		}
+		seen[desc.Digest] = struct{}{}
+		path, err := o.blobPath(desc.Digest)
+		if errors.Is(err, errdefs.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		subject, referrer, ok := parseReferrer(desc, b)
+		if !ok || subject != dgst {
+			continue
+		}
+		referrers = append(referrers, referrer)
+	}
+	return referrers, nil
+}
+
+// descriptors returns the manifest descriptors in the layout indexes, including those of nested indexes.
+func (o *OCILayout) descriptors() ([]ocispec.Descriptor, error) {
+	descs := []ocispec.Descriptor{}
+	for _, path := range o.paths {
+		index, err := o.readIndex(path)
+		if err != nil {
+			return nil, err
+		}
+		queue := index.Manifests
+		for len(queue) > 0 {
+			desc := queue[0]
+			queue = queue[1:]
+			descs = append(descs, desc)
+			if desc.MediaType != images.MediaTypeDockerSchema2ManifestList && desc.MediaType != ocispec.MediaTypeImageIndex {
+				continue
+			}
+			b, err := os.ReadFile(filepath.Join(path, layoutBlobPath(desc.Digest)))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			var child ocispec.Index
+			if err := json.Unmarshal(b, &child); err != nil {
+				return nil, err
+			}
+			queue = append(queue, child.Manifests...)
+		}
+	}
+	return descs, nil
+}
+
+// blobPath returns the path of the blob in the first layout which contains it.
+func (o *OCILayout) blobPath(dgst digest.Digest) (string, error) {
+	// Validating the digest guards against paths outside of the layout.
+	if err := dgst.Validate(); err != nil {
+		return "", err
+	}
+	for _, path := range o.paths {
+		blobPath := filepath.Join(path, layoutBlobPath(dgst))
+		_, err := os.Stat(blobPath)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return blobPath, nil
+	}
+	return "", fmt.Errorf("blob with digest %s: %w", dgst.String(), errdefs.ErrNotFound)
+}
+
+func (o *OCILayout) readIndex(path string) (ocispec.Index, error) {
+	b, err := os.ReadFile(filepath.Join(path, ocispec.ImageIndexFile))
+	if err != nil {
+		return ocispec.Index{}, err
+	}
+	var index ocispec.Index
+	err = json.Unmarshal(b, &index)
+	if err != nil {
+		return ocispec.Index{}, err
+	}
+	return index, nil
+}
+
+func layoutBlobPath(dgst digest.Digest) string {
+	return filepath.Join(ocispec.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// layoutImageName returns the full image name of the index descriptor.
+func layoutImageName(desc ocispec.Descriptor) (string, bool) {
+	if name, ok := desc.Annotations[images.AnnotationImageName]; ok {
+		return name, true
+	}
+	name, ok := desc.Annotations[ocispec.AnnotationRefName]
+	if !ok {
+		return "", false
+	}
+	// Ref names are commonly only a tag, which can not be parsed as there is no registry or repository.
+	if _, err := parseStorageName(name, desc.Digest); err != nil {
+		return "", false
+	}
+	return name, true
+}
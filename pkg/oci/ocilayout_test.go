@@ -0,0 +1,213 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+type layoutFixture struct {
+	path     string
+	index    digest.Digest
+	manifest digest.Digest
+	config   digest.Digest
+	layer    digest.Digest
+	referrer digest.Digest
+}
+
+// writeLayoutFixture writes an OCI image layout with an image index containing a single manifest
+// and a referrer of the manifest.
+func writeLayoutFixture(t *testing.T) layoutFixture {
+	t.Helper()
+
+	path := t.TempDir()
+	writeBlob := func(b []byte) digest.Digest {
+		dgst := digest.FromBytes(b)
+		require.NoError(t, os.MkdirAll(filepath.Join(path, "blobs", "sha256"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(path, "blobs", "sha256", dgst.Encoded()), b, 0o644))
+		return dgst
+	}
+	writeJSON := func(v interface{}) (digest.Digest, int64) {
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+		return writeBlob(b), int64(len(b))
+	}
+
+	layer := []byte("layer content")
+	layerDgst := writeBlob(layer)
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers"}}`)
+	configDgst := writeBlob(config)
+	manifestDgst, manifestSize := writeJSON(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: configDgst, Size: int64(len(config))},
+		Layers: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: layerDgst, Size: int64(len(layer))},
+		},
+	})
+	indexDgst, indexSize := writeJSON(ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: manifestDgst, Size: manifestSize},
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("other platform"), Size: 10},
+		},
+	})
+	referrerDgst, referrerSize := writeJSON(ocispec.Manifest{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.example.sbom",
+		Config:       ocispec.DescriptorEmptyJSON,
+		Subject:      &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: manifestDgst, Size: manifestSize},
+	})
+
+	b, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(path, ocispec.ImageLayoutFile), b, 0o644))
+	b, err = json.Marshal(ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{
+			{
+				MediaType: ocispec.MediaTypeImageIndex,
+				Digest:    indexDgst,
+				Size:      indexSize,
+				Annotations: map[string]string{
+					images.AnnotationImageName: "docker.io/library/test:1.0",
+					ocispec.AnnotationRefName:  "1.0",
+				},
+			},
+			{
+				MediaType:   ocispec.MediaTypeImageIndex,
+				Digest:      indexDgst,
+				Size:        indexSize,
+				Annotations: map[string]string{ocispec.AnnotationRefName: "example.com/library/test:1.0"},
+			},
+			{
+				MediaType:   ocispec.MediaTypeImageManifest,
+				Digest:      manifestDgst,
+				Size:        manifestSize,
+				Annotations: map[string]string{ocispec.AnnotationRefName: "latest"},
+			},
+			{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Digest:    referrerDgst,
+				Size:      referrerSize,
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(path, ocispec.ImageIndexFile), b, 0o644))
+
+	return layoutFixture{
+		path:     path,
+		index:    indexDgst,
+		manifest: manifestDgst,
+		config:   configDgst,
+		layer:    layerDgst,
+		referrer: referrerDgst,
+	}
+}
+
+func TestOCILayout(t *testing.T) {
+	t.Parallel()
+
+	fixture := writeLayoutFixture(t)
+	ol, err := NewOCILayout([]string{t.TempDir(), fixture.path}, []url.URL{{Host: "docker.io"}, {Host: "example.com"}})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.Error(t, ol.Verify(ctx))
+	ol, err = NewOCILayout([]string{fixture.path}, []url.URL{{Host: "docker.io"}, {Host: "example.com"}})
+	require.NoError(t, err)
+	require.NoError(t, ol.Verify(ctx))
+
+	imgs, err := ol.ListImages(ctx)
+	require.NoError(t, err)
+	require.Len(t, imgs, 2)
+	require.Equal(t, "docker.io/library/test:1.0", imgs[0].Name)
+	require.Equal(t, fixture.index, imgs[0].Digest)
+	require.Equal(t, "example.com/library/test:1.0", imgs[1].Name)
+
+	dgst, err := ol.Resolve(ctx, "example.com/library/test:1.0")
+	require.NoError(t, err)
+	require.Equal(t, fixture.index, dgst)
+	_, err = ol.Resolve(ctx, "docker.io/library/missing:1.0")
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+
+	keys, err := ol.AllIdentifiers(ctx, imgs[0])
+	require.NoError(t, err)
+	require.Equal(t, []string{fixture.index.String(), fixture.manifest.String(), fixture.config.String(), fixture.layer.String()}, keys)
+
+	b, mediaType, err := ol.GetManifest(ctx, fixture.index)
+	require.NoError(t, err)
+	require.Equal(t, ocispec.MediaTypeImageIndex, mediaType)
+	require.Equal(t, fixture.index, digest.FromBytes(b))
+	_, mediaType, err = ol.GetManifest(ctx, fixture.config)
+	require.NoError(t, err)
+	require.Equal(t, ocispec.MediaTypeImageConfig, mediaType)
+
+	size, err := ol.Size(ctx, fixture.layer)
+	require.NoError(t, err)
+	require.Equal(t, int64(len("layer content")), size)
+	rc, err := ol.GetBlob(ctx, fixture.layer)
+	require.NoError(t, err)
+	b, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	require.Equal(t, "layer content", string(b))
+	require.NoError(t, rc.Close())
+
+	_, err = ol.Size(ctx, digest.FromString("missing"))
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+	_, err = ol.GetBlob(ctx, digest.FromString("missing"))
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+	_, err = ol.GetBlob(ctx, digest.Digest("sha256:../../index.json"))
+	require.Error(t, err)
+
+	referrers, err := ol.ListReferrers(ctx, fixture.manifest)
+	require.NoError(t, err)
+	require.Len(t, referrers, 1)
+	require.Equal(t, fixture.referrer, referrers[0].Digest)
+	require.Equal(t, "application/vnd.example.sbom", referrers[0].ArtifactType)
+}
+
+func TestOCILayoutSubscribe(t *testing.T) {
+	t.Parallel()
+
+	fixture := writeLayoutFixture(t)
+	ol, err := NewOCILayout([]string{fixture.path}, []url.URL{{Host: "docker.io"}})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	imgCh, _, err := ol.Subscribe(ctx)
+	require.NoError(t, err)
+
+	indexPath := filepath.Join(fixture.path, ocispec.ImageIndexFile)
+	b, err := os.ReadFile(indexPath)
+	require.NoError(t, err)
+	var index ocispec.Index
+	require.NoError(t, json.Unmarshal(b, &index))
+	index.Manifests[0].Annotations[images.AnnotationImageName] = "docker.io/library/test:2.0"
+	b, err = json.Marshal(index)
+	require.NoError(t, err)
+	tmpPath := filepath.Join(t.TempDir(), "index.json.tmp")
+	require.NoError(t, os.WriteFile(tmpPath, b, 0o644))
+	require.NoError(t, os.Rename(tmpPath, indexPath))
+
+	events := []ImageEvent{<-imgCh, <-imgCh}
+	require.ElementsMatch(t, []string{"docker.io/library/test:2.0", "docker.io/library/test:1.0"}, []string{events[0].Image.Name, events[1].Image.Name})
+	for _, event := range events {
+		switch event.Image.Name {
+		case "docker.io/library/test:2.0":
+			require.Equal(t, CreateEvent, event.Type)
+		case "docker.io/library/test:1.0":
+			require.Equal(t, DeleteEvent, event.Type)
+		}
+	}
+}
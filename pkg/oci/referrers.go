@@ -0,0 +1,51 @@
+package oci
+
+import (
+	"encoding/json"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ReferrersKey returns the key used to advertise that referrers of the subject digest are available.
+func ReferrersKey(dgst digest.Digest) string {
+	return "referrers/" + dgst.String()
+}
+
+// referrerDocument contains the fields of manifests and indexes which describe a referrer.
+type referrerDocument struct {
+	Subject      *ocispec.Descriptor `json:"subject,omitempty"`
+	Annotations  map[string]string   `json:"annotations,omitempty"`
+	MediaType    string              `json:"mediaType,omitempty"`
+	ArtifactType string              `json:"artifactType,omitempty"`
+	Config       ocispec.Descriptor  `json:"config"`
+}
+
+// parseReferrer returns the subject of the manifest or index and the descriptor used to list it as a referrer.
+// False is returned if the content does not have a subject.
+func parseReferrer(desc ocispec.Descriptor, b []byte) (digest.Digest, ocispec.Descriptor, bool) {
+	var doc referrerDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return "", ocispec.Descriptor{}, false
+	}
+	if doc.Subject == nil {
+		return "", ocispec.Descriptor{}, false
+	}
+	mediaType := desc.MediaType
+	if doc.MediaType != "" {
+		mediaType = doc.MediaType
+	}
+	// The config media type is used as artifact type for manifests without one as defined by the distribution spec.
+	artifactType := doc.ArtifactType
+	if artifactType == "" && mediaType == ocispec.MediaTypeImageManifest {
+		artifactType = doc.Config.MediaType
+	}
+	referrer := ocispec.Descriptor{
+		MediaType:    mediaType,
+		Digest:       desc.Digest,
+		Size:         desc.Size,
+		ArtifactType: artifactType,
+		Annotations:  doc.Annotations,
+	}
+	return doc.Subject.Digest, referrer, true
+}
@@ -0,0 +1,227 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spegel-org/spegel/internal/mux"
+	"github.com/spegel-org/spegel/pkg/oci"
+)
+
+const (
+	// maxTagsPeers is the max amount of peers which are asked for tags of a repository.
+	maxTagsPeers = 10
+	// peerTagsTimeout is how long to wait for a peer to list tags.
+	peerTagsTimeout = 5 * time.Second
+)
+
+type tagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+type catalogList struct {
+	Repositories []string `json:"repositories"`
+}
+
+// handleTags lists the tags of the repository from local images. Tags advertised by peers
+// are included when enabled, unless the request was sent by another peer.
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-tags
+func (r *Registry) handleTags(rw mux.ResponseWriter, req *http.Request, ref reference) {
+	n, last, err := parsePagination(req)
+	if err != nil {
+		rw.WriteError(http.StatusBadRequest, err)
+		return
+	}
+	imgs, err := r.ociClient.ListImages(req.Context())
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, fmt.Errorf("could not list images: %w", err))
+		return
+	}
+	tags := []string{}
+	for _, img := range imgs {
+		if img.Tag == "" || fmt.Sprintf("%s/%s", img.Registry, img.Repository) != ref.name {
+			continue
+		}
+		tags = append(tags, img.Tag)
+	}
+	if r.peerTags && !isPeerRequest(req) {
+		tags = append(tags, r.listPeerTags(req, ref)...)
+	}
+	if len(tags) == 0 {
+		rw.WriteError(http.StatusNotFound, mux.WithCode(mux.ErrorCodeNameUnknown, fmt.Errorf("repository %s could not be found", ref.name)))
+		return
+	}
+	slices.Sort(tags)
+	tags = slices.Compact(tags)
+	tags, more := paginate(tags, n, last)
+	if more {
+		setNextLink(rw, req, n, tags[len(tags)-1])
+	}
+	name := ref.name
+	if ref.originalRegistry != "" {
+		name = strings.TrimPrefix(name, ref.originalRegistry+"/")
+	}
+	r.writeJSON(rw, req, tagList{Name: name, Tags: tags})
+}
+
+// handleCatalog lists the repositories of local images. Repositories are prefixed with their
+// registry unless the registry parameter is set.
+// https://distribution.github.io/distribution/spec/api/#catalog
+func (r *Registry) handleCatalog(rw mux.ResponseWriter, req *http.Request, ref reference) {
+	n, last, err := parsePagination(req)
+	if err != nil {
+		rw.WriteError(http.StatusBadRequest, err)
+		return
+	}
+	imgs, err := r.ociClient.ListImages(req.Context())
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, fmt.Errorf("could not list images: %w", err))
+		return
+	}
+	repositories := []string{}
+	for _, img := range imgs {
+		if ref.originalRegistry == "" {
+			repositories = append(repositories, fmt.Sprintf("%s/%s", img.Registry, img.Repository))
+			continue
+		}
+		if img.Registry == ref.originalRegistry {
+			repositories = append(repositories, img.Repository)
+		}
+	}
+	slices.Sort(repositories)
+	repositories = slices.Compact(repositories)
+	repositories, more := paginate(repositories, n, last)
+	if more {
+		setNextLink(rw, req, n, repositories[len(repositories)-1])
+	}
+	r.writeJSON(rw, req, catalogList{Repositories: repositories})
+}
+
+// listPeerTags returns the tags of the repository listed by peers which advertise it.
+// Peers which fail to list their tags are ignored.
+func (r *Registry) listPeerTags(req *http.Request, ref reference) []string {
+	registry, repository, _ := strings.Cut(ref.name, "/")
+	resolveCtx, cancel := context.WithTimeout(req.Context(), r.resolveTimeout)
+	defer cancel()
+	peerCh, err := r.router.Resolve(resolveCtx, oci.RepositoryKey(registry, repository), false, maxTagsPeers)
+	if err != nil {
+		r.log.Error(err, "could not resolve peers with repository", "repository", ref.name)
+		return nil
+	}
+	peers := collectPeers(resolveCtx, peerCh, maxTagsPeers)
+
+	tags := []string{}
+	mx := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			peerTags, err := r.fetchPeerTags(req, peer, registry, repository)
+			if err != nil {
+				r.log.V(4).Info("could not list tags from peer", "peer", peer.String(), "reason", err.Error())
+				return
+			}
+			mx.Lock()
+			defer mx.Unlock()
+			tags = append(tags, peerTags...)
+		}()
+	}
+	wg.Wait()
+	return tags
+}
+
+// fetchPeerTags lists the tags of the repository from the local images of the peer.
+func (r *Registry) fetchPeerTags(req *http.Request, peer netip.AddrPort, registry, repository string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), peerTagsTimeout)
+	defer cancel()
+	u := peerURL(req, peer)
+	u.Path = fmt.Sprintf("/v2/%s/tags/list", repository)
+	u.RawQuery = url.Values{"ns": {registry}}.Encode()
+	peerReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	r.setVia(peerReq.Header, viaChain(req))
+	resp, err := r.roundTripper().RoundTrip(peerReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("expected peer to respond with 200 OK but received: %s", resp.Status)
+	}
+	list := tagList{}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list.Tags, nil
+}
+
+// parsePagination returns the max amount of results and the last result of the previous page.
+// The amount is negative when no limit is requested.
+func parsePagination(req *http.Request) (int, string, error) {
+	query := req.URL.Query()
+	v := query.Get("n")
+	if v == "" {
+		return -1, query.Get("last"), nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, "", mux.WithCode(mux.ErrorCodePaginationNumberInvalid, errors.New("invalid number of results requested"))
+	}
+	return n, query.Get("last"), nil
+}
+
+// paginate returns the sorted entries following last limited to n entries, and if more entries exist.
+func paginate(entries []string, n int, last string) ([]string, bool) {
+	if last != "" {
+		i, found := slices.BinarySearch(entries, last)
+		if found {
+			i++
+		}
+		entries = entries[i:]
+	}
+	if n < 0 || len(entries) <= n {
+		return entries, false
+	}
+	return entries[:n], n > 0
+}
+
+// setNextLink sets the link header to the next page of results.
+func setNextLink(rw mux.ResponseWriter, req *http.Request, n int, last string) {
+	query := req.URL.Query()
+	query.Set("n", strconv.Itoa(n))
+	query.Set("last", last)
+	u := url.URL{Path: req.URL.Path, RawQuery: query.Encode()}
+	rw.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, u.String()))
+}
+
+func (r *Registry) writeJSON(rw mux.ResponseWriter, req *http.Request, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, fmt.Errorf("could not encode response: %w", err))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Content-Length", strconv.FormatInt(int64(len(b)), 10))
+	if req.Method == http.MethodHead {
+		return
+	}
+	_, err = rw.Write(b)
+	if err != nil {
+		r.log.Error(err, "error occurred when writing response")
+		return
+	}
+}
@@ -0,0 +1,172 @@
+package registry
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/spegel-org/spegel/internal/mux"
+	"github.com/spegel-org/spegel/pkg/oci"
+	"github.com/spegel-org/spegel/pkg/routing"
+)
+
+func TestListHandler(t *testing.T) {
+	t.Parallel()
+
+	imgs := []oci.Image{}
+	for _, imageStr := range []string{
+		"docker.io/library/nginx:1.25@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020",
+		"docker.io/library/nginx:1.24@sha256:fa32bd3bcd49a45a62cfc1b0fed6a0b63bf8af95db5bad7ec22865aee0a4b795",
+		"docker.io/library/nginx:latest@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020",
+		"docker.io/library/nginx@sha256:25fad2a32ad1f6f510e528448ae1ec69a28ef81916a004d3629874104f8a7f70",
+		"ghcr.io/spegel-org/spegel:v0.0.9@sha256:fa32bd3bcd49a45a62cfc1b0fed6a0b63bf8af95db5bad7ec22865aee0a4b795",
+	} {
+		img, err := oci.Parse(imageStr, "")
+		require.NoError(t, err)
+		imgs = append(imgs, img)
+	}
+	reg := NewRegistry(oci.NewMockClient(imgs), routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}))
+
+	tests := []struct {
+		name           string
+		target         string
+		expectedBody   string
+		expectedLink   string
+		expectedStatus int
+	}{
+		{
+			name:           "all tags",
+			target:         "/v2/library/nginx/tags/list?ns=docker.io",
+			expectedBody:   `{"name":"library/nginx","tags":["1.24","1.25","latest"]}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "tags without registry parameter",
+			target:         "/v2/docker.io/library/nginx/tags/list",
+			expectedBody:   `{"name":"docker.io/library/nginx","tags":["1.24","1.25","latest"]}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "first page of tags",
+			target:         "/v2/library/nginx/tags/list?ns=docker.io&n=2",
+			expectedBody:   `{"name":"library/nginx","tags":["1.24","1.25"]}`,
+			expectedLink:   `</v2/library/nginx/tags/list?last=1.25&n=2&ns=docker.io>; rel="next"`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "last page of tags",
+			target:         "/v2/library/nginx/tags/list?ns=docker.io&n=2&last=1.25",
+			expectedBody:   `{"name":"library/nginx","tags":["latest"]}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "zero tags requested",
+			target:         "/v2/library/nginx/tags/list?ns=docker.io&n=0",
+			expectedBody:   `{"name":"library/nginx","tags":[]}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "unknown repository",
+			target:         "/v2/library/foo/tags/list?ns=docker.io",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "invalid number of tags",
+			target:         "/v2/library/nginx/tags/list?ns=docker.io&n=-1",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "all repositories",
+			target:         "/v2/_catalog",
+			expectedBody:   `{"repositories":["docker.io/library/nginx","ghcr.io/spegel-org/spegel"]}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "repositories with registry parameter",
+			target:         "/v2/_catalog?ns=docker.io",
+			expectedBody:   `{"repositories":["library/nginx"]}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "first page of repositories",
+			target:         "/v2/_catalog?n=1",
+			expectedBody:   `{"repositories":["docker.io/library/nginx"]}`,
+			expectedLink:   `</v2/_catalog?last=docker.io%2Flibrary%2Fnginx&n=1>; rel="next"`,
+			expectedStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.target, nil)
+			m, err := mux.NewServeMux(reg.handle)
+			require.NoError(t, err)
+			m.ServeHTTP(rw, req)
+
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			require.Equal(t, tt.expectedLink, resp.Header.Get("Link"))
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.JSONEq(t, tt.expectedBody, string(b))
+		})
+	}
+}
+
+func TestTagsHandlerPeers(t *testing.T) {
+	t.Parallel()
+
+	peerSvr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !isPeerRequest(req) || req.URL.Query().Get("ns") != "docker.io" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		//nolint:errcheck // ignore
+		rw.Write([]byte(`{"name":"library/nginx","tags":["1.26","1.25"]}`))
+	}))
+	t.Cleanup(func() {
+		peerSvr.Close()
+	})
+
+	img, err := oci.Parse("docker.io/library/nginx:1.25@sha256:b060fffe8e1561c9c3e6dea6db487b900100fc26830b9ea2ec966c151ab4c020", "")
+	require.NoError(t, err)
+	resolver := map[string][]netip.AddrPort{
+		oci.RepositoryKey("docker.io", "library/nginx"): {netip.MustParseAddrPort(peerSvr.Listener.Addr().String())},
+	}
+	reg := NewRegistry(oci.NewMockClient([]oci.Image{img}), routing.NewMemoryRouter(resolver, netip.AddrPort{}), WithPeerTags(true))
+	m, err := mux.NewServeMux(reg.handle)
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/v2/library/nginx/tags/list?ns=docker.io", nil)
+	m.ServeHTTP(rw, req)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"library/nginx","tags":["1.25","1.26"]}`, string(b))
+
+	// Requests from peers only list local tags.
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/v2/library/nginx/tags/list?ns=docker.io", nil)
+	req.Header.Set(ViaHeaderKey, "peer")
+	m.ServeHTTP(rw, req)
+	resp = rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	b, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"library/nginx","tags":["1.25"]}`, string(b))
+}
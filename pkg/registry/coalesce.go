@@ -0,0 +1,275 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/spegel-org/spegel/internal/mux"
+)
+
+var _ mux.ResponseWriter = &flight{}
+
+type flightKey struct {
+	dgst     digest.Digest
+	external bool
+}
+
+// canCoalesce returns true if the request can share its response with concurrent identical requests.
+func (r *Registry) canCoalesce(req *http.Request, ref reference) bool {
+	if !r.coalesceRequests {
+		return false
+	}
+	if ref.kind != referenceKindBlob || ref.dgst == "" {
+		return false
+	}
+	if req.Method != http.MethodGet {
+		return false
+	}
+	return req.Header.Get("Range") == ""
+}
+
+// mirrorCoalesced mirrors the request once for all concurrent requests of the same blob.
+// The first request starts the mirror request which is written to a temporary file, while all
+// requests including the first one read the response from the file as it is being written.
+// Requests joining late receive the bytes already received before waiting for the rest.
+// The mirror request is cancelled when all requests waiting for it have been closed.
+func (r *Registry) mirrorCoalesced(rw mux.ResponseWriter, req *http.Request, ref reference, isExternal bool, log logr.Logger) bool {
+	key := flightKey{dgst: ref.dgst, external: isExternal}
+
+	r.flightsMx.Lock()
+	f, ok := r.flights[key]
+	if ok {
+		log.V(4).Info("coalescing mirror request with request in flight")
+	} else {
+		var err error
+		f, err = newFlight()
+		if err != nil {
+			r.flightsMx.Unlock()
+			log.Error(err, "could not coalesce mirror request")
+			return r.mirror(rw, req, ref, isExternal, log)
+		}
+		r.flights[key] = f
+		ctx, cancel := context.WithCancel(context.WithoutCancel(req.Context()))
+		f.cancel = cancel
+		go r.runFlight(key, f, req.Clone(ctx), ref, isExternal, log)
+	}
+	f.mx.Lock()
+	f.readers++
+	f.mx.Unlock()
+	r.flightsMx.Unlock()
+
+	defer r.leaveFlight(key, f)
+	return f.serve(rw, req)
+}
+
+// runFlight runs the mirror request which the flight shares with all waiting requests.
+func (r *Registry) runFlight(key flightKey, f *flight, req *http.Request, ref reference, isExternal bool, log logr.Logger) {
+	pulledThrough := false
+	aborted := true
+	defer func() {
+		// Aborting a response is done by panicking which has to be recovered as the goroutine is not owned by the server.
+		if p := recover(); p != nil && p != http.ErrAbortHandler {
+			log.Error(fmt.Errorf("%v", p), "coalesced mirror request panicked")
+		}
+		r.flightsMx.Lock()
+		if r.flights[key] == f {
+			delete(r.flights, key)
+		}
+		r.flightsMx.Unlock()
+		f.finish(pulledThrough, aborted)
+	}()
+	pulledThrough = r.mirror(f, req, ref, isExternal, log)
+	aborted = false
+}
+
+// leaveFlight removes a waiting request from the flight, cancelling the flight if it was the last one.
+func (r *Registry) leaveFlight(key flightKey, f *flight) {
+	r.flightsMx.Lock()
+	defer r.flightsMx.Unlock()
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	f.readers--
+	if f.readers > 0 {
+		return
+	}
+	if r.flights[key] == f {
+		delete(r.flights, key)
+	}
+	f.cancel()
+	if f.done {
+		f.file.Close()
+	}
+}
+
+// flight is a mirror request whose response is written to a file so that it can be read by multiple requests.
+type flight struct {
+	err           error
+	header        http.Header
+	sentHeader    http.Header
+	file          *os.File
+	cond          *sync.Cond
+	cancel        context.CancelFunc
+	status        int
+	size          int64
+	readers       int
+	mx            sync.Mutex
+	wroteHeader   bool
+	done          bool
+	aborted       bool
+	pulledThrough bool
+}
+
+func newFlight() (*flight, error) {
+	file, err := os.CreateTemp("", "spegel-mirror-*")
+	if err != nil {
+		return nil, err
+	}
+	// The file is removed straight away so that it is cleaned up when closed, even if the process is killed.
+	err = os.Remove(file.Name())
+	if err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+	f := &flight{
+		header: http.Header{},
+		file:   file,
+	}
+	f.cond = sync.NewCond(&f.mx)
+	return f, nil
+}
+
+func (f *flight) Header() http.Header {
+	return f.header
+}
+
+func (f *flight) WriteHeader(statusCode int) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if f.wroteHeader {
+		return
+	}
+	f.wroteHeader = true
+	f.status = statusCode
+	f.sentHeader = f.header.Clone()
+	f.cond.Broadcast()
+}
+
+func (f *flight) Write(b []byte) (int, error) {
+	f.WriteHeader(http.StatusOK)
+	n, err := f.file.Write(b)
+	f.mx.Lock()
+	f.size += int64(n)
+	f.cond.Broadcast()
+	f.mx.Unlock()
+	return n, err
+}
+
+func (f *flight) WriteError(statusCode int, err error) {
+	f.mx.Lock()
+	f.err = err
+	f.mx.Unlock()
+	f.WriteHeader(statusCode)
+}
+
+func (f *flight) Error() error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.err
+}
+
+func (f *flight) Status() int {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if f.status == 0 {
+		return http.StatusOK
+	}
+	return f.status
+}
+
+func (f *flight) Size() int64 {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.size
+}
+
+// finish marks the flight as done, waking up all waiting requests.
+func (f *flight) finish(pulledThrough, aborted bool) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.done = true
+	f.pulledThrough = pulledThrough
+	f.aborted = aborted
+	f.cond.Broadcast()
+	if f.readers == 0 {
+		f.file.Close()
+	}
+}
+
+// serve writes the response of the flight to the response writer as it is received.
+func (f *flight) serve(rw mux.ResponseWriter, req *http.Request) bool {
+	ctx := req.Context()
+	stop := context.AfterFunc(ctx, func() {
+		f.mx.Lock()
+		defer f.mx.Unlock()
+		f.cond.Broadcast()
+	})
+	defer stop()
+
+	f.mx.Lock()
+	for !f.wroteHeader && !f.done && ctx.Err() == nil {
+		f.cond.Wait()
+	}
+	wroteHeader, aborted, status, header, err := f.wroteHeader, f.aborted, f.status, f.sentHeader, f.err
+	f.mx.Unlock()
+	if ctx.Err() != nil {
+		rw.WriteError(http.StatusNotFound, fmt.Errorf("coalesced mirror request has been cancelled: %w", ctx.Err()))
+		return false
+	}
+	if !wroteHeader {
+		if aborted {
+			panic(http.ErrAbortHandler)
+		}
+		rw.WriteError(http.StatusInternalServerError, errors.New("coalesced mirror request did not write a response"))
+		return false
+	}
+	for k, v := range header {
+		rw.Header()[k] = v
+	}
+	if err != nil {
+		rw.WriteError(status, err)
+		return false
+	}
+	rw.WriteHeader(status)
+
+	var offset int64
+	for {
+		f.mx.Lock()
+		for offset == f.size && !f.done && ctx.Err() == nil {
+			f.cond.Wait()
+		}
+		size, done, aborted, pulledThrough := f.size, f.done, f.aborted, f.pulledThrough
+		f.mx.Unlock()
+		if ctx.Err() != nil {
+			return pulledThrough
+		}
+		if offset == size && done {
+			if aborted {
+				panic(http.ErrAbortHandler)
+			}
+			return pulledThrough
+		}
+		n, err := io.Copy(rw, io.NewSectionReader(f.file, offset, size-offset))
+		offset += n
+		if err != nil {
+			return pulledThrough
+		}
+	}
+}
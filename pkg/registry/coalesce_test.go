@@ -0,0 +1,108 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spegel-org/spegel/internal/mux"
+	"github.com/spegel-org/spegel/pkg/routing"
+)
+
+func TestMirrorCoalesced(t *testing.T) {
+	t.Parallel()
+
+	blob := []byte("hello world")
+	dgst := digest.FromBytes(blob)
+	release := make(chan struct{})
+	peerRequests := &atomic.Int64{}
+	peerSvr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		peerRequests.Add(1)
+		rw.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		rw.Header().Set("Docker-Content-Digest", dgst.String())
+		//nolint:errcheck // ignore
+		rw.Write(blob[:5])
+		//nolint:errcheck // ignore
+		http.NewResponseController(rw).Flush()
+		<-release
+		//nolint:errcheck // ignore
+		rw.Write(blob[5:])
+	}))
+	t.Cleanup(func() {
+		peerSvr.Close()
+	})
+
+	resolver := map[string][]netip.AddrPort{
+		dgst.String(): {netip.MustParseAddrPort(peerSvr.Listener.Addr().String())},
+	}
+	reg := NewRegistry(nil, routing.NewMemoryRouter(resolver, netip.AddrPort{}), WithCoalesceRequests(true))
+	m, err := mux.NewServeMux(reg.handle)
+	require.NoError(t, err)
+	svr := httptest.NewServer(m)
+	t.Cleanup(func() {
+		svr.Close()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	count := 5
+	bodies := make([][]byte, count)
+	errs := make([]error, count)
+	wg := sync.WaitGroup{}
+	for i := range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v2/foo/bar/blobs/%s", svr.URL, dgst.String()), nil)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				errs[i] = fmt.Errorf("unexpected status %s", resp.Status)
+				return
+			}
+			bodies[i], errs[i] = io.ReadAll(resp.Body)
+		}()
+		// Wait for the request to join the flight before sending the next one.
+		require.Eventually(t, func() bool {
+			reg.flightsMx.Lock()
+			defer reg.flightsMx.Unlock()
+			f, ok := reg.flights[flightKey{dgst: dgst, external: true}]
+			if !ok {
+				return false
+			}
+			f.mx.Lock()
+			defer f.mx.Unlock()
+			return f.readers == i+1
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int64(1), peerRequests.Load())
+	for i := range count {
+		require.NoError(t, errs[i])
+		require.Equal(t, blob, bodies[i])
+	}
+	reg.flightsMx.Lock()
+	defer reg.flightsMx.Unlock()
+	require.Empty(t, reg.flights)
+}
@@ -7,13 +7,19 @@ import (
 	"strings"
 
 	"github.com/opencontainers/go-digest"
+
+	"github.com/spegel-org/spegel/internal/mux"
+	"github.com/spegel-org/spegel/pkg/oci"
 )
 
 type referenceKind string
 
 const (
-	referenceKindManifest = "Manifest"
-	referenceKindBlob     = "Blob"
+	referenceKindManifest  = "Manifest"
+	referenceKindBlob      = "Blob"
+	referenceKindReferrers = "Referrers"
+	referenceKindTags      = "Tags"
+	referenceKindCatalog   = "Catalog"
 )
 
 type reference struct {
@@ -23,6 +29,17 @@ type reference struct {
 	originalRegistry string
 }
 
+// key returns the key used to resolve peers for the reference.
+func (r reference) key() string {
+	if r.kind == referenceKindReferrers {
+		return oci.ReferrersKey(r.dgst)
+	}
+	if r.dgst != "" {
+		return r.dgst.String()
+	}
+	return r.name
+}
+
 func (r reference) hasLatestTag() bool {
 	if r.name == "" {
 		return false
@@ -35,6 +52,9 @@ func (r reference) hasLatestTag() bool {
 // https://github.com/opencontainers/distribution-spec/blob/main/spec.md
 // /v2/<name>/manifests/<reference>
 // /v2/<name>/blobs/<reference>
+// /v2/<name>/referrers/<digest>
+// /v2/<name>/tags/list
+// /v2/_catalog
 
 var (
 	nameRegex           = regexp.MustCompile(`([a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*)`)
@@ -42,13 +62,16 @@ var (
 	manifestRegexTag    = regexp.MustCompile(`/v2/` + nameRegex.String() + `/manifests/` + tagRegex.String() + `$`)
 	manifestRegexDigest = regexp.MustCompile(`/v2/` + nameRegex.String() + `/manifests/(.*)`)
 	blobsRegexDigest    = regexp.MustCompile(`/v2/` + nameRegex.String() + `/blobs/(.*)`)
+	referrersRegex      = regexp.MustCompile(`/v2/` + nameRegex.String() + `/referrers/(.*)`)
+	tagsListRegex       = regexp.MustCompile(`/v2/` + nameRegex.String() + `/tags/list$`)
+	catalogRegex        = regexp.MustCompile(`^/v2/_catalog$`)
 )
 
 func parsePathComponents(originalRegistry, path string) (reference, error) {
 	comps := manifestRegexTag.FindStringSubmatch(path)
 	if len(comps) == 6 {
 		if originalRegistry == "" {
-			return reference{}, errors.New("registry parameter needs to be set for tag references")
+			return reference{}, mux.WithCode(mux.ErrorCodeNameInvalid, errors.New("registry parameter needs to be set for tag references"))
 		}
 		name := fmt.Sprintf("%s/%s:%s", originalRegistry, comps[1], comps[5])
 		ref := reference{
@@ -76,5 +99,41 @@ func parsePathComponents(originalRegistry, path string) (reference, error) {
 		}
 		return ref, nil
 	}
-	return reference{}, errors.New("distribution path could not be parsed")
+	comps = referrersRegex.FindStringSubmatch(path)
+	if len(comps) == 6 {
+		dgst, err := digest.Parse(comps[5])
+		if err != nil {
+			return reference{}, mux.WithCode(mux.ErrorCodeDigestInvalid, fmt.Errorf("invalid referrers subject: %w", err))
+		}
+		ref := reference{
+			kind:             referenceKindReferrers,
+			dgst:             dgst,
+			originalRegistry: originalRegistry,
+		}
+		return ref, nil
+	}
+	comps = tagsListRegex.FindStringSubmatch(path)
+	if len(comps) == 5 {
+		// Without a registry parameter the name has to include the registry.
+		name := comps[1]
+		if originalRegistry != "" {
+			name = fmt.Sprintf("%s/%s", originalRegistry, comps[1])
+		} else if !strings.Contains(name, "/") {
+			return reference{}, mux.WithCode(mux.ErrorCodeNameInvalid, errors.New("registry parameter needs to be set or name needs to include the registry when listing tags"))
+		}
+		ref := reference{
+			kind:             referenceKindTags,
+			name:             name,
+			originalRegistry: originalRegistry,
+		}
+		return ref, nil
+	}
+	if catalogRegex.MatchString(path) {
+		ref := reference{
+			kind:             referenceKindCatalog,
+			originalRegistry: originalRegistry,
+		}
+		return ref, nil
+	}
+	return reference{}, mux.WithCode(mux.ErrorCodeUnsupported, errors.New("distribution path could not be parsed"))
 }
@@ -34,6 +34,38 @@ func TestParsePathComponents(t *testing.T) {
 			expectedDgst:    digest.Digest("sha256:295c7be079025306c4f1d65997fcf7adb411c88f139ad1d34b537164aa060369"),
 			expectedRefKind: referenceKindBlob,
 		},
+		{
+			name:            "valid referrers digest",
+			registry:        "docker.io",
+			path:            "/v2/library/nginx/referrers/sha256:295c7be079025306c4f1d65997fcf7adb411c88f139ad1d34b537164aa060369",
+			expectedName:    "",
+			expectedDgst:    digest.Digest("sha256:295c7be079025306c4f1d65997fcf7adb411c88f139ad1d34b537164aa060369"),
+			expectedRefKind: referenceKindReferrers,
+		},
+		{
+			name:            "valid tags list",
+			registry:        "docker.io",
+			path:            "/v2/library/nginx/tags/list",
+			expectedName:    "docker.io/library/nginx",
+			expectedDgst:    "",
+			expectedRefKind: referenceKindTags,
+		},
+		{
+			name:            "valid tags list without registry",
+			registry:        "",
+			path:            "/v2/docker.io/library/nginx/tags/list",
+			expectedName:    "docker.io/library/nginx",
+			expectedDgst:    "",
+			expectedRefKind: referenceKindTags,
+		},
+		{
+			name:            "valid catalog",
+			registry:        "",
+			path:            "/v2/_catalog",
+			expectedName:    "",
+			expectedDgst:    "",
+			expectedRefKind: referenceKindCatalog,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -61,3 +93,17 @@ func TestParsePathComponentsMissingRegistry(t *testing.T) {
 	_, err := parsePathComponents("", "/v2/spegel-org/spegel/manifests/v0.0.1")
 	require.EqualError(t, err, "registry parameter needs to be set for tag references")
 }
+
+func TestParsePathComponentsInvalidReferrersDigest(t *testing.T) {
+	t.Parallel()
+
+	_, err := parsePathComponents("example.com", "/v2/spegel-org/spegel/referrers/v0.0.1")
+	require.EqualError(t, err, "invalid referrers subject: invalid checksum digest format")
+}
+
+func TestParsePathComponentsTagsMissingRegistry(t *testing.T) {
+	t.Parallel()
+
+	_, err := parsePathComponents("", "/v2/nginx/tags/list")
+	require.EqualError(t, err, "registry parameter needs to be set or name needs to include the registry when listing tags")
+}
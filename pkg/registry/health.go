@@ -0,0 +1,337 @@
+package registry
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/spegel-org/spegel/pkg/metrics"
+)
+
+const (
+	// circuitFailureThreshold is the amount of consecutive failures which opens the circuit of a peer.
+	circuitFailureThreshold = 3
+	// circuitOpenDuration is how long a peer is skipped before a probe request is allowed.
+	circuitOpenDuration = 30 * time.Second
+	// peerHealthExpiration is how long the health of a peer is kept after it was last used.
+	peerHealthExpiration = 10 * time.Minute
+	// healthSmoothing is the weight of new samples in the moving averages of a peer.
+	healthSmoothing = 0.3
+	// minThroughputBytes is the least amount of bytes a response needs to measure throughput.
+	minThroughputBytes = 64 * 1024
+	// scoreSize is the content size used to weigh latency against throughput when ordering peers.
+	scoreSize = 1024 * 1024
+)
+
+type circuitState string
+
+const (
+	circuitClosed   circuitState = "closed"
+	circuitOpen     circuitState = "open"
+	circuitHalfOpen circuitState = "half-open"
+)
+
+// peerStats is the health of a single peer.
+type peerStats struct {
+	openedAt            time.Time
+	probedAt            time.Time
+	lastSeen            time.Time
+	state               circuitState
+	successRate         float64
+	latency             float64
+	throughput          float64
+	consecutiveFailures int
+}
+
+// expectedSeconds is the expected duration to receive content from the peer.
+func (s *peerStats) expectedSeconds() float64 {
+	if s.throughput == 0 {
+		return s.latency
+	}
+	return s.latency + scoreSize/s.throughput
+}
+
+// peerHealth tracks the health of peers across mirror requests. Peers which keep failing
+// have their circuit opened and are skipped, until a single probe request is allowed after
+// a while. Resolved peers are ordered so that healthy and fast peers are tried first.
+type peerHealth struct {
+	peers map[netip.AddrPort]*peerStats
+	mx    sync.Mutex
+}
+
+func newPeerHealth() *peerHealth {
+	return &peerHealth{
+		peers: map[netip.AddrPort]*peerStats{},
+	}
+}
+
+// stats returns the stats of the peer, creating them if the peer is unknown. Must be called with the lock held.
+func (h *peerHealth) stats(peer netip.AddrPort) *peerStats {
+	now := time.Now()
+	for p, s := range h.peers {
+		if now.Sub(s.lastSeen) > peerHealthExpiration {
+			delete(h.peers, p)
+			metrics.PeerHealthScore.DeleteLabelValues(p.String())
+		}
+	}
+	s, ok := h.peers[peer]
+	if !ok {
+		s = &peerStats{
+			state:       circuitClosed,
+			successRate: 1,
+		}
+		h.peers[peer] = s
+	}
+	s.lastSeen = now
+	return s
+}
+
+// allow returns true if a request should be sent to the peer. Peers with an open circuit are
+// allowed a single probe request once the circuit has been open long enough. Probes which end
+// without a result, for example when cancelled, are retried after the same duration.
+func (h *peerHealth) allow(peer netip.AddrPort) bool {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	s := h.stats(peer)
+	switch s.state {
+	case circuitOpen:
+		if time.Since(s.openedAt) < circuitOpenDuration {
+			return false
+		}
+		s.state = circuitHalfOpen
+		s.probedAt = time.Now()
+		return true
+	case circuitHalfOpen:
+		if time.Since(s.probedAt) < circuitOpenDuration {
+			return false
+		}
+		s.probedAt = time.Now()
+		return true
+	default:
+		return true
+	}
+}
+
+// isOpen returns true if requests to the peer are not allowed, without using the probe request.
+func (h *peerHealth) isOpen(peer netip.AddrPort) bool {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	s, ok := h.peers[peer]
+	if !ok {
+		return false
+	}
+	switch s.state {
+	case circuitOpen:
+		return time.Since(s.openedAt) < circuitOpenDuration
+	case circuitHalfOpen:
+		return time.Since(s.probedAt) < circuitOpenDuration
+	default:
+		return false
+	}
+}
+
+func (h *peerHealth) healthy(peer netip.AddrPort) bool {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	s, ok := h.peers[peer]
+	if !ok {
+		return true
+	}
+	return s.state == circuitClosed && s.consecutiveFailures == 0
+}
+
+// recordSuccess records that the peer responded successfully with the latency until the response headers.
+func (h *peerHealth) recordSuccess(peer netip.AddrPort, latency time.Duration) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	s := h.stats(peer)
+	s.state = circuitClosed
+	s.consecutiveFailures = 0
+	s.successRate = smooth(s.successRate, 1)
+	if s.latency == 0 {
+		s.latency = latency.Seconds()
+	} else {
+		s.latency = smooth(s.latency, latency.Seconds())
+	}
+	metrics.PeerHealthScore.WithLabelValues(peer.String()).Set(s.successRate)
+}
+
+// recordFailure records that the request to the peer failed, opening the circuit if the peer keeps failing.
+func (h *peerHealth) recordFailure(peer netip.AddrPort) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	s := h.stats(peer)
+	s.consecutiveFailures++
+	s.successRate = smooth(s.successRate, 0)
+	if s.state == circuitHalfOpen || s.consecutiveFailures >= circuitFailureThreshold {
+		if s.state != circuitOpen {
+			metrics.PeerCircuitOpenedTotal.Inc()
+		}
+		s.state = circuitOpen
+		s.openedAt = time.Now()
+	}
+	metrics.PeerHealthScore.WithLabelValues(peer.String()).Set(s.successRate)
+}
+
+// recordThroughput records the amount of bytes received from the peer during the duration.
+func (h *peerHealth) recordThroughput(peer netip.AddrPort, n int64, d time.Duration) {
+	if n < minThroughputBytes || d <= 0 {
+		return
+	}
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	s := h.stats(peer)
+	throughput := float64(n) / d.Seconds()
+	if s.throughput == 0 {
+		s.throughput = throughput
+		return
+	}
+	s.throughput = smooth(s.throughput, throughput)
+}
+
+// order sorts the peers with healthy and fast peers first.
+func (h *peerHealth) order(peers []netip.AddrPort) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	unknown := &peerStats{state: circuitClosed, successRate: 1}
+	rank := map[circuitState]int{circuitClosed: 0, circuitHalfOpen: 1, circuitOpen: 2}
+	slices.SortStableFunc(peers, func(a, b netip.AddrPort) int {
+		aStats, ok := h.peers[a]
+		if !ok {
+			aStats = unknown
+		}
+		bStats, ok := h.peers[b]
+		if !ok {
+			bStats = unknown
+		}
+		return cmp.Or(
+			cmp.Compare(rank[aStats.state], rank[bStats.state]),
+			cmp.Compare(bStats.successRate, aStats.successRate),
+			cmp.Compare(aStats.expectedSeconds(), bStats.expectedSeconds()),
+		)
+	})
+}
+
+// orderPeers returns a channel which returns resolved peers ordered by health. Peers are only
+// waited for while none of the peers resolved so far is healthy, otherwise only the peers which
+// have already been resolved are reordered.
+func (h *peerHealth) orderPeers(ctx, resolveCtx context.Context, peerCh <-chan netip.AddrPort, count int) <-chan netip.AddrPort {
+	peers := []netip.AddrPort{}
+	for count <= 0 || len(peers) < count {
+		if slices.ContainsFunc(peers, h.healthy) {
+			peer, ok := tryReceive(peerCh)
+			if !ok {
+				break
+			}
+			peers = append(peers, peer)
+			continue
+		}
+		peer, ok := receive(resolveCtx, peerCh)
+		if !ok {
+			break
+		}
+		peers = append(peers, peer)
+	}
+	h.order(peers)
+	return prependPeers(ctx, peers, peerCh)
+}
+
+func tryReceive(peerCh <-chan netip.AddrPort) (netip.AddrPort, bool) {
+	select {
+	case peer, ok := <-peerCh:
+		return peer, ok
+	default:
+		return netip.AddrPort{}, false
+	}
+}
+
+func receive(ctx context.Context, peerCh <-chan netip.AddrPort) (netip.AddrPort, bool) {
+	select {
+	case <-ctx.Done():
+		return netip.AddrPort{}, false
+	case peer, ok := <-peerCh:
+		return peer, ok
+	}
+}
+
+type peerHealthStatus struct {
+	LastSeen            time.Time `json:"lastSeen"`
+	Peer                string    `json:"peer"`
+	State               string    `json:"state"`
+	Score               float64   `json:"score"`
+	LatencySeconds      float64   `json:"latencySeconds"`
+	ThroughputBytes     float64   `json:"throughputBytesPerSecond"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+}
+
+// statuses returns the health of all known peers, ordered in the same way as resolved peers.
+func (h *peerHealth) statuses() []peerHealthStatus {
+	h.mx.Lock()
+	peers := make([]netip.AddrPort, 0, len(h.peers))
+	for peer := range h.peers {
+		peers = append(peers, peer)
+	}
+	h.mx.Unlock()
+	h.order(peers)
+
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	statuses := []peerHealthStatus{}
+	for _, peer := range peers {
+		s, ok := h.peers[peer]
+		if !ok {
+			continue
+		}
+		statuses = append(statuses, peerHealthStatus{
+			Peer:                peer.String(),
+			State:               string(s.state),
+			Score:               s.successRate,
+			LatencySeconds:      s.latency,
+			ThroughputBytes:     s.throughput,
+			ConsecutiveFailures: s.consecutiveFailures,
+			LastSeen:            s.lastSeen,
+		})
+	}
+	return statuses
+}
+
+func smooth(current, sample float64) float64 {
+	return (1-healthSmoothing)*current + healthSmoothing*sample
+}
+
+// measuredBody records the throughput of a peer response body once it has been read,
+// and records a failure if the peer fails while the body is being read.
+type measuredBody struct {
+	start  time.Time
+	rc     io.ReadCloser
+	health *peerHealth
+	peer   netip.AddrPort
+	n      int64
+	done   bool
+}
+
+func (m *measuredBody) Read(p []byte) (int, error) {
+	n, err := m.rc.Read(p)
+	m.n += int64(n)
+	if err != nil && !m.done {
+		m.done = true
+		switch {
+		case errors.Is(err, io.EOF):
+			m.health.recordThroughput(m.peer, m.n, time.Since(m.start))
+		// Failures are already recorded when resuming from another peer fails.
+		case errors.Is(err, context.Canceled), errors.Is(err, errResumeFailed):
+		default:
+			m.health.recordFailure(m.peer)
+		}
+	}
+	return n, err
+}
+
+func (m *measuredBody) Close() error {
+	return m.rc.Close()
+}
@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerHealthCircuit(t *testing.T) {
+	t.Parallel()
+
+	h := newPeerHealth()
+	peer := netip.MustParseAddrPort("10.0.0.1:5000")
+
+	for range circuitFailureThreshold - 1 {
+		require.True(t, h.allow(peer))
+		h.recordFailure(peer)
+	}
+	require.True(t, h.allow(peer))
+	require.False(t, h.healthy(peer))
+	h.recordFailure(peer)
+	require.False(t, h.allow(peer))
+	require.True(t, h.isOpen(peer))
+
+	// A single probe is allowed after the circuit has been open long enough.
+	h.peers[peer].openedAt = time.Now().Add(-circuitOpenDuration)
+	require.False(t, h.isOpen(peer))
+	require.True(t, h.allow(peer))
+	require.False(t, h.allow(peer))
+	require.True(t, h.isOpen(peer))
+
+	// A failed probe opens the circuit again.
+	h.recordFailure(peer)
+	require.Equal(t, circuitOpen, h.peers[peer].state)
+	require.False(t, h.allow(peer))
+
+	// A successful probe closes the circuit.
+	h.peers[peer].openedAt = time.Now().Add(-circuitOpenDuration)
+	require.True(t, h.allow(peer))
+	h.recordSuccess(peer, time.Millisecond)
+	require.True(t, h.healthy(peer))
+	require.True(t, h.allow(peer))
+	require.True(t, h.allow(peer))
+}
+
+func TestPeerHealthOrder(t *testing.T) {
+	t.Parallel()
+
+	h := newPeerHealth()
+	failing := netip.MustParseAddrPort("10.0.0.1:5000")
+	slow := netip.MustParseAddrPort("10.0.0.2:5000")
+	fast := netip.MustParseAddrPort("10.0.0.3:5000")
+	unknown := netip.MustParseAddrPort("10.0.0.4:5000")
+	open := netip.MustParseAddrPort("10.0.0.5:5000")
+	h.recordSuccess(failing, time.Millisecond)
+	h.recordFailure(failing)
+	h.recordSuccess(slow, 100*time.Millisecond)
+	h.recordThroughput(slow, 1024*1024, time.Second)
+	h.recordSuccess(fast, time.Millisecond)
+	h.recordThroughput(fast, 1024*1024, 10*time.Millisecond)
+	for range circuitFailureThreshold {
+		h.recordFailure(open)
+	}
+
+	peerCh := make(chan netip.AddrPort, 5)
+	for _, peer := range []netip.AddrPort{open, failing, slow, unknown, fast} {
+		peerCh <- peer
+	}
+	close(peerCh)
+	ordered := []netip.AddrPort{}
+	for peer := range h.orderPeers(context.Background(), context.Background(), peerCh, 5) {
+		ordered = append(ordered, peer)
+	}
+	require.Equal(t, []netip.AddrPort{unknown, fast, slow, failing, open}, ordered)
+
+	statuses := h.statuses()
+	require.Len(t, statuses, 4)
+	require.Equal(t, fast.String(), statuses[0].Peer)
+	require.Equal(t, string(circuitOpen), statuses[3].State)
+}
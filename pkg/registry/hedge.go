@@ -0,0 +1,142 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/spegel-org/spegel/pkg/metrics"
+)
+
+var _ http.RoundTripper = &hedgedRoundTripper{}
+
+// hedgedRoundTripper sends the request to the next peer if the first peer has not responded
+// with headers within the delay. The response of whichever peer responds first is used and
+// the other request is cancelled. Hedging is disabled when the delay is zero.
+type hedgedRoundTripper struct {
+	rt        http.RoundTripper
+	next      func() (netip.AddrPort, bool)
+	onFailure func(netip.AddrPort)
+	start     time.Time
+	// peer is the peer which the returned response is from.
+	peer netip.AddrPort
+	// unused are the peers whose requests were cancelled before they responded, they can be tried again.
+	unused []netip.AddrPort
+	delay  time.Duration
+}
+
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	cancel context.CancelFunc
+	start  time.Time
+	peer   netip.AddrPort
+}
+
+func (h *hedgedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	h.start = time.Now()
+	if h.delay <= 0 {
+		return h.rt.RoundTrip(req)
+	}
+
+	resultCh := make(chan hedgeResult, 2)
+	pending := map[netip.AddrPort]context.CancelFunc{}
+	send := func(req *http.Request, peer netip.AddrPort) {
+		ctx, cancel := context.WithCancel(req.Context())
+		pending[peer] = cancel
+		go func() {
+			start := time.Now()
+			resp, err := h.rt.RoundTrip(req.WithContext(ctx)) //nolint:bodyclose // Body is closed by the caller or when discarded.
+			resultCh <- hedgeResult{resp: resp, err: err, cancel: cancel, start: start, peer: peer}
+		}()
+	}
+	send(req, h.peer)
+
+	timer := time.NewTimer(h.delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			peer, ok := h.next()
+			if !ok {
+				continue
+			}
+			metrics.MirrorHedgedRequestsTotal.Inc()
+			hedgeReq := req.Clone(req.Context())
+			hedgeReq.URL.Host = peer.String()
+			send(hedgeReq, peer)
+		case res := <-resultCh:
+			delete(pending, res.peer)
+			// Failed responses are only used when there are no other requests which could succeed.
+			if len(pending) > 0 && !isSuccessResponse(res) {
+				h.recordFailure(req, res)
+				discardResult(res)
+				continue
+			}
+			// Requests which have not responded yet are cancelled and their peers can be tried again.
+			for peer, cancel := range pending {
+				cancel()
+				h.unused = append(h.unused, peer)
+				go func() {
+					discardResult(<-resultCh)
+				}()
+			}
+			if res.peer != h.peer {
+				metrics.MirrorHedgeWinsTotal.Inc()
+			}
+			h.peer = res.peer
+			h.start = res.start
+			if res.err != nil {
+				res.cancel()
+				return nil, res.err
+			}
+			res.resp.Body = &cancelBody{ReadCloser: res.resp.Body, cancel: res.cancel}
+			return res.resp, nil
+		}
+	}
+}
+
+// recordFailure records the failure of a request whose response is not used. Busy peers and
+// requests cancelled by the client are not failures.
+func (h *hedgedRoundTripper) recordFailure(req *http.Request, res hedgeResult) {
+	if h.onFailure == nil || req.Context().Err() != nil {
+		return
+	}
+	if res.err == nil && (isBusyResponse(res.resp) || res.resp.StatusCode == http.StatusLoopDetected) {
+		return
+	}
+	h.onFailure(res.peer)
+}
+
+func isSuccessResponse(res hedgeResult) bool {
+	if res.err != nil {
+		return false
+	}
+	switch res.resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		return true
+	default:
+		return false
+	}
+}
+
+// discardResult cancels the request and closes the response of a request which was not used.
+func discardResult(res hedgeResult) {
+	res.cancel()
+	if res.resp != nil {
+		res.resp.Body.Close()
+	}
+}
+
+// cancelBody cancels the context of the request when the response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelBody) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
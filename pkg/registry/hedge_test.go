@@ -0,0 +1,185 @@
+package registry
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/spegel-org/spegel/internal/mux"
+	"github.com/spegel-org/spegel/pkg/oci"
+	"github.com/spegel-org/spegel/pkg/routing"
+)
+
+func TestMirrorHandlerHedge(t *testing.T) {
+	t.Parallel()
+
+	ociClient := oci.NewMockClient(nil)
+	dgst := ociClient.AddBlob([]byte("hello world"))
+	slowSvr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(func() {
+		slowSvr.Close()
+	})
+	peerReg := NewRegistry(ociClient, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}))
+	peerMux, err := mux.NewServeMux(peerReg.handle)
+	require.NoError(t, err)
+	peerSvr := httptest.NewServer(peerMux)
+	t.Cleanup(func() {
+		peerSvr.Close()
+	})
+
+	tests := []struct {
+		name         string
+		hedgeDelay   time.Duration
+		expectedFast bool
+	}{
+		{
+			name:         "hedged request to next peer is used",
+			hedgeDelay:   50 * time.Millisecond,
+			expectedFast: true,
+		},
+		{
+			name:         "hedging disabled waits for first peer",
+			hedgeDelay:   0,
+			expectedFast: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resolver := map[string][]netip.AddrPort{
+				dgst.String(): {
+					netip.MustParseAddrPort(slowSvr.Listener.Addr().String()),
+					netip.MustParseAddrPort(peerSvr.Listener.Addr().String()),
+				},
+			}
+			reg := NewRegistry(nil, routing.NewMemoryRouter(resolver, netip.AddrPort{}), WithHedgeDelay(tt.hedgeDelay), WithResolveTimeout(10*time.Second))
+			m, err := mux.NewServeMux(reg.handle)
+			require.NoError(t, err)
+
+			start := time.Now()
+			target := fmt.Sprintf("http://example.com/v2/foo/bar/blobs/%s", dgst.String())
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			m.ServeHTTP(rw, req)
+			resp := rw.Result()
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "hello world", string(b))
+			require.Equal(t, tt.expectedFast, time.Since(start) < time.Second)
+		})
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestHedgedRoundTripper(t *testing.T) {
+	t.Parallel()
+
+	first := netip.MustParseAddrPort("10.0.0.1:5000")
+	second := netip.MustParseAddrPort("10.0.0.2:5000")
+	newResponse := func(statusCode int, retryAfter string) *http.Response {
+		resp := &http.Response{StatusCode: statusCode, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}
+		if retryAfter != "" {
+			resp.Header.Set("Retry-After", retryAfter)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		expectedPeer     netip.AddrPort
+		name             string
+		secondRetryAfter string
+		expectedUnused   []netip.AddrPort
+		expectedFailed   []netip.AddrPort
+		firstStatus      int
+		secondStatus     int
+		firstWaits       bool
+	}{
+		{
+			name:           "cancelled peer is returned as unused",
+			firstWaits:     true,
+			secondStatus:   http.StatusOK,
+			expectedPeer:   second,
+			expectedUnused: []netip.AddrPort{first},
+		},
+		{
+			name:           "failed hedge is recorded",
+			firstStatus:    http.StatusOK,
+			secondStatus:   http.StatusInternalServerError,
+			expectedPeer:   first,
+			expectedFailed: []netip.AddrPort{second},
+		},
+		{
+			name:             "busy hedge is not recorded",
+			firstStatus:      http.StatusOK,
+			secondStatus:     http.StatusServiceUnavailable,
+			secondRetryAfter: "1",
+			expectedPeer:     first,
+		},
+		{
+			name:           "unavailable hedge is recorded",
+			firstStatus:    http.StatusOK,
+			secondStatus:   http.StatusServiceUnavailable,
+			expectedPeer:   first,
+			expectedFailed: []netip.AddrPort{second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			secondDone := make(chan struct{})
+			failed := []netip.AddrPort{}
+			hedger := &hedgedRoundTripper{
+				rt: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					if req.URL.Host == second.String() {
+						defer close(secondDone)
+						return newResponse(tt.secondStatus, tt.secondRetryAfter), nil
+					}
+					if tt.firstWaits {
+						<-req.Context().Done()
+						return nil, req.Context().Err()
+					}
+					// The first peer responds after the hedge has failed.
+					<-secondDone
+					return newResponse(tt.firstStatus, ""), nil
+				}),
+				peer:  first,
+				delay: 10 * time.Millisecond,
+				next: func() (netip.AddrPort, bool) {
+					return second, true
+				},
+				onFailure: func(peer netip.AddrPort) {
+					failed = append(failed, peer)
+				},
+			}
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/v2/foo/bar/blobs/sha256:foo", first), nil)
+			resp, err := hedger.RoundTrip(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedPeer, hedger.peer)
+			require.ElementsMatch(t, tt.expectedUnused, hedger.unused)
+			require.ElementsMatch(t, tt.expectedFailed, failed)
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spegel-org/spegel/internal/mux"
+)
+
+// parallelHeaders are the headers of the peer response to the HEAD request which are passed on to the client.
+var parallelHeaders = []string{"Content-Type", "ETag"}
+
+type chunk struct {
+	index int
+	start int64
+	end   int64
+}
+
+// canMirrorParallel returns true if the request could be served by downloading chunks from multiple peers.
+// Requests that already contain a range are proxied as is to a single peer.
+func (r *Registry) canMirrorParallel(req *http.Request, ref reference) bool {
+	if r.parallelPeers < 2 {
+		return false
+	}
+	if ref.kind != referenceKindBlob || req.Method != http.MethodGet {
+		return false
+	}
+	return req.Header.Get("Range") == ""
+}
+
+// mirrorParallel downloads a blob by splitting it into byte ranges which are fetched from the peers
+// at the same time. The chunks are written to the response in order, failed chunks are fetched again
+// from another peer, and the digest is verified before the last chunk is written. An error is only returned
+// before the response has been written to, allowing the request to be proxied to a single peer instead.
+// Failures after the headers have been written abort the response as there is no way to signal the error.
+func (r *Registry) mirrorParallel(rw mux.ResponseWriter, req *http.Request, ref reference, peers []netip.AddrPort) error {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	header, size, err := r.headBlob(ctx, req, peers)
+	if err != nil {
+		return err
+	}
+	if size <= r.chunkSize {
+		return fmt.Errorf("blob size %d is not larger than chunk size %d", size, r.chunkSize)
+	}
+	chunks := []chunk{}
+	for start := int64(0); start < size; start += r.chunkSize {
+		end := min(start+r.chunkSize, size) - 1
+		chunks = append(chunks, chunk{index: len(chunks), start: start, end: end})
+	}
+
+	// Chunks are only buffered for a limited window ahead of the chunk being written, and the chunks buffered
+	// by all parallel downloads on the node are limited. The blob is proxied from a single peer when the node
+	// buffer is full, as there is no point in waiting for other downloads to complete.
+	if !r.chunkBuffer.tryAcquire() {
+		return errors.New("parallel download buffer is full")
+	}
+	buffered := &atomic.Int64{}
+	buffered.Store(1)
+	window := make(chan struct{}, 2*len(peers))
+	window <- struct{}{}
+	jobCh := make(chan chunk)
+	retryCh := make(chan chunk, len(chunks))
+	results := make([]chan []byte, len(chunks))
+	for i := range results {
+		results[i] = make(chan []byte, 1)
+	}
+	producerDone := make(chan struct{})
+	defer func() {
+		// Chunks which were never written still hold their space in the node buffer.
+		cancel()
+		<-producerDone
+		r.chunkBuffer.release(int(buffered.Load()))
+	}()
+	go func() {
+		defer close(producerDone)
+		for i, c := range chunks {
+			if i > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case window <- struct{}{}:
+				}
+				if !r.chunkBuffer.acquire(ctx) {
+					return
+				}
+				buffered.Add(1)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case jobCh <- c:
+			}
+		}
+	}()
+
+	errs := []error{}
+	var errMx sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer netip.AddrPort) {
+			defer wg.Done()
+			for {
+				var c chunk
+				// Retries have precedence as the writer is most likely waiting for them.
+				select {
+				case c = <-retryCh:
+				default:
+					select {
+					case <-ctx.Done():
+						return
+					case c = <-retryCh:
+					case c = <-jobCh:
+					}
+				}
+				b, err := r.fetchChunk(ctx, req, peer, c)
+				if err != nil {
+					// Stop using the peer and let another peer fetch the chunk.
+					retryCh <- c
+					switch {
+					case ctx.Err() != nil:
+					case errors.Is(err, errMirrorBusy):
+						r.log.V(4).Info("peer is busy, fetching chunk from another peer", "peer", peer.String(), "chunk", c.index)
+					default:
+						r.peerHealth.recordFailure(peer)
+						r.log.Error(err, "fetching chunk from peer failed", "peer", peer.String(), "chunk", c.index)
+					}
+					errMx.Lock()
+					errs = append(errs, err)
+					errMx.Unlock()
+					return
+				}
+				results[c.index] <- b
+			}
+		}(peer)
+	}
+	workersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(workersDone)
+	}()
+
+	for _, k := range parallelHeaders {
+		if v := header.Get(k); v != "" {
+			rw.Header().Set(k, v)
+		}
+	}
+	rw.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	rw.Header().Set("Docker-Content-Digest", ref.dgst.String())
+	rw.WriteHeader(http.StatusOK)
+
+	release := func() {
+		<-window
+		buffered.Add(-1)
+		r.chunkBuffer.release(1)
+	}
+	err = writeChunks(rw, req, ref, results, workersDone, release, func() error {
+		errMx.Lock()
+		defer errMx.Unlock()
+		return errors.Join(errs...)
+	})
+	if err != nil {
+		r.log.Error(err, "parallel mirror download failed after response was written", "digest", ref.dgst.String())
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+func writeChunks(w io.Writer, req *http.Request, ref reference, results []chan []byte, workersDone <-chan struct{}, release func(), workerErr func() error) error {
+	verifier := ref.dgst.Verifier()
+	for i := range results {
+		var b []byte
+		select {
+		case <-req.Context().Done():
+			return req.Context().Err()
+		case b = <-results[i]:
+		case <-workersDone:
+			// All workers may have exited after the last chunk was delivered.
+			select {
+			case b = <-results[i]:
+			default:
+				return errors.Join(errors.New("all peers failed before blob download completed"), workerErr())
+			}
+		}
+		//nolint: errcheck // Digest verifier writes never return an error.
+		verifier.Write(b)
+		if i == len(results)-1 && !verifier.Verified() {
+			return fmt.Errorf("downloaded content does not match digest %s", ref.dgst.String())
+		}
+		_, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+		release()
+	}
+	return nil
+}
+
+// chunkBuffer limits the amount of chunks buffered in memory by all parallel downloads on the node.
+// A nil buffer is unlimited.
+type chunkBuffer struct {
+	slots chan struct{}
+}
+
+func newChunkBuffer(size, chunkSize int64) *chunkBuffer {
+	if size <= 0 || chunkSize <= 0 {
+		return nil
+	}
+	return &chunkBuffer{
+		slots: make(chan struct{}, max(1, size/chunkSize)),
+	}
+}
+
+// tryAcquire returns true if space for a chunk was acquired without waiting.
+func (c *chunkBuffer) tryAcquire() bool {
+	if c == nil {
+		return true
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquire waits for space for a chunk and returns false if the context is cancelled.
+func (c *chunkBuffer) acquire(ctx context.Context) bool {
+	if c == nil {
+		return true
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *chunkBuffer) release(n int) {
+	if c == nil {
+		return
+	}
+	for range n {
+		<-c.slots
+	}
+}
+
+// headBlob returns the headers and size of the blob from the first peer to respond.
+func (r *Registry) headBlob(ctx context.Context, req *http.Request, peers []netip.AddrPort) (http.Header, int64, error) {
+	errs := []error{}
+	for _, peer := range peers {
+		headReq := peerRequest(ctx, req, peer)
+		headReq.Method = http.MethodHead
+		resp, err := r.roundTripper().RoundTrip(headReq)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			errs = append(errs, fmt.Errorf("expected mirror to respond with 200 OK but received: %s", resp.Status))
+			continue
+		}
+		if resp.ContentLength < 0 {
+			errs = append(errs, errors.New("mirror did not respond with content length"))
+			continue
+		}
+		return resp.Header, resp.ContentLength, nil
+	}
+	return nil, 0, errors.Join(errs...)
+}
+
+func (r *Registry) fetchChunk(ctx context.Context, req *http.Request, peer netip.AddrPort, c chunk) ([]byte, error) {
+	chunkReq := peerRequest(ctx, req, peer)
+	chunkReq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", c.start, c.end))
+	start := time.Now()
+	resp, err := r.roundTripper().RoundTrip(chunkReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if isBusyResponse(resp) {
+		return nil, errMirrorBusy
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("expected mirror to respond with 206 Partial Content but received: %s", resp.Status)
+	}
+	expectedRange := fmt.Sprintf("bytes %d-%d/", c.start, c.end)
+	if contentRange := resp.Header.Get("Content-Range"); !strings.HasPrefix(contentRange, expectedRange) {
+		return nil, fmt.Errorf("expected content range %s but received: %s", expectedRange, contentRange)
+	}
+	latency := time.Since(start)
+	b := make([]byte, c.end-c.start+1)
+	_, err = io.ReadFull(r.limitIngress(resp.Body), b)
+	if err != nil {
+		return nil, err
+	}
+	r.peerHealth.recordSuccess(peer, latency)
+	r.peerHealth.recordThroughput(peer, int64(len(b)), time.Since(start)-latency)
+	return b, nil
+}
+
+// collectPeers reads peers from the channel until the count is reached or the channel is closed.
+func collectPeers(ctx context.Context, peerCh <-chan netip.AddrPort, count int) []netip.AddrPort {
+	peers := []netip.AddrPort{}
+	for len(peers) < count {
+		select {
+		case <-ctx.Done():
+			return peers
+		case peer, ok := <-peerCh:
+			if !ok {
+				return peers
+			}
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// prependPeers returns a channel which first returns the given peers followed by any peers from the channel.
+func prependPeers(ctx context.Context, peers []netip.AddrPort, peerCh <-chan netip.AddrPort) <-chan netip.AddrPort {
+	ch := make(chan netip.AddrPort, len(peers))
+	for _, peer := range peers {
+		ch <- peer
+	}
+	go func() {
+		defer close(ch)
+		for peer := range peerCh {
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- peer:
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,175 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spegel-org/spegel/internal/mux"
+	"github.com/spegel-org/spegel/pkg/oci"
+	"github.com/spegel-org/spegel/pkg/routing"
+)
+
+func TestMirrorParallel(t *testing.T) {
+	t.Parallel()
+
+	blob := make([]byte, 1000)
+	_, err := rand.Read(blob)
+	require.NoError(t, err)
+	ociClient := oci.NewMockClient(nil)
+	dgst := ociClient.AddBlob(blob)
+
+	corruptBlob := bytes.Repeat([]byte("a"), len(blob))
+	newPeer := func(t *testing.T, rangeRequests *atomic.Int64, content []byte) netip.AddrPort {
+		t.Helper()
+
+		peerReg := NewRegistry(ociClient, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}))
+		peerMux, err := mux.NewServeMux(peerReg.handle)
+		require.NoError(t, err)
+		svr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("X-Peer", "foo")
+			if req.Header.Get("Range") != "" {
+				rangeRequests.Add(1)
+			}
+			if content != nil {
+				http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(content))
+				return
+			}
+			peerMux.ServeHTTP(rw, req)
+		}))
+		t.Cleanup(func() {
+			svr.Close()
+		})
+		return netip.MustParseAddrPort(svr.Listener.Addr().String())
+	}
+
+	tests := []struct {
+		name          string
+		peers         []string
+		chunkSize     int64
+		bufferSize    int64
+		fullBuffer    bool
+		expectRanges  bool
+		expectAborted bool
+	}{
+		{
+			name:         "all peers working",
+			peers:        []string{"good", "good", "good"},
+			chunkSize:    100,
+			expectRanges: true,
+		},
+		{
+			name:         "failed chunks are fetched from other peers",
+			peers:        []string{"unreachable", "good", "unreachable", "good"},
+			chunkSize:    100,
+			expectRanges: true,
+		},
+		{
+			name:         "node buffer smaller than window",
+			peers:        []string{"good", "good", "good"},
+			chunkSize:    100,
+			bufferSize:   200,
+			expectRanges: true,
+		},
+		{
+			name:         "full node buffer is proxied",
+			peers:        []string{"good", "good"},
+			chunkSize:    100,
+			bufferSize:   100,
+			fullBuffer:   true,
+			expectRanges: false,
+		},
+		{
+			name:         "blob smaller than chunk size is proxied",
+			peers:        []string{"good", "good"},
+			chunkSize:    2000,
+			expectRanges: false,
+		},
+		{
+			name:          "content not matching digest is aborted",
+			peers:         []string{"corrupt", "corrupt"},
+			chunkSize:     100,
+			expectRanges:  true,
+			expectAborted: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rangeRequests := &atomic.Int64{}
+			peers := []netip.AddrPort{}
+			for _, kind := range tt.peers {
+				switch kind {
+				case "good":
+					peers = append(peers, newPeer(t, rangeRequests, nil))
+				case "corrupt":
+					peers = append(peers, newPeer(t, rangeRequests, corruptBlob))
+				case "unreachable":
+					peers = append(peers, netip.MustParseAddrPort("127.0.0.1:0"))
+				}
+			}
+			resolver := map[string][]netip.AddrPort{
+				dgst.String(): peers,
+			}
+			reg := NewRegistry(nil, routing.NewMemoryRouter(resolver, netip.AddrPort{}), WithParallelPeers(len(peers)), WithChunkSize(tt.chunkSize), WithParallelBufferSize(tt.bufferSize))
+			if tt.fullBuffer {
+				require.True(t, reg.chunkBuffer.tryAcquire())
+			}
+			m, err := mux.NewServeMux(reg.handle)
+			require.NoError(t, err)
+			svr := httptest.NewServer(m)
+			t.Cleanup(func() {
+				svr.Close()
+			})
+
+			header, b, err := getBlob(t, svr.URL, dgst)
+			if tt.expectAborted {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, blob, b)
+			if !tt.expectRanges {
+				require.Equal(t, int64(0), rangeRequests.Load())
+				return
+			}
+			require.Equal(t, int64(10), rangeRequests.Load())
+			require.Equal(t, "application/octet-stream", header.Get("Content-Type"))
+			require.Empty(t, header.Get("X-Peer"))
+			if reg.chunkBuffer != nil {
+				require.Eventually(t, func() bool {
+					return len(reg.chunkBuffer.slots) == 0
+				}, time.Second, 10*time.Millisecond)
+			}
+		})
+	}
+}
+
+func getBlob(t *testing.T, baseURL string, dgst digest.Digest) (http.Header, []byte, error) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v2/foo/bar/blobs/%s", baseURL, dgst.String()), nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	b, err := io.ReadAll(resp.Body)
+	return resp.Header, b, err
+}
@@ -2,41 +2,81 @@ package registry
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/go-logr/logr"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"github.com/spegel-org/spegel/internal/mux"
 	"github.com/spegel-org/spegel/pkg/metrics"
 	"github.com/spegel-org/spegel/pkg/oci"
 	"github.com/spegel-org/spegel/pkg/routing"
+	"github.com/spegel-org/spegel/pkg/state"
 	"github.com/spegel-org/spegel/pkg/throttle"
 )
 
-const (
-	MirroredHeaderKey = "X-Spegel-Mirrored"
-)
+var tracer = otel.Tracer("github.com/spegel-org/spegel/pkg/registry")
 
 type Registry struct {
-	log              logr.Logger
-	throttler        *throttle.Throttler
-	ociClient        oci.Client
-	router           routing.Router
-	transport        http.RoundTripper
-	localAddr        string
-	resolveRetries   int
-	resolveTimeout   time.Duration
-	resolveLatestTag bool
+	log               logr.Logger
+	throttler         *throttle.Throttler
+	egressLimiter     *throttle.FairLimiter
+	ingressLimiter    *throttle.ReadLimiter
+	uploadLimiter     *uploadLimiter
+	ociClient         oci.Client
+	router            routing.Router
+	transport         http.RoundTripper
+	upstreamTransport http.RoundTripper
+	tlsConfig         *tls.Config
+	flights           map[flightKey]*flight
+	egressWeights     map[string]float64
+	mismatchedPeers   *mismatchedPeers
+	peerHealth        *peerHealth
+	chunkBuffer       *chunkBuffer
+	contentKeys       *state.ContentKeys
+	upstreams         []url.URL
+	localHosts        []string
+	localAddr         string
+	nodeID            string
+	peerTransport     peerTransportConfig
+	resolveRetries    int
+	maxHops           int
+	resolveTimeout    time.Duration
+	hedgeDelay        time.Duration
+	parallelPeers     int
+	chunkSize         int64
+	chunkBufferSize   int64
+	flightsMx         sync.Mutex
+	resolveLatestTag  bool
+	pullThrough       bool
+	coalesceRequests  bool
+	peerTags          bool
+	peerAuth          bool
 }
 
 type Option func(*Registry)
@@ -59,24 +99,210 @@ func WithResolveTimeout(resolveTimeout time.Duration) Option {
 	}
 }
 
+// WithHedgeDelay enables sending the request to the next peer when the first peer has not
+// responded with headers within the delay. The first response is used and the other is cancelled.
+func WithHedgeDelay(hedgeDelay time.Duration) Option {
+	return func(r *Registry) {
+		r.hedgeDelay = hedgeDelay
+	}
+}
+
 func WithTransport(transport http.RoundTripper) Option {
 	return func(r *Registry) {
 		r.transport = transport
 	}
 }
 
+// WithMaxHops sets the max amount of nodes which may mirror a request. Requests from peers for content
+// which is not available locally are mirrored again if they have been mirrored by less nodes than the max.
+func WithMaxHops(maxHops int) Option {
+	return func(r *Registry) {
+		r.maxHops = maxHops
+	}
+}
+
+// WithParallelPeers sets the amount of peers that large blobs are downloaded from at the same time.
+// Parallel downloads are disabled when set to less than two.
+func WithParallelPeers(parallelPeers int) Option {
+	return func(r *Registry) {
+		r.parallelPeers = parallelPeers
+	}
+}
+
+// WithChunkSize sets the size of the byte ranges requested from each peer during parallel downloads.
+func WithChunkSize(chunkSize int64) Option {
+	return func(r *Registry) {
+		r.chunkSize = chunkSize
+	}
+}
+
+// WithParallelBufferSize limits the total size in bytes of chunks buffered by all parallel downloads.
+// Downloads are proxied from a single peer when the buffer is full. Unlimited when zero.
+func WithParallelBufferSize(parallelBufferSize int64) Option {
+	return func(r *Registry) {
+		r.chunkBufferSize = parallelBufferSize
+	}
+}
+
+// WithPullThrough enables fetching content from the original registry when no peer can serve it.
+func WithPullThrough(pullThrough bool) Option {
+	return func(r *Registry) {
+		r.pullThrough = pullThrough
+	}
+}
+
+// WithPullThroughRegistries sets the registries which content may be pulled through from.
+func WithPullThroughRegistries(registries []url.URL) Option {
+	return func(r *Registry) {
+		r.upstreams = registries
+	}
+}
+
+// WithContentKeys keeps content which is pulled through advertised for as long as it is stored.
+func WithContentKeys(contentKeys *state.ContentKeys) Option {
+	return func(r *Registry) {
+		r.contentKeys = contentKeys
+	}
+}
+
+// WithCoalesceRequests enables sharing a single mirror request between concurrent requests for the same blob.
+func WithCoalesceRequests(coalesceRequests bool) Option {
+	return func(r *Registry) {
+		r.coalesceRequests = coalesceRequests
+	}
+}
+
+// WithPeerTags enables including tags advertised by peers when listing the tags of a repository.
+func WithPeerTags(peerTags bool) Option {
+	return func(r *Registry) {
+		r.peerTags = peerTags
+	}
+}
+
+// WithPeerTLSConfig sets the TLS config of the transport used for requests to peers.
+func WithPeerTLSConfig(tlsConfig *tls.Config) Option {
+	return func(r *Registry) {
+		r.peerTransport.tlsConfig = tlsConfig
+	}
+}
+
+// WithDialTimeout sets the max duration spent connecting to a peer.
+func WithDialTimeout(dialTimeout time.Duration) Option {
+	return func(r *Registry) {
+		r.peerTransport.dialTimeout = dialTimeout
+	}
+}
+
+// WithTLSHandshakeTimeout sets the max duration spent on the TLS handshake with a peer.
+func WithTLSHandshakeTimeout(tlsHandshakeTimeout time.Duration) Option {
+	return func(r *Registry) {
+		r.peerTransport.tlsHandshakeTimeout = tlsHandshakeTimeout
+	}
+}
+
+// WithResponseHeaderTimeout sets the max duration spent waiting for response headers from a peer.
+func WithResponseHeaderTimeout(responseHeaderTimeout time.Duration) Option {
+	return func(r *Registry) {
+		r.peerTransport.responseHeaderTimeout = responseHeaderTimeout
+	}
+}
+
+// WithKeepAlive sets the interval of keep-alive probes on connections to peers.
+func WithKeepAlive(keepAlive time.Duration) Option {
+	return func(r *Registry) {
+		r.peerTransport.keepAlive = keepAlive
+	}
+}
+
+// WithMaxIdleConnsPerPeer sets the max amount of idle connections kept open to each peer.
+func WithMaxIdleConnsPerPeer(maxIdleConnsPerPeer int) Option {
+	return func(r *Registry) {
+		r.peerTransport.maxIdleConnsPerPeer = maxIdleConnsPerPeer
+	}
+}
+
+// WithHTTP2 enables HTTP/2 for requests to peers, which is used without TLS (h2c) when TLS is disabled.
+func WithHTTP2(http2 bool) Option {
+	return func(r *Registry) {
+		r.peerTransport.http2 = http2
+	}
+}
+
+// WithUpstreamTransport sets the transport used when pulling through from the original registry.
+func WithUpstreamTransport(transport http.RoundTripper) Option {
+	return func(r *Registry) {
+		r.upstreamTransport = transport
+	}
+}
+
+// WithTLSConfig serves the registry over TLS with the given config.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(r *Registry) {
+		r.tlsConfig = tlsConfig
+	}
+}
+
+// WithPeerAuthentication requires requests from peers to present a verified client certificate.
+// The TLS config has to verify client certificates which are presented.
+func WithPeerAuthentication(peerAuth bool) Option {
+	return func(r *Registry) {
+		r.peerAuth = peerAuth
+	}
+}
+
 func WithLocalAddress(localAddr string) Option {
 	return func(r *Registry) {
 		r.localAddr = localAddr
 	}
 }
 
+// WithLocalHosts sets additional hosts which the local Spegel instance is reached at,
+// for example the host name used as mirror when TLS is enabled.
+func WithLocalHosts(localHosts []string) Option {
+	return func(r *Registry) {
+		r.localHosts = localHosts
+	}
+}
+
 func WithBlobSpeed(blobSpeed throttle.Byterate) Option {
 	return func(r *Registry) {
 		r.throttler = throttle.NewThrottler(blobSpeed)
 	}
 }
 
+// WithEgressSpeed limits the total write speed when serving blobs. Bandwidth is shared fairly between requesters.
+func WithEgressSpeed(egressSpeed throttle.Byterate) Option {
+	return func(r *Registry) {
+		r.egressLimiter = throttle.NewFairLimiter(egressSpeed)
+	}
+}
+
+// WithEgressWeights sets the weight of requester IPs when sharing the egress speed. Requesters have a weight of one by default.
+func WithEgressWeights(weights map[string]float64) Option {
+	return func(r *Registry) {
+		r.egressWeights = weights
+	}
+}
+
+// WithIngressSpeed limits the total read speed of content pulled from peers.
+func WithIngressSpeed(ingressSpeed throttle.Byterate) Option {
+	return func(r *Registry) {
+		r.ingressLimiter = throttle.NewReadLimiter(ingressSpeed)
+	}
+}
+
+// WithMaxConcurrentUploads limits the amount of blobs served at the same time. Requests above
+// the limit are rejected with 503 Service Unavailable and a Retry-After header so that the requester
+// tries another peer.
+func WithMaxConcurrentUploads(maxUploads int) Option {
+	return func(r *Registry) {
+		if maxUploads <= 0 {
+			return
+		}
+		r.uploadLimiter = newUploadLimiter(maxUploads)
+	}
+}
+
 func WithLogger(log logr.Logger) Option {
 	return func(r *Registry) {
 		r.log = log
@@ -90,10 +316,32 @@ func NewRegistry(ociClient oci.Client, router routing.Router, opts ...Option) *R
 		resolveRetries:   3,
 		resolveTimeout:   20 * time.Millisecond,
 		resolveLatestTag: true,
+		chunkSize:        16 * 1024 * 1024,
+		flights:          map[flightKey]*flight{},
+		mismatchedPeers:  newMismatchedPeers(),
+		peerHealth:       newPeerHealth(),
+		peerTransport:    defaultPeerTransportConfig(),
+		maxHops:          1,
 	}
 	for _, opt := range opts {
 		opt(r)
 	}
+	r.chunkBuffer = newChunkBuffer(r.chunkBufferSize, r.chunkSize)
+	if r.egressLimiter != nil {
+		for requester, weight := range r.egressWeights {
+			r.egressLimiter.SetWeight(requester, weight)
+		}
+	}
+	// The local address identifies the node in the via header of mirrored requests.
+	r.nodeID = r.localAddr
+	if r.nodeID == "" {
+		r.nodeID = randomNodeID()
+	}
+	if r.transport == nil {
+		r.transport = newPeerTransport(r.peerTransport)
+	}
+	// Trace context is injected into requests to peers so that their spans are part of the same trace.
+	r.transport = &connReuseTransport{rt: otelhttp.NewTransport(r.transport)}
 	return r
 }
 
@@ -102,9 +350,15 @@ func (r *Registry) Server(addr string) (*http.Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Peers may use HTTP/2 without TLS, which is negotiated by the handler.
+	var handler http.Handler = m
+	if r.tlsConfig == nil {
+		handler = h2c.NewHandler(m, &http2.Server{})
+	}
 	srv := &http.Server{
-		Addr:    addr,
-		Handler: m,
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: r.tlsConfig,
 	}
 	return srv, nil
 }
@@ -112,14 +366,34 @@ func (r *Registry) Server(addr string) (*http.Server, error) {
 func (r *Registry) handle(rw mux.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	handler := ""
+	via := req.Header.Get(ViaHeaderKey)
 	path := req.URL.Path
 	if strings.HasPrefix(path, "/v2") {
 		path = "/v2/*"
 	}
+	// Trace context decides if requests are sampled, which is why it is only continued from authenticated peers.
+	ctx := req.Context()
+	if hasPeerCertificate(req) {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(req.Header))
+	}
+	ctx, span := tracer.Start(ctx, "Registry.handle", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.request.method", req.Method),
+		attribute.String("url.path", req.URL.Path),
+	))
+	req = req.WithContext(ctx)
 	defer func() {
 		latency := time.Since(start)
 		statusCode := strconv.FormatInt(int64(rw.Status()), 10)
 
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", rw.Status()),
+			attribute.String("handler", handler),
+		)
+		if rw.Error() != nil {
+			span.SetStatus(codes.Error, rw.Error().Error())
+		}
+		span.End()
+
 		metrics.HttpRequestsInflight.WithLabelValues(path).Add(-1)
 		metrics.HttpRequestDurHistogram.WithLabelValues(path, req.Method, statusCode).Observe(latency.Seconds())
 		metrics.HttpResponseSizeHistogram.WithLabelValues(path, req.Method, statusCode).Observe(float64(rw.Size()))
@@ -137,6 +411,9 @@ func (r *Registry) handle(rw mux.ResponseWriter, req *http.Request) {
 			"ip", getClientIP(req),
 			"handler", handler,
 		}
+		if via != "" {
+			kvs = append(kvs, "via", via)
+		}
 		if rw.Status() >= 200 && rw.Status() < 300 {
 			r.log.Info("", kvs...)
 			return
@@ -154,9 +431,27 @@ func (r *Registry) handle(rw mux.ResponseWriter, req *http.Request) {
 		handler = r.registryHandler(rw, req)
 		return
 	}
+	if strings.HasPrefix(req.URL.Path, "/v2") {
+		rw.WriteError(http.StatusMethodNotAllowed, mux.WithCode(mux.ErrorCodeUnsupported, fmt.Errorf("method %s is not supported", req.Method)))
+		return
+	}
 	rw.WriteHeader(http.StatusNotFound)
 }
 
+// PeerHealthHandler writes the health of known peers as JSON.
+func (r *Registry) PeerHealthHandler(rw http.ResponseWriter, req *http.Request) {
+	b, err := json.Marshal(r.peerHealth.statuses())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_, err = rw.Write(b)
+	if err != nil {
+		r.log.Error(err, "error occurred when writing peer health")
+	}
+}
+
 func (r *Registry) readyHandler(rw mux.ResponseWriter, req *http.Request) {
 	ok, err := r.router.Ready(req.Context())
 	if err != nil {
@@ -167,6 +462,15 @@ func (r *Registry) readyHandler(rw mux.ResponseWriter, req *http.Request) {
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	ok, err = r.ociClient.Ready(req.Context())
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, fmt.Errorf("could not determine OCI client readiness: %w", err))
+		return
+	}
+	if !ok {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 }
 
 func (r *Registry) registryHandler(rw mux.ResponseWriter, req *http.Request) string {
@@ -180,14 +484,44 @@ func (r *Registry) registryHandler(rw mux.ResponseWriter, req *http.Request) str
 	originalRegistry := req.URL.Query().Get("ns")
 	ref, err := parsePathComponents(originalRegistry, req.URL.Path)
 	if err != nil {
-		rw.WriteError(http.StatusNotFound, fmt.Errorf("could not parse path according to OCI distribution spec: %w", err))
+		status := http.StatusNotFound
+		switch mux.CodeOf(err) {
+		case mux.ErrorCodeNameInvalid, mux.ErrorCodeDigestInvalid:
+			status = http.StatusBadRequest
+		}
+		rw.WriteError(status, fmt.Errorf("could not parse path according to OCI distribution spec: %w", err))
 		return "registry"
 	}
 
-	// Request with mirror header are proxied.
-	if req.Header.Get(MirroredHeaderKey) != "true" {
-		// Set mirrored header in request to stop infinite loops
-		req.Header.Set(MirroredHeaderKey, "true")
+	// Requests which loop or have been mirrored too many times are rejected.
+	chain := viaChain(req)
+	err = r.checkVia(chain)
+	if err != nil {
+		rw.WriteError(http.StatusLoopDetected, err)
+		return "registry"
+	}
+
+	// Requests which are not sent from this node have to be authenticated, whether or not they have been mirrored.
+	if r.peerAuth && !r.isLocalRequest(req) && !hasPeerCertificate(req) {
+		rw.WriteError(http.StatusUnauthorized, mux.WithCode(mux.ErrorCodeUnauthorized, errors.New("peer certificate is required")))
+		return "registry"
+	}
+
+	// Tags and catalog are listed from local images and are never proxied.
+	switch ref.kind {
+	case referenceKindTags:
+		r.handleTags(rw, req, ref)
+		return "tags"
+	case referenceKindCatalog:
+		r.handleCatalog(rw, req, ref)
+		return "catalog"
+	}
+
+	// Requests from clients are proxied. Requests from peers are served from local content, unless the content
+	// is not available locally and the request has been mirrored by less nodes than the max hops.
+	if len(chain) == 0 || (len(chain) < r.maxHops && !r.hasLocalContent(req.Context(), ref)) {
+		// Add this node to the via header in request to stop infinite loops
+		r.setVia(req.Header, chain)
 		r.handleMirror(rw, req, ref)
 		return "mirror"
 	}
@@ -200,32 +534,52 @@ func (r *Registry) registryHandler(rw mux.ResponseWriter, req *http.Request) str
 	case referenceKindBlob:
 		r.handleBlob(rw, req, ref)
 		return "blob"
+	case referenceKindReferrers:
+		r.handleReferrers(rw, req, ref)
+		return "referrers"
 	default:
-		rw.WriteError(http.StatusNotFound, fmt.Errorf("unknown reference kind %s", ref.kind))
+		rw.WriteError(http.StatusNotFound, mux.WithCode(mux.ErrorCodeUnsupported, fmt.Errorf("unknown reference kind %s", ref.kind)))
 		return "registry"
 	}
 }
 
-func (r *Registry) handleMirror(rw mux.ResponseWriter, req *http.Request, ref reference) {
-	key := ref.dgst.String()
-	if key == "" {
-		key = ref.name
+// hasLocalContent returns true if the content of the reference can be served from local content.
+func (r *Registry) hasLocalContent(ctx context.Context, ref reference) bool {
+	switch {
+	case ref.kind == referenceKindReferrers:
+		referrers, err := r.ociClient.ListReferrers(ctx, ref.dgst)
+		return err == nil && len(referrers) > 0
+	case ref.dgst == "":
+		_, err := r.ociClient.Resolve(ctx, ref.name)
+		return err == nil
+	default:
+		_, err := r.ociClient.Size(ctx, ref.dgst)
+		return err == nil
 	}
+}
 
-	log := r.log.WithValues("key", key, "path", req.URL.Path, "ip", getClientIP(req))
+func (r *Registry) handleMirror(rw mux.ResponseWriter, req *http.Request, ref reference) {
+	log := r.log.WithValues("key", ref.key(), "path", req.URL.Path, "ip", getClientIP(req))
 
 	isExternal := r.isExternalRequest(req)
+	ctx, span := tracer.Start(req.Context(), "Registry.handleMirror", trace.WithAttributes(
+		attribute.String("key", ref.key()),
+		attribute.Bool("external", isExternal),
+	))
+	defer span.End()
+	req = req.WithContext(ctx)
 	if isExternal {
 		log.Info("handling mirror request from external node")
 	}
 
+	pulledThrough := false
 	defer func() {
 		sourceType := "internal"
 		if isExternal {
 			sourceType = "external"
 		}
 		cacheType := "hit"
-		if rw.Status() != http.StatusOK {
+		if pulledThrough || (rw.Status() != http.StatusOK && rw.Status() != http.StatusPartialContent) {
 			cacheType = "miss"
 		}
 		metrics.MirrorRequestsTotal.WithLabelValues(ref.originalRegistry, cacheType, sourceType).Inc()
@@ -233,27 +587,60 @@ func (r *Registry) handleMirror(rw mux.ResponseWriter, req *http.Request, ref re
 
 	if !r.resolveLatestTag && ref.hasLatestTag() {
 		r.log.V(4).Info("skipping mirror request for image with latest tag", "image", ref.name)
-		rw.WriteHeader(http.StatusNotFound)
+		rw.WriteError(http.StatusNotFound, mux.WithCode(mux.ErrorCodeManifestUnknown, fmt.Errorf("mirroring of image %s with latest tag is disabled", ref.name)))
+		return
+	}
+
+	if r.canCoalesce(req, ref) {
+		pulledThrough = r.mirrorCoalesced(rw, req, ref, isExternal, log)
 		return
 	}
+	pulledThrough = r.mirror(rw, req, ref, isExternal, log)
+}
+
+// mirror resolves peers for the reference and proxies the request to them. It returns
+// true if the content was instead pulled through from the original registry.
+func (r *Registry) mirror(rw mux.ResponseWriter, req *http.Request, ref reference, isExternal bool, log logr.Logger) bool {
+	key := ref.key()
 
 	// Resolve mirror with the requested key
 	resolveCtx, cancel := context.WithTimeout(req.Context(), r.resolveTimeout)
 	defer cancel()
 	resolveCtx = logr.NewContext(resolveCtx, log)
-	peerCh, err := r.router.Resolve(resolveCtx, key, isExternal, r.resolveRetries)
+	parallel := r.canMirrorParallel(req, ref)
+	resolveCount := r.resolveRetries
+	if parallel {
+		resolveCount = max(resolveCount, r.parallelPeers)
+	}
+	peerCh, err := r.router.Resolve(resolveCtx, key, isExternal, resolveCount)
 	if err != nil {
 		rw.WriteError(http.StatusInternalServerError, fmt.Errorf("error occurred when attempting to resolve mirrors: %w", err))
-		return
+		return false
+	}
+	if parallel {
+		peers := collectPeers(req.Context(), peerCh, r.parallelPeers)
+		r.peerHealth.order(peers)
+		peers = slices.DeleteFunc(peers, r.peerHealth.isOpen)
+		if len(peers) > 1 {
+			err := r.mirrorParallel(rw, req, ref, peers)
+			if err == nil {
+				log.V(4).Info("mirrored request in parallel", "peers", len(peers))
+				return false
+			}
+			log.V(4).Info("falling back to single peer mirroring", "reason", err.Error())
+		}
+		peerCh = prependPeers(req.Context(), peers, peerCh)
 	}
+	peerCh = r.peerHealth.orderPeers(req.Context(), resolveCtx, peerCh, resolveCount)
 
 	mirrorAttempts := 0
+	busyMirrors := 0
 	for {
 		select {
 		case <-req.Context().Done():
 			// Request has been closed by server or client. No use continuing.
-			rw.WriteError(http.StatusNotFound, fmt.Errorf("mirroring for image component %s has been cancelled: %w", key, resolveCtx.Err()))
-			return
+			rw.WriteError(http.StatusNotFound, mux.WithCode(unknownErrorCode(ref), fmt.Errorf("mirroring for image component %s has been cancelled: %w", key, resolveCtx.Err())))
+			return false
 		case ipAddr, ok := <-peerCh:
 			// Channel closed means no more mirrors will be received and max retries has been reached.
 			if !ok {
@@ -261,58 +648,179 @@ func (r *Registry) handleMirror(rw mux.ResponseWriter, req *http.Request, ref re
 				if mirrorAttempts > 0 {
 					err = errors.Join(err, fmt.Errorf("requests to %d mirrors failed, all attempts have been exhausted or timeout has been reached", mirrorAttempts))
 				}
-				rw.WriteError(http.StatusNotFound, err)
-				return
+				if busyMirrors > 0 {
+					err = errors.Join(err, fmt.Errorf("%d mirrors were busy", busyMirrors))
+				}
+				if r.canPullThrough(ref) {
+					pullErr := r.handlePullThrough(rw, req, ref)
+					if pullErr == nil {
+						log.V(4).Info("pulled through request from upstream registry", "registry", ref.originalRegistry)
+						return true
+					}
+					err = errors.Join(err, fmt.Errorf("pull through from upstream registry failed: %w", pullErr))
+				}
+				// Referrers which cannot be found are listed from local content, which is an empty list if there are none.
+				if ref.kind == referenceKindReferrers {
+					log.V(4).Info("listing local referrers as no mirror could list them", "reason", err.Error())
+					r.handleReferrers(rw, req, ref)
+					return false
+				}
+				rw.WriteError(http.StatusNotFound, mux.WithCode(unknownErrorCode(ref), err))
+				return false
 			}
 
-			mirrorAttempts++
+			if r.mismatchedPeers.contains(key, ipAddr) {
+				log.V(4).Info("skipping mirror which has served content not matching digest", "peer", ipAddr.String())
+				continue
+			}
+			if !r.peerHealth.allow(ipAddr) {
+				log.V(4).Info("skipping mirror which keeps failing", "peer", ipAddr.String())
+				continue
+			}
 
 			// Modify response returns and error on non 200 status code and NOP error handler skips response writing.
 			// If proxy fails no response is written and it is tried again against a different mirror.
 			// If the response writer has been written to it means that the request was properly proxied.
 			succeeded := false
-			scheme := "http"
-			if req.TLS != nil {
-				scheme = "https"
-			}
-			u := &url.URL{
-				Scheme: scheme,
-				Host:   ipAddr.String(),
+			busy := false
+			u := peerURL(req, ipAddr)
+			hedger := &hedgedRoundTripper{
+				rt:    r.roundTripper(),
+				peer:  ipAddr,
+				delay: r.hedgeDelay,
+				next: func() (netip.AddrPort, bool) {
+					for {
+						peer, ok := tryReceive(peerCh)
+						if !ok {
+							return netip.AddrPort{}, false
+						}
+						if r.mismatchedPeers.contains(key, peer) || !r.peerHealth.allow(peer) {
+							continue
+						}
+						return peer, true
+					}
+				},
+				onFailure: r.peerHealth.recordFailure,
 			}
 			proxy := httputil.NewSingleHostReverseProxy(u)
-			proxy.Transport = r.transport
-			proxy.ErrorHandler = func(_ http.ResponseWriter, _ *http.Request, err error) {
-				log.Error(err, "request to mirror failed", "attempt", mirrorAttempts)
+			proxy.Transport = hedger
+			proxy.ErrorHandler = func(_ http.ResponseWriter, proxyReq *http.Request, err error) {
+				// Busy mirrors are not failures, the next mirror is tried right away.
+				if errors.Is(err, errMirrorBusy) {
+					busy = true
+					log.V(4).Info("mirror is busy, trying next mirror", "peer", hedger.peer.String())
+					return
+				}
+				// Mirrors which have already handled the request are skipped.
+				if errors.Is(err, errMirrorLoop) {
+					log.V(4).Info("mirror has already handled request, trying next mirror", "peer", hedger.peer.String())
+					return
+				}
+				// Requests cancelled by the client say nothing about the health of the mirror.
+				if proxyReq.Context().Err() == nil {
+					r.peerHealth.recordFailure(hedger.peer)
+				}
+				log.Error(err, "request to mirror failed", "attempt", mirrorAttempts+1)
 			}
 			proxy.ModifyResponse = func(resp *http.Response) error {
-				if resp.StatusCode != http.StatusOK {
-					return fmt.Errorf("expected mirror to respond with 200 OK but received: %s", resp.Status)
+				// The response may be from a hedged request to another peer.
+				ipAddr := hedger.peer
+				if isBusyResponse(resp) {
+					return errMirrorBusy
+				}
+				if resp.StatusCode == http.StatusLoopDetected {
+					return errMirrorLoop
+				}
+				// Unsatisfiable ranges are passed through to the client as the mirror has the content.
+				if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && req.Header.Get("Range") != "" {
+					succeeded = true
+					return nil
+				}
+				// Range requests are passed through to the mirror which will respond with partial content.
+				if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+					return fmt.Errorf("expected mirror to respond with 200 OK or 206 Partial Content but received: %s", resp.Status)
+				}
+				if canResume(req, ref, resp) {
+					resp.Body = r.resumeBody(req, ref, resp, ipAddr, isExternal, log)
+				}
+				resp.Body = r.limitIngress(resp.Body)
+				// Content is verified so that corrupt content from a peer is never passed on in full.
+				err := verifyResponse(req, ref, resp, func(err error) {
+					log.Error(err, "mirror served content not matching digest", "peer", ipAddr.String())
+					r.recordMismatch(ref, key, ipAddr)
+				}, r.refetchBlob(req, ref, resp, ipAddr, isExternal, log))
+				if errors.Is(err, errDigestMismatch) {
+					r.recordMismatch(ref, key, ipAddr)
+				}
+				if err != nil {
+					return err
+				}
+				r.peerHealth.recordSuccess(ipAddr, time.Since(hedger.start))
+				resp.Body = &measuredBody{
+					rc:     resp.Body,
+					health: r.peerHealth,
+					peer:   ipAddr,
+					start:  time.Now(),
 				}
 				succeeded = true
 				return nil
 			}
-			proxy.ServeHTTP(rw, req)
+			attemptCtx, span := tracer.Start(req.Context(), "Registry.mirrorAttempt", trace.WithAttributes(
+				attribute.String("peer", ipAddr.String()),
+				attribute.Int("attempt", mirrorAttempts+1),
+			))
+			proxy.ServeHTTP(rw, req.WithContext(attemptCtx))
+			// The hedged peer may have served the response.
+			span.SetAttributes(attribute.String("served_by", hedger.peer.String()))
+			// Peers whose hedged requests were cancelled have not failed and are tried again.
+			if !succeeded && len(hedger.unused) > 0 {
+				peerCh = prependPeers(req.Context(), hedger.unused, peerCh)
+			}
+			if busy {
+				span.SetStatus(codes.Error, "mirror is busy")
+				span.End()
+				busyMirrors++
+				break
+			}
 			if !succeeded {
+				span.SetStatus(codes.Error, "request to mirror failed")
+				span.End()
+				mirrorAttempts++
 				break
 			}
-			log.V(4).Info("mirrored request", "url", u.String())
-			return
+			span.End()
+			log.V(4).Info("mirrored request", "peer", hedger.peer.String())
+			return false
 		}
 	}
 }
 
+// limitIngress limits the read speed of the response body from a peer if an ingress speed is set.
+func (r *Registry) limitIngress(rc io.ReadCloser) io.ReadCloser {
+	if r.ingressLimiter == nil {
+		return rc
+	}
+	return r.ingressLimiter.ReadCloser(rc)
+}
+
+// recordMismatch records that the peer served content not matching the digest of the reference.
+func (r *Registry) recordMismatch(ref reference, key string, peer netip.AddrPort) {
+	metrics.MirrorDigestMismatchesTotal.WithLabelValues(ref.originalRegistry).Inc()
+	r.mismatchedPeers.add(key, peer)
+}
+
 func (r *Registry) handleManifest(rw mux.ResponseWriter, req *http.Request, ref reference) {
 	if ref.dgst == "" {
 		var err error
 		ref.dgst, err = r.ociClient.Resolve(req.Context(), ref.name)
 		if err != nil {
-			rw.WriteError(http.StatusNotFound, fmt.Errorf("could not get digest for image tag %s: %w", ref.name, err))
+			writeOCIError(rw, mux.ErrorCodeManifestUnknown, fmt.Errorf("could not get digest for image tag %s: %w", ref.name, err))
 			return
 		}
 	}
 	b, mediaType, err := r.ociClient.GetManifest(req.Context(), ref.dgst)
 	if err != nil {
-		rw.WriteError(http.StatusNotFound, fmt.Errorf("could not get manifest content for digest %s: %w", ref.dgst.String(), err))
+		writeOCIError(rw, mux.ErrorCodeManifestUnknown, fmt.Errorf("could not get manifest content for digest %s: %w", ref.dgst.String(), err))
 		return
 	}
 	rw.Header().Set("Content-Type", mediaType)
@@ -329,35 +837,152 @@ func (r *Registry) handleManifest(rw mux.ResponseWriter, req *http.Request, ref
 }
 
 func (r *Registry) handleBlob(rw mux.ResponseWriter, req *http.Request, ref reference) {
-	size, err := r.ociClient.Size(req.Context(), ref.dgst)
+	if r.uploadLimiter != nil && req.Method == http.MethodGet {
+		if !r.uploadLimiter.acquire(req.Context()) {
+			rw.Header().Set("Retry-After", uploadRetryAfter)
+			rw.WriteError(http.StatusServiceUnavailable, errors.New("max concurrent blob uploads reached"))
+			return
+		}
+		defer r.uploadLimiter.release()
+	}
+
+	rc, err := r.ociClient.GetBlob(req.Context(), ref.dgst)
 	if err != nil {
-		rw.WriteError(http.StatusInternalServerError, fmt.Errorf("could not determine size of blob with digest %s: %w", ref.dgst.String(), err))
+		writeOCIError(rw, mux.ErrorCodeBlobUnknown, fmt.Errorf("could not get reader for blob with digest %s: %w", ref.dgst.String(), err))
 		return
 	}
-	rw.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	defer rc.Close()
+
+	// Blobs are content addressed which makes the digest a strong validator for If-Range requests.
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("ETag", fmt.Sprintf("%q", ref.dgst.String()))
 	rw.Header().Set("Docker-Content-Digest", ref.dgst.String())
-	if req.Method == http.MethodHead {
+	var w http.ResponseWriter = rw
+	if r.throttler != nil || r.egressLimiter != nil {
+		var writer io.Writer = rw
+		if r.egressLimiter != nil {
+			writer = r.egressLimiter.Writer(req.Context(), writer, getRemoteIP(req))
+		}
+		if r.throttler != nil {
+			writer = r.throttler.Writer(writer)
+		}
+		w = &throttledResponseWriter{
+			ResponseWriter: rw,
+			writer:         writer,
+		}
+	}
+	// ServeContent handles HEAD requests, Range and If-Range headers, and multi range responses.
+	http.ServeContent(w, req, "", time.Time{}, rc)
+}
+
+// writeOCIError writes an error returned by the OCI client. Content which could not be
+// found is written with the given code while all other errors are internal errors.
+func writeOCIError(rw mux.ResponseWriter, code mux.ErrorCode, err error) {
+	if errdefs.IsNotFound(err) {
+		rw.WriteError(http.StatusNotFound, mux.WithCode(code, err))
 		return
 	}
-	var w io.Writer = rw
-	if r.throttler != nil {
-		w = r.throttler.Writer(rw)
+	rw.WriteError(http.StatusInternalServerError, err)
+}
+
+// unknownErrorCode returns the error code used when the content of the reference cannot be found.
+func unknownErrorCode(ref reference) mux.ErrorCode {
+	switch ref.kind {
+	case referenceKindManifest, referenceKindReferrers:
+		return mux.ErrorCodeManifestUnknown
+	default:
+		return mux.ErrorCodeBlobUnknown
 	}
-	rc, err := r.ociClient.GetBlob(req.Context(), ref.dgst)
+}
+
+// handleReferrers lists the local manifests which have the requested digest as subject.
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-referrers
+func (r *Registry) handleReferrers(rw mux.ResponseWriter, req *http.Request, ref reference) {
+	referrers, err := r.ociClient.ListReferrers(req.Context(), ref.dgst)
 	if err != nil {
-		rw.WriteError(http.StatusInternalServerError, fmt.Errorf("could not get reader for blob with digest %s: %w", ref.dgst.String(), err))
+		writeOCIError(rw, mux.ErrorCodeManifestUnknown, fmt.Errorf("could not list referrers for digest %s: %w", ref.dgst.String(), err))
 		return
 	}
-	defer rc.Close()
-	_, err = io.Copy(w, rc)
+	if artifactType := req.URL.Query().Get("artifactType"); artifactType != "" {
+		referrers = slices.DeleteFunc(referrers, func(desc ocispec.Descriptor) bool {
+			return desc.ArtifactType != artifactType
+		})
+		rw.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	idx := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: referrers,
+	}
+	b, err := json.Marshal(idx)
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, fmt.Errorf("could not encode referrers: %w", err))
+		return
+	}
+	rw.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+	rw.Header().Set("Content-Length", strconv.FormatInt(int64(len(b)), 10))
+	if req.Method == http.MethodHead {
+		return
+	}
+	_, err = rw.Write(b)
 	if err != nil {
-		r.log.Error(err, "error occurred when copying blob")
+		r.log.Error(err, "error occurred when writing referrers")
 		return
 	}
 }
 
+func (r *Registry) roundTripper() http.RoundTripper {
+	return r.transport
+}
+
 func (r *Registry) isExternalRequest(req *http.Request) bool {
-	return req.Host != r.localAddr
+	return req.Host != r.localAddr && !slices.Contains(r.localHosts, req.Host)
+}
+
+// peerURL returns the base URL of the peer registry which the request should be sent to.
+func peerURL(req *http.Request, peer netip.AddrPort) *url.URL {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return &url.URL{
+		Scheme: scheme,
+		Host:   peer.String(),
+	}
+}
+
+// peerRequest returns a copy of the request which is sent to the peer.
+func peerRequest(ctx context.Context, req *http.Request, peer netip.AddrPort) *http.Request {
+	peerReq := req.Clone(ctx)
+	peerReq.RequestURI = ""
+	u := peerURL(req, peer)
+	peerReq.URL.Scheme = u.Scheme
+	peerReq.URL.Host = u.Host
+	return peerReq
+}
+
+// isLocalRequest returns true if the request was sent from this node, either over loopback or from the node IP.
+// The remote address of the connection is used as headers can be set by any client.
+func (r *Registry) isLocalRequest(req *http.Request) bool {
+	remoteAddr, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := remoteAddr.Addr().Unmap()
+	if ip.IsLoopback() {
+		return true
+	}
+	localAddr, err := netip.ParseAddrPort(r.localAddr)
+	if err != nil {
+		return false
+	}
+	return localAddr.Addr().Unmap() == ip
+}
+
+// hasPeerCertificate returns true if the request was sent with a client certificate. Certificates
+// are verified during the TLS handshake.
+func hasPeerCertificate(req *http.Request) bool {
+	return req.TLS != nil && len(req.TLS.PeerCertificates) > 0
 }
 
 func getClientIP(req *http.Request) string {
@@ -369,9 +994,23 @@ func getClientIP(req *http.Request) string {
 		}
 		return forwardedFor
 	}
+	return getRemoteIP(req)
+}
+
+// getRemoteIP returns the IP of the connection which, unlike the forwarded for header, is not set by the client.
+func getRemoteIP(req *http.Request) string {
 	h, _, err := net.SplitHostPort(req.RemoteAddr)
 	if err != nil {
 		return ""
 	}
 	return h
 }
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	writer io.Writer
+}
+
+func (t *throttledResponseWriter) Write(b []byte) (int, error) {
+	return t.writer.Write(b)
+}
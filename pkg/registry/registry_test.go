@@ -1,16 +1,31 @@
 package registry
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 
 	"github.com/spegel-org/spegel/internal/mux"
+	"github.com/spegel-org/spegel/pkg/oci"
 	"github.com/spegel-org/spegel/pkg/routing"
 )
 
@@ -56,21 +71,22 @@ func TestMirrorHandler(t *testing.T) {
 		name            string
 		key             string
 		expectedBody    string
+		expectedCode    mux.ErrorCode
 		expectedStatus  int
 	}{
 		{
 			name:            "request should timeout when no peers exists",
 			key:             "no-peers",
 			expectedStatus:  http.StatusNotFound,
-			expectedBody:    "",
-			expectedHeaders: nil,
+			expectedCode:    mux.ErrorCodeBlobUnknown,
+			expectedHeaders: map[string][]string{"Content-Type": {"application/json"}},
 		},
 		{
 			name:            "request should not timeout and give 404 if all peers fail",
 			key:             "no-working-peers",
 			expectedStatus:  http.StatusNotFound,
-			expectedBody:    "",
-			expectedHeaders: nil,
+			expectedCode:    mux.ErrorCodeBlobUnknown,
+			expectedHeaders: map[string][]string{"Content-Type": {"application/json"}},
 		},
 		{
 			name:            "request should work when first peer responds",
@@ -112,7 +128,17 @@ func TestMirrorHandler(t *testing.T) {
 				require.NoError(t, err)
 				require.Equal(t, tt.expectedStatus, resp.StatusCode)
 
-				if method == http.MethodGet {
+				if method == http.MethodGet && tt.expectedCode != "" {
+					errResp := struct {
+						Errors []struct {
+							Code mux.ErrorCode `json:"code"`
+						} `json:"errors"`
+					}{}
+					require.NoError(t, json.Unmarshal(b, &errResp))
+					require.Len(t, errResp.Errors, 1)
+					require.Equal(t, tt.expectedCode, errResp.Errors[0].Code)
+				}
+				if method == http.MethodGet && tt.expectedCode == "" {
 					require.Equal(t, tt.expectedBody, string(b))
 				}
 				if method == http.MethodHead {
@@ -130,6 +156,613 @@ func TestMirrorHandler(t *testing.T) {
 	}
 }
 
+func TestBlobHandlerRange(t *testing.T) {
+	t.Parallel()
+
+	ociClient := oci.NewMockClient(nil)
+	dgst := ociClient.AddBlob([]byte("hello world"))
+	etag := fmt.Sprintf("%q", dgst.String())
+	reg := NewRegistry(ociClient, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}))
+
+	tests := []struct {
+		headers         map[string]string
+		name            string
+		expectedBody    string
+		expectedRange   string
+		expectedStatus  int
+		expectMultipart bool
+	}{
+		{
+			name:           "full content",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "hello world",
+		},
+		{
+			name:           "single range",
+			headers:        map[string]string{"Range": "bytes=6-10"},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "world",
+			expectedRange:  "bytes 6-10/11",
+		},
+		{
+			name:           "open ended range",
+			headers:        map[string]string{"Range": "bytes=6-"},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "world",
+			expectedRange:  "bytes 6-10/11",
+		},
+		{
+			name:            "multiple ranges",
+			headers:         map[string]string{"Range": "bytes=0-4,6-10"},
+			expectedStatus:  http.StatusPartialContent,
+			expectMultipart: true,
+		},
+		{
+			name:           "unsatisfiable range",
+			headers:        map[string]string{"Range": "bytes=20-30"},
+			expectedStatus: http.StatusRequestedRangeNotSatisfiable,
+			expectedRange:  "bytes */11",
+		},
+		{
+			name:           "if range matching etag",
+			headers:        map[string]string{"Range": "bytes=0-4", "If-Range": etag},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "hello",
+			expectedRange:  "bytes 0-4/11",
+		},
+		{
+			name:           "if range not matching etag",
+			headers:        map[string]string{"Range": "bytes=0-4", "If-Range": `"sha256:foo"`},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "hello world",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			target := fmt.Sprintf("http://example.com/v2/foo/bar/blobs/%s", dgst.String())
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			req.Header.Set(ViaHeaderKey, "peer")
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			m, err := mux.NewServeMux(reg.handle)
+			require.NoError(t, err)
+			m.ServeHTTP(rw, req)
+
+			resp := rw.Result()
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			require.Equal(t, tt.expectedRange, resp.Header.Get("Content-Range"))
+			if tt.expectedStatus == http.StatusRequestedRangeNotSatisfiable {
+				return
+			}
+			require.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+			require.Equal(t, dgst.String(), resp.Header.Get("Docker-Content-Digest"))
+			if tt.expectMultipart {
+				require.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/byteranges; boundary="))
+				require.Contains(t, string(b), "Content-Range: bytes 0-4/11")
+				require.Contains(t, string(b), "Content-Range: bytes 6-10/11")
+				return
+			}
+			require.Equal(t, tt.expectedBody, string(b))
+		})
+	}
+}
+
+func TestMirrorHandlerRange(t *testing.T) {
+	t.Parallel()
+
+	ociClient := oci.NewMockClient(nil)
+	dgst := ociClient.AddBlob([]byte("hello world"))
+	missingDgst := digest.FromString("missing")
+	peerReg := NewRegistry(ociClient, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}))
+	peerMux, err := mux.NewServeMux(peerReg.handle)
+	require.NoError(t, err)
+	peerSvr := httptest.NewServer(peerMux)
+	t.Cleanup(func() {
+		peerSvr.Close()
+	})
+	peer := netip.MustParseAddrPort(peerSvr.Listener.Addr().String())
+
+	resolver := map[string][]netip.AddrPort{
+		dgst.String():        {peer},
+		missingDgst.String(): {peer},
+	}
+
+	tests := []struct {
+		name           string
+		dgst           digest.Digest
+		rangeHeader    string
+		expectedBody   string
+		expectedRange  string
+		expectedStatus int
+		expectHealthy  bool
+	}{
+		{
+			name:           "satisfiable range",
+			dgst:           dgst,
+			rangeHeader:    "bytes=6-10",
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "world",
+			expectedRange:  "bytes 6-10/11",
+			expectHealthy:  true,
+		},
+		{
+			name:           "unsatisfiable range",
+			dgst:           dgst,
+			rangeHeader:    "bytes=20-30",
+			expectedStatus: http.StatusRequestedRangeNotSatisfiable,
+			expectedRange:  "bytes */11",
+			expectHealthy:  true,
+		},
+		{
+			name:           "content missing on peer",
+			dgst:           missingDgst,
+			rangeHeader:    "bytes=6-10",
+			expectedStatus: http.StatusNotFound,
+			expectHealthy:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			reg := NewRegistry(nil, routing.NewMemoryRouter(resolver, netip.AddrPort{}))
+			target := fmt.Sprintf("http://example.com/v2/foo/bar/blobs/%s", tt.dgst.String())
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			req.Header.Set("Range", tt.rangeHeader)
+			m, err := mux.NewServeMux(reg.handle)
+			require.NoError(t, err)
+			m.ServeHTTP(rw, req)
+
+			resp := rw.Result()
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			require.Equal(t, tt.expectHealthy, reg.peerHealth.healthy(peer))
+			if tt.expectedStatus == http.StatusNotFound {
+				return
+			}
+			require.Equal(t, tt.expectedRange, resp.Header.Get("Content-Range"))
+			if tt.expectedStatus == http.StatusRequestedRangeNotSatisfiable {
+				return
+			}
+			require.Equal(t, tt.expectedBody, string(b))
+		})
+	}
+}
+
+func TestMirrorHandlerTLS(t *testing.T) {
+	t.Parallel()
+
+	ociClient := oci.NewMockClient(nil)
+	dgst := ociClient.AddBlob([]byte("hello world"))
+	peerReg := NewRegistry(ociClient, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}))
+	peerMux, err := mux.NewServeMux(peerReg.handle)
+	require.NoError(t, err)
+	peerSvr := httptest.NewTLSServer(peerMux)
+	t.Cleanup(func() {
+		peerSvr.Close()
+	})
+
+	resolver := map[string][]netip.AddrPort{
+		dgst.String(): {netip.MustParseAddrPort(peerSvr.Listener.Addr().String())},
+	}
+	reg := NewRegistry(nil, routing.NewMemoryRouter(resolver, netip.AddrPort{}), WithTransport(peerSvr.Client().Transport))
+
+	// Requests received over TLS are proxied to peers over TLS.
+	target := fmt.Sprintf("https://example.com/v2/foo/bar/blobs/%s", dgst.String())
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	m, err := mux.NewServeMux(reg.handle)
+	require.NoError(t, err)
+	m.ServeHTTP(rw, req)
+
+	resp := rw.Result()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "hello world", string(b))
+}
+
+func TestMaxConcurrentUploads(t *testing.T) {
+	t.Parallel()
+
+	ociClient := oci.NewMockClient(nil)
+	dgst := ociClient.AddBlob([]byte("hello world"))
+	busyReg := NewRegistry(ociClient, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}), WithMaxConcurrentUploads(1))
+	require.True(t, busyReg.uploadLimiter.acquire(context.Background()))
+	busyMux, err := mux.NewServeMux(busyReg.handle)
+	require.NoError(t, err)
+	busySvr := httptest.NewServer(busyMux)
+	t.Cleanup(func() {
+		busySvr.Close()
+	})
+
+	// Blob requests above the limit are rejected.
+	target := fmt.Sprintf("http://example.com/v2/foo/bar/blobs/%s", dgst.String())
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set(ViaHeaderKey, "peer")
+	busyMux.ServeHTTP(rw, req)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	// Mirrors try the next peer when a peer is busy.
+	peerReg := NewRegistry(ociClient, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}), WithMaxConcurrentUploads(1))
+	peerMux, err := mux.NewServeMux(peerReg.handle)
+	require.NoError(t, err)
+	peerSvr := httptest.NewServer(peerMux)
+	t.Cleanup(func() {
+		peerSvr.Close()
+	})
+	resolver := map[string][]netip.AddrPort{
+		dgst.String(): {
+			netip.MustParseAddrPort(busySvr.Listener.Addr().String()),
+			netip.MustParseAddrPort(peerSvr.Listener.Addr().String()),
+		},
+	}
+	reg := NewRegistry(nil, routing.NewMemoryRouter(resolver, netip.AddrPort{}))
+	m, err := mux.NewServeMux(reg.handle)
+	require.NoError(t, err)
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, target, nil)
+	m.ServeHTTP(rw, req)
+	resp = rw.Result()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "hello world", string(b))
+}
+
+// spanRecorder is set as the global tracer provider once, as global tracers only delegate to the first provider set.
+var spanRecorder = sync.OnceValue(func() *tracetest.SpanRecorder {
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return sr
+})
+
+func TestMirrorTracing(t *testing.T) {
+	t.Parallel()
+
+	sr := spanRecorder()
+
+	ociClient := oci.NewMockClient(nil)
+	dgst := ociClient.AddBlob([]byte("hello world"))
+
+	tests := []struct {
+		name               string
+		expectedHandleSpan int
+		peerCertificate    bool
+	}{
+		{
+			name:               "trace is continued by authenticated peer",
+			peerCertificate:    true,
+			expectedHandleSpan: 2,
+		},
+		{
+			name:               "trace is not continued by unauthenticated peer",
+			peerCertificate:    false,
+			expectedHandleSpan: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			peerReg := NewRegistry(ociClient, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}))
+			peerSrv, err := peerReg.Server("")
+			require.NoError(t, err)
+			traceparentCh := make(chan string, 1)
+			peerSvr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				traceparentCh <- req.Header.Get("traceparent")
+				if tt.peerCertificate {
+					// Certificates are verified during the TLS handshake.
+					req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}
+				}
+				peerSrv.Handler.ServeHTTP(rw, req)
+			}))
+			t.Cleanup(func() {
+				peerSvr.Close()
+			})
+
+			resolver := map[string][]netip.AddrPort{
+				dgst.String(): {netip.MustParseAddrPort(peerSvr.Listener.Addr().String())},
+			}
+			reg := NewRegistry(nil, routing.NewMemoryRouter(resolver, netip.AddrPort{}))
+			srv, err := reg.Server("")
+			require.NoError(t, err)
+
+			// Trace context from clients is not continued.
+			ctx, span := otel.Tracer("test").Start(context.Background(), "test")
+			defer span.End()
+			clientTraceID := span.SpanContext().TraceID().String()
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://example.com/v2/foo/bar/blobs/%s", dgst.String()), nil)
+			otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+			srv.Handler.ServeHTTP(rw, req)
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			comps := strings.Split(<-traceparentCh, "-")
+			require.Len(t, comps, 4)
+			traceID := comps[1]
+			require.NotEqual(t, clientTraceID, traceID)
+			spanCount := func() map[string]int {
+				count := map[string]int{}
+				for _, span := range sr.Ended() {
+					if span.SpanContext().TraceID().String() != traceID {
+						continue
+					}
+					count[span.Name()]++
+				}
+				return count
+			}
+			require.Eventually(t, func() bool {
+				return spanCount()["Registry.handle"] == tt.expectedHandleSpan
+			}, 5*time.Second, 10*time.Millisecond)
+			count := spanCount()
+			require.Equal(t, 1, count["Registry.handleMirror"])
+			require.Equal(t, 1, count["Registry.mirrorAttempt"])
+		})
+	}
+}
+
+func TestPeerAuthentication(t *testing.T) {
+	t.Parallel()
+
+	ociClient := oci.NewMockClient(nil)
+	dgst := ociClient.AddBlob([]byte("hello world"))
+	reg := NewRegistry(ociClient, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}), WithPeerAuthentication(true), WithLocalAddress("10.0.0.1:30020"))
+
+	tests := []struct {
+		name           string
+		target         string
+		path           string
+		remoteAddr     string
+		peerCerts      []*x509.Certificate
+		expectedStatus int
+		withoutVia     bool
+	}{
+		{
+			name:           "without TLS",
+			target:         "http://example.com",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "without peer certificate",
+			target:         "https://example.com",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "without peer certificate or via header",
+			target:         "https://example.com",
+			withoutVia:     true,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "tags without peer certificate",
+			target:         "https://example.com",
+			path:           "/v2/foo/bar/tags/list",
+			withoutVia:     true,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "with peer certificate",
+			target:         "https://example.com",
+			peerCerts:      []*x509.Certificate{{}},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "from loopback without peer certificate",
+			target:         "https://example.com",
+			remoteAddr:     "127.0.0.1:1234",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "from node IP without peer certificate",
+			target:         "https://example.com",
+			remoteAddr:     "10.0.0.1:1234",
+			expectedStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := tt.path
+			if path == "" {
+				path = fmt.Sprintf("/v2/foo/bar/blobs/%s", dgst.String())
+			}
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tt.target+path, nil)
+			if !tt.withoutVia {
+				req.Header.Set(ViaHeaderKey, "peer")
+			}
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			if req.TLS != nil {
+				req.TLS.PeerCertificates = tt.peerCerts
+			}
+			m, err := mux.NewServeMux(reg.handle)
+			require.NoError(t, err)
+			m.ServeHTTP(rw, req)
+
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestReferrersHandler(t *testing.T) {
+	t.Parallel()
+
+	ociClient := oci.NewMockClient(nil)
+	subject := ociClient.AddBlob([]byte(`{"mediaType":"application/vnd.oci.image.manifest.v1+json"}`))
+	signature := ociClient.AddBlob([]byte(fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":"application/vnd.dev.cosign.artifact.sig.v1+json","config":{"mediaType":"application/vnd.oci.empty.v1+json"},"subject":{"digest":%q}}`, subject)))
+	sbom := ociClient.AddBlob([]byte(fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/spdx+json"},"annotations":{"foo":"bar"},"subject":{"digest":%q}}`, subject)))
+	reg := NewRegistry(ociClient, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}))
+
+	tests := []struct {
+		name            string
+		subject         digest.Digest
+		artifactType    string
+		expectedFilters string
+		expectedDgsts   []digest.Digest
+		fromClient      bool
+	}{
+		{
+			name:          "all referrers",
+			subject:       subject,
+			expectedDgsts: []digest.Digest{signature, sbom},
+		},
+		{
+			name:          "unknown subject from client without peers",
+			subject:       digest.FromString("foo"),
+			expectedDgsts: []digest.Digest{},
+			fromClient:    true,
+		},
+		{
+			name:            "filtered by artifact type",
+			subject:         subject,
+			artifactType:    "application/spdx+json",
+			expectedDgsts:   []digest.Digest{sbom},
+			expectedFilters: "artifactType",
+		},
+		{
+			name:            "no matching artifact type",
+			subject:         subject,
+			artifactType:    "application/foo",
+			expectedDgsts:   []digest.Digest{},
+			expectedFilters: "artifactType",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			target := fmt.Sprintf("http://example.com/v2/foo/bar/referrers/%s", tt.subject)
+			if tt.artifactType != "" {
+				target = fmt.Sprintf("%s?artifactType=%s", target, url.QueryEscape(tt.artifactType))
+			}
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			if !tt.fromClient {
+				req.Header.Set(ViaHeaderKey, "peer")
+			}
+			m, err := mux.NewServeMux(reg.handle)
+			require.NoError(t, err)
+			m.ServeHTTP(rw, req)
+
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, ocispec.MediaTypeImageIndex, resp.Header.Get("Content-Type"))
+			require.Equal(t, tt.expectedFilters, resp.Header.Get("OCI-Filters-Applied"))
+			idx := ocispec.Index{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&idx))
+			require.Equal(t, 2, idx.SchemaVersion)
+			dgsts := []digest.Digest{}
+			for _, desc := range idx.Manifests {
+				dgsts = append(dgsts, desc.Digest)
+				switch desc.Digest {
+				case signature:
+					require.Equal(t, "application/vnd.dev.cosign.artifact.sig.v1+json", desc.ArtifactType)
+				case sbom:
+					require.Equal(t, "application/spdx+json", desc.ArtifactType)
+					require.Equal(t, map[string]string{"foo": "bar"}, desc.Annotations)
+				}
+			}
+			require.ElementsMatch(t, tt.expectedDgsts, dgsts)
+		})
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	t.Parallel()
+
+	reg := NewRegistry(oci.NewMockClient(nil), routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}))
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		expectedCode   mux.ErrorCode
+		expectedStatus int
+	}{
+		{
+			name:           "missing blob",
+			method:         http.MethodGet,
+			path:           "/v2/foo/bar/blobs/sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   mux.ErrorCodeBlobUnknown,
+		},
+		{
+			name:           "tag without registry",
+			method:         http.MethodGet,
+			path:           "/v2/foo/bar/manifests/latest",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   mux.ErrorCodeNameInvalid,
+		},
+		{
+			name:           "unknown path",
+			method:         http.MethodGet,
+			path:           "/v2/foo/bar/uploads/",
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   mux.ErrorCodeUnsupported,
+		},
+		{
+			name:           "unsupported method",
+			method:         http.MethodPut,
+			path:           "/v2/foo/bar/manifests/latest",
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedCode:   mux.ErrorCodeUnsupported,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "http://example.com"+tt.path, nil)
+			req.Header.Set(ViaHeaderKey, "peer")
+			m, err := mux.NewServeMux(reg.handle)
+			require.NoError(t, err)
+			m.ServeHTTP(rw, req)
+
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			errResp := struct {
+				Errors []struct {
+					Code    mux.ErrorCode `json:"code"`
+					Message string        `json:"message"`
+				} `json:"errors"`
+			}{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+			require.Len(t, errResp.Errors, 1)
+			require.Equal(t, tt.expectedCode, errResp.Errors[0].Code)
+			require.NotEmpty(t, errResp.Errors[0].Message)
+		})
+	}
+}
+
 func TestGetClientIP(t *testing.T) {
 	t.Parallel()
 
@@ -173,3 +806,50 @@ func TestGetClientIP(t *testing.T) {
 		})
 	}
 }
+
+func TestGetRemoteIP(t *testing.T) {
+	t.Parallel()
+
+	req := &http.Request{
+		RemoteAddr: "127.0.0.1:9090",
+		Header: http.Header{
+			"X-Forwarded-For": []string{"10.0.0.1"},
+		},
+	}
+	require.Equal(t, "127.0.0.1", getRemoteIP(req))
+}
+
+func TestIsExternalRequest(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		host     string
+		expected bool
+	}{
+		{
+			name:     "local address",
+			host:     "10.0.0.1:30020",
+			expected: false,
+		},
+		{
+			name:     "local mirror host used with TLS",
+			host:     "localhost:30020",
+			expected: false,
+		},
+		{
+			name:     "other node",
+			host:     "10.0.0.2:30020",
+			expected: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			reg := NewRegistry(nil, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}), WithLocalAddress("10.0.0.1:30020"), WithLocalHosts([]string{"localhost:30020"}))
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("https://%s/v2/", tt.host), nil)
+			require.Equal(t, tt.expected, reg.isExternalRequest(req))
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+
+	"github.com/spegel-org/spegel/pkg/metrics"
+)
+
+var errResumeFailed = errors.New("could not resume blob from another mirror")
+
+// canResume returns true if the blob response can be continued from another peer if the peer fails.
+func canResume(req *http.Request, ref reference, resp *http.Response) bool {
+	if req.Method != http.MethodGet || ref.kind != referenceKindBlob || ref.dgst == "" {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true
+	case http.StatusPartialContent:
+		// Multi range responses are not supported.
+		_, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		return ok
+	default:
+		return false
+	}
+}
+
+// resumableBody reads the blob from another peer, continuing from the offset already read,
+// if the peer fails while the body is being read.
+type resumableBody struct {
+	rc     io.ReadCloser
+	resume func(failed netip.AddrPort, offset int64) (io.ReadCloser, netip.AddrPort, error)
+	peer   netip.AddrPort
+	offset int64
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	b.offset += int64(n)
+	if err == nil || errors.Is(err, io.EOF) {
+		return n, err
+	}
+	rc, peer, resumeErr := b.resume(b.peer, b.offset)
+	if resumeErr != nil {
+		return n, errors.Join(err, resumeErr)
+	}
+	b.rc.Close()
+	b.rc = rc
+	b.peer = peer
+	return n, nil
+}
+
+func (b *resumableBody) Close() error {
+	return b.rc.Close()
+}
+
+// resumeBody wraps the response body so that the blob is continued from another peer if the peer fails.
+func (r *Registry) resumeBody(req *http.Request, ref reference, resp *http.Response, peer netip.AddrPort, isExternal bool, log logr.Logger) io.ReadCloser {
+	start, end := int64(0), resp.ContentLength-1
+	if resp.StatusCode == http.StatusPartialContent {
+		start, end, _ = parseContentRange(resp.Header.Get("Content-Range"))
+	}
+	return &resumableBody{
+		rc:   resp.Body,
+		peer: peer,
+		resume: func(failed netip.AddrPort, offset int64) (io.ReadCloser, netip.AddrPort, error) {
+			if req.Context().Err() != nil {
+				return nil, netip.AddrPort{}, req.Context().Err()
+			}
+			r.peerHealth.recordFailure(failed)
+			log.Info("mirror failed during transfer, resuming from another mirror", "peer", failed.String(), "offset", offset)
+			rc, peer, err := r.fetchRemainder(req, ref, failed, start+offset, end, isExternal)
+			if err != nil {
+				return nil, netip.AddrPort{}, fmt.Errorf("%w: %w", errResumeFailed, err)
+			}
+			metrics.MirrorResumesTotal.Inc()
+			return rc, peer, nil
+		},
+	}
+}
+
+// refetchBlob returns a function which requests the complete blob from a peer other than the peer, used
+// when the content from the peer does not match the digest. Nil is returned if the blob can not be requested again.
+func (r *Registry) refetchBlob(req *http.Request, ref reference, resp *http.Response, peer netip.AddrPort, isExternal bool, log logr.Logger) func() (io.ReadCloser, error) {
+	if resp.StatusCode != http.StatusOK || !canResume(req, ref, resp) {
+		return nil
+	}
+	return func() (io.ReadCloser, error) {
+		log.Info("mirror served content not matching digest, fetching blob from another mirror", "peer", peer.String())
+		rc, _, err := r.fetchRemainder(req, ref, peer, 0, resp.ContentLength-1, isExternal)
+		if err != nil {
+			return nil, err
+		}
+		return r.limitIngress(rc), nil
+	}
+}
+
+// fetchRemainder requests the bytes from start to end of the blob from a peer other than the failed peer.
+// The end is unknown when negative, in which case the rest of the blob is requested.
+func (r *Registry) fetchRemainder(req *http.Request, ref reference, failed netip.AddrPort, start, end int64, isExternal bool) (io.ReadCloser, netip.AddrPort, error) {
+	resolveCtx, cancel := context.WithTimeout(req.Context(), r.resolveTimeout)
+	defer cancel()
+	peerCh, err := r.router.Resolve(resolveCtx, ref.key(), isExternal, r.resolveRetries+1)
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+	byteRange := fmt.Sprintf("bytes=%d-", start)
+	if end >= 0 {
+		byteRange = fmt.Sprintf("bytes=%d-%d", start, end)
+	}
+	errs := []error{}
+	for _, peer := range collectPeers(resolveCtx, peerCh, r.resolveRetries+1) {
+		if peer == failed || r.mismatchedPeers.contains(ref.key(), peer) || !r.peerHealth.allow(peer) {
+			continue
+		}
+		rangeReq := peerRequest(req.Context(), req, peer)
+		rangeReq.Header.Set("Range", byteRange)
+		rangeReq.Header.Del("If-Range")
+		resp, err := r.roundTripper().RoundTrip(rangeReq)
+		if err != nil {
+			r.peerHealth.recordFailure(peer)
+			errs = append(errs, err)
+			continue
+		}
+		respStart, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if resp.StatusCode != http.StatusPartialContent || !ok || respStart != start {
+			resp.Body.Close()
+			if !isBusyResponse(resp) {
+				r.peerHealth.recordFailure(peer)
+			}
+			errs = append(errs, fmt.Errorf("expected mirror to respond with 206 Partial Content from byte %d but received: %s", start, resp.Status))
+			continue
+		}
+		return resp.Body, peer, nil
+	}
+	errs = append(errs, errors.New("no other mirror could serve the remaining content"))
+	return nil, netip.AddrPort{}, errors.Join(errs...)
+}
+
+// parseContentRange returns the first and last byte of a single range content range header.
+func parseContentRange(v string) (int64, int64, bool) {
+	v, ok := strings.CutPrefix(v, "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+	byteRange, _, ok := strings.Cut(v, "/")
+	if !ok {
+		return 0, 0, false
+	}
+	startStr, endStr, ok := strings.Cut(byteRange, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	end, err := strconv.ParseInt(endStr, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, end, true
+}
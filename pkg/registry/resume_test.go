@@ -0,0 +1,146 @@
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/spegel-org/spegel/internal/mux"
+	"github.com/spegel-org/spegel/pkg/oci"
+	"github.com/spegel-org/spegel/pkg/routing"
+)
+
+func TestMirrorHandlerResume(t *testing.T) {
+	t.Parallel()
+
+	blob := bytes.Repeat([]byte("hello world"), 100000)
+	ociClient := oci.NewMockClient(nil)
+	dgst := ociClient.AddBlob(blob)
+	failingSvr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Length", strconv.FormatInt(int64(len(blob)), 10))
+		status := http.StatusOK
+		if req.Header.Get("Range") != "" {
+			rw.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(blob)-1, len(blob)))
+			status = http.StatusPartialContent
+		}
+		rw.WriteHeader(status)
+		//nolint:errcheck // ignore
+		rw.Write(blob[:len(blob)/2])
+		if flusher, ok := rw.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		panic(http.ErrAbortHandler)
+	}))
+	t.Cleanup(func() {
+		failingSvr.Close()
+	})
+	peerReg := NewRegistry(ociClient, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}))
+	peerMux, err := mux.NewServeMux(peerReg.handle)
+	require.NoError(t, err)
+	peerSvr := httptest.NewServer(peerMux)
+	t.Cleanup(func() {
+		peerSvr.Close()
+	})
+
+	tests := []struct {
+		name           string
+		rangeHeader    string
+		expectedBody   []byte
+		expectedStatus int
+	}{
+		{
+			name:           "full blob",
+			expectedStatus: http.StatusOK,
+			expectedBody:   blob,
+		},
+		{
+			name:           "range request",
+			rangeHeader:    "bytes=0-",
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   blob,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resolver := map[string][]netip.AddrPort{
+				dgst.String(): {
+					netip.MustParseAddrPort(failingSvr.Listener.Addr().String()),
+					netip.MustParseAddrPort(peerSvr.Listener.Addr().String()),
+				},
+			}
+			reg := NewRegistry(nil, routing.NewMemoryRouter(resolver, netip.AddrPort{}))
+			m, err := mux.NewServeMux(reg.handle)
+			require.NoError(t, err)
+			srv := httptest.NewServer(m)
+			t.Cleanup(func() {
+				srv.Close()
+			})
+
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/foo/bar/blobs/%s", srv.URL, dgst.String()), nil)
+			require.NoError(t, err)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			resp, err := srv.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			require.Equal(t, tt.expectedBody, b)
+		})
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		value         string
+		expectedStart int64
+		expectedEnd   int64
+		expectedOk    bool
+	}{
+		{
+			name:          "single range",
+			value:         "bytes 10-19/100",
+			expectedStart: 10,
+			expectedEnd:   19,
+			expectedOk:    true,
+		},
+		{
+			name:          "unknown size",
+			value:         "bytes 0-9/*",
+			expectedStart: 0,
+			expectedEnd:   9,
+			expectedOk:    true,
+		},
+		{
+			name:  "unsatisfied range",
+			value: "bytes */100",
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			start, end, ok := parseContentRange(tt.value)
+			require.Equal(t, tt.expectedOk, ok)
+			require.Equal(t, tt.expectedStart, start)
+			require.Equal(t, tt.expectedEnd, end)
+		})
+	}
+}
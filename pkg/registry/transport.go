@@ -0,0 +1,109 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/spegel-org/spegel/pkg/metrics"
+)
+
+// peerTransportConfig configures the transport used for requests to peers.
+type peerTransportConfig struct {
+	tlsConfig             *tls.Config
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	keepAlive             time.Duration
+	maxIdleConnsPerPeer   int
+	http2                 bool
+}
+
+func defaultPeerTransportConfig() peerTransportConfig {
+	return peerTransportConfig{
+		dialTimeout:         30 * time.Second,
+		tlsHandshakeTimeout: 10 * time.Second,
+		keepAlive:           30 * time.Second,
+		maxIdleConnsPerPeer: http.DefaultMaxIdleConnsPerHost,
+	}
+}
+
+// newPeerTransport returns a transport for requests to peers. HTTP/2 is negotiated during the TLS
+// handshake when TLS is enabled, otherwise HTTP/2 is used without TLS (h2c).
+func newPeerTransport(cfg peerTransportConfig) http.RoundTripper {
+	dialer := &net.Dialer{
+		Timeout:   cfg.dialTimeout,
+		KeepAlive: cfg.keepAlive,
+	}
+	if cfg.http2 && cfg.tlsConfig == nil {
+		transport := &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			ReadIdleTimeout: cfg.keepAlive,
+		}
+		return &headerTimeoutTransport{
+			rt:      transport,
+			timeout: cfg.responseHeaderTimeout,
+		}
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       cfg.tlsConfig,
+		ForceAttemptHTTP2:     cfg.http2,
+		TLSHandshakeTimeout:   cfg.tlsHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.responseHeaderTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   cfg.maxIdleConnsPerPeer,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// headerTimeoutTransport cancels requests which have not received response headers within the timeout.
+type headerTimeoutTransport struct {
+	rt      http.RoundTripper
+	timeout time.Duration
+}
+
+func (h *headerTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if h.timeout <= 0 {
+		return h.rt.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(h.timeout, cancel)
+	resp, err := h.rt.RoundTrip(req.WithContext(ctx))
+	timedOut := !timer.Stop()
+	if err != nil {
+		cancel()
+		if timedOut && req.Context().Err() == nil {
+			return nil, fmt.Errorf("timeout awaiting response headers after %s: %w", h.timeout, err)
+		}
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// connReuseTransport records if requests to peers reuse existing connections.
+type connReuseTransport struct {
+	rt http.RoundTripper
+}
+
+func (c *connReuseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			metrics.PeerConnectionsTotal.WithLabelValues(strconv.FormatBool(info.Reused)).Inc()
+		},
+	}
+	return c.rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
@@ -0,0 +1,92 @@
+package registry
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/spegel-org/spegel/pkg/oci"
+	"github.com/spegel-org/spegel/pkg/routing"
+)
+
+func TestPeerTransportHTTP2(t *testing.T) {
+	t.Parallel()
+
+	ociClient := oci.NewMockClient(nil)
+	dgst := ociClient.AddBlob([]byte("hello world"))
+	peerReg := NewRegistry(ociClient, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}))
+	peerSrv, err := peerReg.Server("")
+	require.NoError(t, err)
+	protoCh := make(chan string, 1)
+	peerSvr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case protoCh <- req.Proto:
+		default:
+		}
+		peerSrv.Handler.ServeHTTP(rw, req)
+	}))
+	t.Cleanup(func() {
+		peerSvr.Close()
+	})
+
+	resolver := map[string][]netip.AddrPort{
+		dgst.String(): {netip.MustParseAddrPort(peerSvr.Listener.Addr().String())},
+	}
+	reg := NewRegistry(nil, routing.NewMemoryRouter(resolver, netip.AddrPort{}), WithHTTP2(true))
+	srv, err := reg.Server("")
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://example.com/v2/foo/bar/blobs/%s", dgst.String()), nil)
+	srv.Handler.ServeHTTP(rw, req)
+	resp := rw.Result()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "hello world", string(b))
+	require.Equal(t, "HTTP/2.0", <-protoCh)
+}
+
+func TestHeaderTimeoutTransport(t *testing.T) {
+	t.Parallel()
+
+	svr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			select {
+			case <-req.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		}
+		//nolint:errcheck // ignore
+		rw.Write([]byte("hello world"))
+	}))
+	t.Cleanup(func() {
+		svr.Close()
+	})
+	client := &http.Client{
+		Transport: &headerTimeoutTransport{
+			rt:      http.DefaultTransport,
+			timeout: 100 * time.Millisecond,
+		},
+	}
+
+	resp, err := client.Get(svr.URL + "/fast")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(b))
+
+	resp, err = client.Get(svr.URL + "/slow")
+	if err == nil {
+		resp.Body.Close()
+	}
+	require.ErrorContains(t, err, "timeout awaiting response headers after 100ms")
+}
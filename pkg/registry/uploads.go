@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/spegel-org/spegel/pkg/metrics"
+)
+
+const (
+	// uploadQueueTimeout is how long a blob request waits for a free upload slot before being rejected.
+	uploadQueueTimeout = 1 * time.Second
+	// uploadRetryAfter is the amount of seconds rejected requests are told to wait before retrying.
+	uploadRetryAfter = "1"
+)
+
+// errMirrorBusy is returned when a mirror rejects a request as it is serving its max concurrent uploads.
+var errMirrorBusy = errors.New("mirror is busy")
+
+// isBusyResponse returns true if the response is returned by a mirror serving its max concurrent uploads.
+// Other unavailable responses do not have a Retry-After header and are treated as failures.
+func isBusyResponse(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != ""
+}
+
+// uploadLimiter limits the amount of blobs served at the same time.
+type uploadLimiter struct {
+	slots chan struct{}
+}
+
+func newUploadLimiter(maxUploads int) *uploadLimiter {
+	return &uploadLimiter{
+		slots: make(chan struct{}, maxUploads),
+	}
+}
+
+// acquire waits for a free upload slot and returns false if none became free in time.
+func (u *uploadLimiter) acquire(ctx context.Context) bool {
+	select {
+	case u.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	metrics.BlobUploadsQueued.Inc()
+	defer metrics.BlobUploadsQueued.Dec()
+	timer := time.NewTimer(uploadQueueTimeout)
+	defer timer.Stop()
+	select {
+	case u.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+	metrics.BlobUploadsRejectedTotal.Inc()
+	return false
+}
+
+func (u *uploadLimiter) release() {
+	<-u.slots
+}
@@ -0,0 +1,275 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/spegel-org/spegel/internal/mux"
+	"github.com/spegel-org/spegel/pkg/oci"
+)
+
+// upstreamHeaders are the response headers which are copied from the upstream registry.
+var upstreamHeaders = []string{
+	"Accept-Ranges",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"Docker-Content-Digest",
+	"ETag",
+}
+
+// canPullThrough returns true if the request can be fetched from the original registry. The original
+// registry is set by the client, so only configured registries are allowed to stop requests to arbitrary hosts.
+func (r *Registry) canPullThrough(ref reference) bool {
+	if !r.pullThrough {
+		return false
+	}
+	_, ok := r.upstreamURL(ref.originalRegistry)
+	return ok
+}
+
+// upstreamURL returns the configured URL of the registry, which decides the scheme used to pull through.
+func (r *Registry) upstreamURL(registry string) (url.URL, bool) {
+	i := slices.IndexFunc(r.upstreams, func(u url.URL) bool {
+		return u.Host == registry
+	})
+	if i == -1 {
+		return url.URL{}, false
+	}
+	return r.upstreams[i], true
+}
+
+// handlePullThrough fetches the content from the original registry when no peer is able to serve it.
+// The content is streamed to the client while it is written to the local content store. Once written
+// the content is advertised so that other nodes can fetch it from this node instead of the original registry.
+// An error is only returned if the response has not been written to.
+func (r *Registry) handlePullThrough(rw mux.ResponseWriter, req *http.Request, ref reference) error {
+	upstream, ok := r.upstreamURL(ref.originalRegistry)
+	if !ok {
+		return fmt.Errorf("registry %s is not mirrored", ref.originalRegistry)
+	}
+	u := &url.URL{
+		Scheme: upstream.Scheme,
+		Host:   upstreamHost(ref.originalRegistry),
+		Path:   req.URL.Path,
+	}
+	upReq, err := http.NewRequestWithContext(req.Context(), req.Method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	// The via header is not passed on as it contains the addresses of nodes. Credentials are only sent
+	// to the configured registry, as they are removed when redirected to another host.
+	for _, k := range []string{"Accept", "Authorization", "Range", "User-Agent"} {
+		if v := req.Header.Values(k); len(v) > 0 {
+			upReq.Header[k] = v
+		}
+	}
+	resp, err := r.doUpstream(upReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("expected upstream registry to respond with 200 OK or 206 Partial Content but received: %s", resp.Status)
+	}
+
+	for _, k := range upstreamHeaders {
+		if v := resp.Header.Values(k); len(v) > 0 {
+			rw.Header()[k] = v
+		}
+	}
+	rw.WriteHeader(resp.StatusCode)
+	if req.Method == http.MethodHead {
+		return nil
+	}
+
+	// Only complete responses can be stored, partial content and referrers are only passed through to the client.
+	var bw oci.BlobWriter
+	var desc ocispec.Descriptor
+	if resp.StatusCode == http.StatusOK && ref.kind != referenceKindReferrers {
+		desc, err = upstreamDescriptor(ref, resp)
+		if err == nil {
+			bw, err = r.newBlobWriter(req.Context(), desc)
+		}
+		if err != nil {
+			r.log.V(4).Info("pulled through content will not be stored", "reason", err.Error())
+		}
+	}
+	if bw == nil {
+		_, err = io.Copy(rw, resp.Body)
+		if err != nil {
+			r.log.Error(err, "error occurred when copying upstream content")
+		}
+		return nil
+	}
+	defer bw.Close()
+
+	sw := &storeWriter{writer: bw}
+	_, err = io.Copy(rw, io.TeeReader(resp.Body, sw))
+	if err != nil {
+		r.log.Error(err, "error occurred when copying upstream content")
+		return nil
+	}
+	if sw.err != nil {
+		r.log.Error(sw.err, "could not store pulled through content", "digest", desc.Digest.String())
+		return nil
+	}
+	err = bw.Commit(req.Context())
+	if err != nil {
+		r.log.Error(err, "could not commit pulled through content", "digest", desc.Digest.String())
+		return nil
+	}
+	// Content in the store is not part of any image yet, so it has to be advertised directly and
+	// kept advertised for as long as it is stored.
+	if r.contentKeys != nil {
+		r.contentKeys.Add(desc.Digest)
+	}
+	err = r.router.Advertise(req.Context(), []string{desc.Digest.String()})
+	if err != nil {
+		r.log.Error(err, "could not advertise pulled through content", "digest", desc.Digest.String())
+		return nil
+	}
+	r.log.V(4).Info("stored and advertised pulled through content", "digest", desc.Digest.String())
+	return nil
+}
+
+func (r *Registry) newBlobWriter(ctx context.Context, desc ocispec.Descriptor) (oci.BlobWriter, error) { //nolint: ireturn // Return type depends on the OCI client.
+	cw, ok := r.ociClient.(oci.ContentWriter)
+	if !ok {
+		return nil, fmt.Errorf("OCI client %s does not support writing content", r.ociClient.Name())
+	}
+	return cw.NewBlobWriter(ctx, desc)
+}
+
+// doUpstream sends the request to the upstream registry. Requests rejected with a bearer
+// challenge are retried with an anonymous token as described by the token authentication spec.
+// https://distribution.github.io/distribution/spec/auth/token/
+func (r *Registry) doUpstream(req *http.Request) (*http.Response, error) {
+	client := &http.Client{Transport: r.upstreamTransport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized || req.Header.Get("Authorization") != "" {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	token, err := fetchToken(req.Context(), client, challenge)
+	if err != nil {
+		return nil, err
+	}
+	authReq := req.Clone(req.Context())
+	authReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	return client.Do(authReq)
+}
+
+var challengeParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+func fetchToken(ctx context.Context, client *http.Client, challenge string) (string, error) {
+	scheme, params, ok := strings.Cut(challenge, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", fmt.Errorf("unsupported authentication challenge: %s", challenge)
+	}
+	values := url.Values{}
+	realm := ""
+	for _, comps := range challengeParamRegex.FindAllStringSubmatch(params, -1) {
+		if comps[1] == "realm" {
+			realm = comps[2]
+			continue
+		}
+		values.Set(comps[1], comps[2])
+	}
+	if realm == "" {
+		return "", errors.New("authentication challenge is missing realm")
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery = values.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("expected token request to respond with 200 OK but received: %s", resp.Status)
+	}
+	tokenResp := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
+	if err != nil {
+		return "", err
+	}
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	if tokenResp.AccessToken != "" {
+		return tokenResp.AccessToken, nil
+	}
+	return "", errors.New("token response does not contain a token")
+}
+
+// upstreamDescriptor returns the descriptor of the content in the response which will be stored.
+func upstreamDescriptor(ref reference, resp *http.Response) (ocispec.Descriptor, error) {
+	if resp.ContentLength < 0 {
+		return ocispec.Descriptor{}, errors.New("upstream response does not have a content length")
+	}
+	dgst := ref.dgst
+	if dgst == "" {
+		var err error
+		dgst, err = digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("could not determine digest of upstream content: %w", err)
+		}
+	}
+	mediaType := resp.Header.Get("Content-Type")
+	if ref.kind == referenceKindBlob {
+		mediaType = "application/octet-stream"
+	}
+	return ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      resp.ContentLength,
+	}, nil
+}
+
+// upstreamHost returns the host of the original registry API.
+func upstreamHost(registry string) string {
+	if registry == "docker.io" {
+		return "registry-1.docker.io"
+	}
+	return registry
+}
+
+// storeWriter writes to the content store without ever failing, as failing
+// to store content should not stop the content from being served.
+type storeWriter struct {
+	writer io.Writer
+	err    error
+}
+
+func (s *storeWriter) Write(b []byte) (int, error) {
+	if s.err == nil {
+		_, s.err = s.writer.Write(b)
+	}
+	return len(b), nil
+}
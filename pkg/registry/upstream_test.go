@@ -0,0 +1,202 @@
+package registry
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spegel-org/spegel/internal/mux"
+	"github.com/spegel-org/spegel/pkg/oci"
+	"github.com/spegel-org/spegel/pkg/routing"
+	"github.com/spegel-org/spegel/pkg/state"
+)
+
+func TestPullThrough(t *testing.T) {
+	t.Parallel()
+
+	blob := []byte("hello world")
+	blobDgst := digest.FromBytes(blob)
+	manifest := []byte(fmt.Sprintf(`{"mediaType":%q}`, ocispec.MediaTypeImageManifest))
+	manifestDgst := digest.FromBytes(manifest)
+
+	upstreamSvr := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			if req.URL.Query().Get("service") != "test" || req.URL.Query().Get("scope") != "repository:foo/bar:pull" {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			//nolint:errcheck // ignore
+			rw.Write([]byte(`{"token": "secret"}`))
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			rw.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="test",scope="repository:foo/bar:pull"`, req.Host))
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case fmt.Sprintf("/v2/foo/bar/blobs/%s", blobDgst):
+			//nolint:errcheck // ignore
+			rw.Write(blob)
+		case "/v2/foo/bar/manifests/v1":
+			rw.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+			rw.Header().Set("Docker-Content-Digest", manifestDgst.String())
+			//nolint:errcheck // ignore
+			rw.Write(manifest)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(func() {
+		upstreamSvr.Close()
+	})
+	upstreamURL, err := url.Parse(upstreamSvr.URL)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedDgst   digest.Digest
+		ns             string
+		expectedBody   []byte
+		pullThrough    bool
+		expectedStatus int
+	}{
+		{
+			name:           "blob is pulled through and stored",
+			path:           fmt.Sprintf("/v2/foo/bar/blobs/%s", blobDgst),
+			pullThrough:    true,
+			expectedStatus: http.StatusOK,
+			expectedBody:   blob,
+			expectedDgst:   blobDgst,
+		},
+		{
+			name:           "manifest tag is pulled through and stored",
+			path:           "/v2/foo/bar/manifests/v1",
+			pullThrough:    true,
+			expectedStatus: http.StatusOK,
+			expectedBody:   manifest,
+			expectedDgst:   manifestDgst,
+		},
+		{
+			name:           "missing content in upstream",
+			path:           fmt.Sprintf("/v2/foo/bar/blobs/%s", digest.FromString("foo")),
+			pullThrough:    true,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "registry not mirrored",
+			path:           fmt.Sprintf("/v2/foo/bar/blobs/%s", blobDgst),
+			ns:             "example.com",
+			pullThrough:    true,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "pull through disabled",
+			path:           fmt.Sprintf("/v2/foo/bar/blobs/%s", blobDgst),
+			pullThrough:    false,
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ociClient := oci.NewMockClient(nil)
+			router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("127.0.0.1:5000"))
+			opts := []Option{
+				WithPullThrough(tt.pullThrough),
+				WithPullThroughRegistries([]url.URL{*upstreamURL}),
+				WithContentKeys(state.NewContentKeys()),
+				WithUpstreamTransport(upstreamSvr.Client().Transport),
+			}
+			reg := NewRegistry(ociClient, router, opts...)
+
+			ns := tt.ns
+			if ns == "" {
+				ns = upstreamURL.Host
+			}
+			target := fmt.Sprintf("http://example.com%s?ns=%s", tt.path, ns)
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			m, err := mux.NewServeMux(reg.handle)
+			require.NoError(t, err)
+			m.ServeHTTP(rw, req)
+
+			resp := rw.Result()
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			require.Equal(t, tt.expectedBody, b)
+
+			rc, err := ociClient.GetBlob(req.Context(), tt.expectedDgst)
+			require.NoError(t, err)
+			defer rc.Close()
+			stored, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedBody, stored)
+			peers, ok := router.Lookup(tt.expectedDgst.String())
+			require.True(t, ok)
+			require.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:5000")}, peers)
+		})
+	}
+}
+
+func TestPullThroughPlainHTTP(t *testing.T) {
+	t.Parallel()
+
+	blob := []byte("hello world")
+	blobDgst := digest.FromBytes(blob)
+	upstreamSvr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// Addresses of nodes in the via header are not sent to the upstream.
+		if req.Header.Get(ViaHeaderKey) != "" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.URL.Path != fmt.Sprintf("/v2/foo/bar/blobs/%s", blobDgst) {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		//nolint:errcheck // ignore
+		rw.Write(blob)
+	}))
+	t.Cleanup(func() {
+		upstreamSvr.Close()
+	})
+	upstreamURL, err := url.Parse(upstreamSvr.URL)
+	require.NoError(t, err)
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("127.0.0.1:5000"))
+	reg := NewRegistry(oci.NewMockClient(nil), router, WithPullThrough(true), WithPullThroughRegistries([]url.URL{*upstreamURL}))
+	m, err := mux.NewServeMux(reg.handle)
+	require.NoError(t, err)
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://example.com/v2/foo/bar/blobs/%s?ns=%s", blobDgst, upstreamURL.Host), nil)
+	m.ServeHTTP(rw, req)
+
+	resp := rw.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, blob, b)
+}
+
+func TestUpstreamHost(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "registry-1.docker.io", upstreamHost("docker.io"))
+	require.Equal(t, "ghcr.io", upstreamHost("ghcr.io"))
+}
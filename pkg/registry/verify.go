@@ -0,0 +1,200 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// maxManifestSize is the largest manifest which will be buffered for verification.
+	maxManifestSize = 4 * 1024 * 1024
+	// mismatchedPeerExpiration is how long a peer is skipped after serving content not matching its digest.
+	mismatchedPeerExpiration = 10 * time.Minute
+)
+
+var errDigestMismatch = errors.New("content does not match digest")
+
+// verifyResponse verifies that the content of the mirror response matches the requested digest.
+// Manifests are buffered and verified before being proxied. Blob content is verified while it is
+// streamed, withholding the last bytes if the content does not match. The blob is then fetched
+// again with refetch, if set, and passed on from the other source if the content already passed on
+// matches. Partial content, referrers and references which are not valid digests are not verified.
+func verifyResponse(req *http.Request, ref reference, resp *http.Response, onMismatch func(error), refetch func() (io.ReadCloser, error)) error {
+	// Referrers are listed for a subject digest which is not the digest of the response.
+	if resp.StatusCode != http.StatusOK || ref.kind == referenceKindReferrers {
+		return nil
+	}
+
+	dgst := ref.dgst
+	if v := resp.Header.Get("Docker-Content-Digest"); v != "" {
+		headerDgst, err := digest.Parse(v)
+		if err != nil {
+			return fmt.Errorf("mirror responded with invalid digest header: %w", err)
+		}
+		if dgst != "" && headerDgst != dgst {
+			return fmt.Errorf("mirror responded with digest %s when %s was requested: %w", headerDgst, dgst, errDigestMismatch)
+		}
+		dgst = headerDgst
+	}
+	if dgst == "" {
+		return errors.New("mirror response for manifest tag is missing digest header")
+	}
+	if dgst.Validate() != nil || req.Method == http.MethodHead {
+		return nil
+	}
+
+	if ref.kind == referenceKindManifest {
+		b, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if len(b) > maxManifestSize {
+			return fmt.Errorf("manifest is larger than max size %d", maxManifestSize)
+		}
+		if dgst.Algorithm().FromBytes(b) != dgst {
+			return fmt.Errorf("manifest from mirror does not match digest %s: %w", dgst, errDigestMismatch)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(b))
+		return nil
+	}
+
+	resp.Body = &verifyReader{
+		rc:         resp.Body,
+		br:         bufio.NewReader(resp.Body),
+		dgst:       dgst,
+		verifier:   dgst.Verifier(),
+		passed:     dgst.Algorithm().Digester(),
+		size:       resp.ContentLength,
+		onMismatch: onMismatch,
+		refetch:    refetch,
+	}
+	return nil
+}
+
+// verifyReader verifies the content read while it is being read.
+type verifyReader struct {
+	rc         io.ReadCloser
+	br         *bufio.Reader
+	verifier   digest.Verifier
+	passed     digest.Digester
+	onMismatch func(error)
+	refetch    func() (io.ReadCloser, error)
+	dgst       digest.Digest
+	size       int64
+	read       int64
+	verified   bool
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.br.Read(p)
+	//nolint:errcheck // Writing to a hash never returns an error.
+	v.verifier.Write(p[:n])
+	v.read += int64(n)
+	complete := errors.Is(err, io.EOF) || (v.size >= 0 && v.read >= v.size)
+	if !complete && err == nil && v.size < 0 && !v.verified {
+		// Without a known size the next byte is peeked to know if these are the last bytes.
+		_, peekErr := v.br.Peek(1)
+		complete = errors.Is(peekErr, io.EOF)
+	}
+	if !complete || v.verified {
+		//nolint:errcheck // Writing to a hash never returns an error.
+		v.passed.Hash().Write(p[:n])
+		return n, err
+	}
+	if !v.verifier.Verified() {
+		// The last bytes are withheld so that the client never receives the complete content.
+		mismatchErr := fmt.Errorf("blob from mirror does not match digest %s: %w", v.dgst, errDigestMismatch)
+		v.onMismatch(mismatchErr)
+		if v.refetch == nil {
+			return 0, mismatchErr
+		}
+		refetchErr := v.switchSource(v.read - int64(n))
+		if refetchErr != nil {
+			return 0, errors.Join(mismatchErr, refetchErr)
+		}
+		return v.Read(p)
+	}
+	v.verified = true
+	//nolint:errcheck // Writing to a hash never returns an error.
+	v.passed.Hash().Write(p[:n])
+	return n, err
+}
+
+// switchSource continues reading the blob from a new source. The new source is only used if the bytes
+// which have already been passed on match, as they can not be taken back. Only a single switch is made.
+func (v *verifyReader) switchSource(passed int64) error {
+	refetch := v.refetch
+	v.refetch = nil
+	rc, err := refetch()
+	if err != nil {
+		return err
+	}
+	verifier := v.dgst.Verifier()
+	prefix := v.dgst.Algorithm().Digester()
+	_, err = io.CopyN(io.MultiWriter(verifier, prefix.Hash()), rc, passed)
+	if err != nil {
+		rc.Close()
+		return err
+	}
+	if prefix.Digest() != v.passed.Digest() {
+		rc.Close()
+		return errors.New("content already passed on does not match content from other mirror")
+	}
+	v.rc.Close()
+	v.rc = rc
+	v.br = bufio.NewReader(rc)
+	v.verifier = verifier
+	v.read = passed
+	return nil
+}
+
+func (v *verifyReader) Close() error {
+	return v.rc.Close()
+}
+
+type mismatchedPeerKey struct {
+	key  string
+	peer netip.AddrPort
+}
+
+// mismatchedPeers records peers which have served content not matching its digest,
+// so that they are skipped when the same content is requested again.
+type mismatchedPeers struct {
+	entries map[mismatchedPeerKey]time.Time
+	mx      sync.Mutex
+}
+
+func newMismatchedPeers() *mismatchedPeers {
+	return &mismatchedPeers{
+		entries: map[mismatchedPeerKey]time.Time{},
+	}
+}
+
+func (m *mismatchedPeers) add(key string, peer netip.AddrPort) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	now := time.Now()
+	for k, expires := range m.entries {
+		if now.After(expires) {
+			delete(m.entries, k)
+		}
+	}
+	m.entries[mismatchedPeerKey{key: key, peer: peer}] = now.Add(mismatchedPeerExpiration)
+}
+
+func (m *mismatchedPeers) contains(key string, peer netip.AddrPort) bool {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	expires, ok := m.entries[mismatchedPeerKey{key: key, peer: peer}]
+	return ok && time.Now().Before(expires)
+}
@@ -0,0 +1,153 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spegel-org/spegel/internal/mux"
+	"github.com/spegel-org/spegel/pkg/routing"
+)
+
+func TestMirrorVerify(t *testing.T) {
+	t.Parallel()
+
+	content := []byte("hello world")
+	dgst := digest.FromBytes(content)
+	newPeer := func(t *testing.T, body []byte, headerDgst digest.Digest, flushAt int, unknownSize bool) netip.AddrPort {
+		t.Helper()
+
+		svr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("Docker-Content-Digest", headerDgst.String())
+			if flushAt == 0 {
+				http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(body))
+				return
+			}
+			// The body is flushed in two parts so that the first part is passed on before the rest is read.
+			if !unknownSize {
+				rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			}
+			//nolint:errcheck // ignore
+			rw.Write(body[:flushAt])
+			//nolint:errcheck // ignore
+			http.NewResponseController(rw).Flush()
+			time.Sleep(50 * time.Millisecond)
+			//nolint:errcheck // ignore
+			rw.Write(body[flushAt:])
+		}))
+		t.Cleanup(func() {
+			svr.Close()
+		})
+		return netip.MustParseAddrPort(svr.Listener.Addr().String())
+	}
+
+	tests := []struct {
+		name          string
+		kind          string
+		peers         []string
+		expectAborted bool
+	}{
+		{
+			name:  "blob from first peer",
+			kind:  "blobs",
+			peers: []string{"good", "corrupt"},
+		},
+		{
+			name:  "corrupt blob is fetched from another peer",
+			kind:  "blobs",
+			peers: []string{"corrupt", "good"},
+		},
+		{
+			name:          "corrupt blob already passed on is aborted and peer is skipped on retry",
+			kind:          "blobs",
+			peers:         []string{"corrupt-passed", "good"},
+			expectAborted: true,
+		},
+		{
+			name:          "corrupt blob of unknown size already passed on is aborted",
+			kind:          "blobs",
+			peers:         []string{"corrupt-passed-unknown-size", "good"},
+			expectAborted: true,
+		},
+		{
+			name:  "blob with wrong digest header is skipped",
+			kind:  "blobs",
+			peers: []string{"wrong-header", "good"},
+		},
+		{
+			name:  "corrupt manifest is skipped",
+			kind:  "manifests",
+			peers: []string{"corrupt", "good"},
+		},
+		{
+			name:  "manifest with wrong digest header is skipped",
+			kind:  "manifests",
+			peers: []string{"wrong-header", "good"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			peers := []netip.AddrPort{}
+			for _, kind := range tt.peers {
+				switch kind {
+				case "good":
+					peers = append(peers, newPeer(t, content, dgst, 0, false))
+				case "corrupt":
+					peers = append(peers, newPeer(t, []byte("hello wOrld"), dgst, 0, false))
+				case "corrupt-passed":
+					peers = append(peers, newPeer(t, []byte("hellO world"), dgst, 5, false))
+				case "corrupt-passed-unknown-size":
+					peers = append(peers, newPeer(t, []byte("hellO world"), dgst, 5, true))
+				case "wrong-header":
+					peers = append(peers, newPeer(t, content, digest.FromString("foo"), 0, false))
+				}
+			}
+			resolver := map[string][]netip.AddrPort{
+				dgst.String(): peers,
+			}
+			reg := NewRegistry(nil, routing.NewMemoryRouter(resolver, netip.AddrPort{}))
+			m, err := mux.NewServeMux(reg.handle)
+			require.NoError(t, err)
+			svr := httptest.NewServer(m)
+			t.Cleanup(func() {
+				svr.Close()
+			})
+
+			get := func() (int, []byte, error) {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v2/foo/bar/%s/%s", svr.URL, tt.kind, dgst.String()), nil)
+				require.NoError(t, err)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					return 0, nil, err
+				}
+				defer resp.Body.Close()
+				b, err := io.ReadAll(resp.Body)
+				return resp.StatusCode, b, err
+			}
+
+			if tt.expectAborted {
+				_, b, err := get()
+				require.Error(t, err)
+				require.Less(t, len(b), len(content))
+			}
+			status, b, err := get()
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, status)
+			require.Equal(t, content, b)
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package registry
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	// ViaHeaderKey is the header containing the comma separated IDs of the nodes which have mirrored the request.
+	ViaHeaderKey = "X-Spegel-Via"
+	// MirroredHeaderKey is set to true on mirrored requests so that peers running older versions do not mirror them again.
+	//
+	// Deprecated: Use ViaHeaderKey, the header is only set for compatibility with older versions.
+	MirroredHeaderKey = "X-Spegel-Mirrored"
+)
+
+// errMirrorLoop is returned when a mirror rejects a request which it has already mirrored.
+var errMirrorLoop = errors.New("mirror has already handled request")
+
+// viaChain returns the IDs of the nodes which have mirrored the request, in the order they mirrored it.
+func viaChain(req *http.Request) []string {
+	chain := []string{}
+	for _, v := range req.Header.Values(ViaHeaderKey) {
+		for _, id := range strings.Split(v, ",") {
+			id = strings.TrimSpace(id)
+			if id == "" {
+				continue
+			}
+			chain = append(chain, id)
+		}
+	}
+	if len(chain) == 0 && req.Header.Get(MirroredHeaderKey) == "true" {
+		chain = append(chain, "unknown")
+	}
+	return chain
+}
+
+// isPeerRequest returns true if the request has been mirrored by another node.
+func isPeerRequest(req *http.Request) bool {
+	return len(viaChain(req)) > 0
+}
+
+// checkVia returns an error if the request has already been mirrored by this node or has passed the max hops.
+func (r *Registry) checkVia(chain []string) error {
+	if slices.Contains(chain, r.nodeID) {
+		return fmt.Errorf("request has already been mirrored by this node %s", r.nodeID)
+	}
+	if len(chain) > r.maxHops {
+		return fmt.Errorf("request has been mirrored %d times which is more than the max of %d hops", len(chain), r.maxHops)
+	}
+	return nil
+}
+
+// setVia sets the via header to the chain followed by the ID of this node. The mirrored header is
+// also set so that peers running older versions serve the request during rolling upgrades.
+func (r *Registry) setVia(header http.Header, chain []string) {
+	header.Set(ViaHeaderKey, strings.Join(append(slices.Clone(chain), r.nodeID), ","))
+	header.Set(MirroredHeaderKey, "true")
+}
+
+func randomNodeID() string {
+	b := make([]byte, 8)
+	//nolint:errcheck // Reading random bytes never returns an error.
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
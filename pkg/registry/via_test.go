@@ -0,0 +1,138 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/spegel-org/spegel/internal/mux"
+	"github.com/spegel-org/spegel/pkg/oci"
+	"github.com/spegel-org/spegel/pkg/routing"
+)
+
+func TestViaChain(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		headers       map[string][]string
+		expectedChain []string
+	}{
+		{
+			name:          "no header",
+			expectedChain: []string{},
+		},
+		{
+			name:          "single value",
+			headers:       map[string][]string{ViaHeaderKey: {"a, b"}},
+			expectedChain: []string{"a", "b"},
+		},
+		{
+			name:          "multiple values",
+			headers:       map[string][]string{ViaHeaderKey: {"a", "b,c"}},
+			expectedChain: []string{"a", "b", "c"},
+		},
+		{
+			name:          "legacy mirrored header",
+			headers:       map[string][]string{MirroredHeaderKey: {"true"}},
+			expectedChain: []string{"unknown"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+			for k, v := range tt.headers {
+				req.Header[k] = v
+			}
+			require.Equal(t, tt.expectedChain, viaChain(req))
+		})
+	}
+}
+
+func TestSetVia(t *testing.T) {
+	t.Parallel()
+
+	reg := NewRegistry(nil, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}), WithLocalAddress("10.0.0.1:5000"))
+	header := http.Header{}
+	reg.setVia(header, []string{"10.0.0.2:5000"})
+	require.Equal(t, "10.0.0.2:5000,10.0.0.1:5000", header.Get(ViaHeaderKey))
+	require.Equal(t, "true", header.Get(MirroredHeaderKey))
+}
+
+func TestViaLoopProtection(t *testing.T) {
+	t.Parallel()
+
+	ociClient := oci.NewMockClient(nil)
+	dgst := ociClient.AddBlob([]byte("hello world"))
+	peerReg := NewRegistry(ociClient, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}), WithLocalAddress("peer:5000"), WithMaxHops(2))
+	peerMux, err := mux.NewServeMux(peerReg.handle)
+	require.NoError(t, err)
+	peerSvr := httptest.NewServer(peerMux)
+	t.Cleanup(func() {
+		peerSvr.Close()
+	})
+	resolver := map[string][]netip.AddrPort{
+		dgst.String(): {netip.MustParseAddrPort(peerSvr.Listener.Addr().String())},
+	}
+
+	tests := []struct {
+		name           string
+		via            string
+		maxHops        int
+		expectedStatus int
+	}{
+		{
+			name:           "request from client is mirrored",
+			maxHops:        1,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "request from peer is served locally",
+			via:            "other:5000",
+			maxHops:        1,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "request from peer is mirrored when below max hops",
+			via:            "other:5000",
+			maxHops:        2,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "request which has passed max hops is rejected",
+			via:            "other:5000,another:5000",
+			maxHops:        1,
+			expectedStatus: http.StatusLoopDetected,
+		},
+		{
+			name:           "request which revisits node is rejected",
+			via:            "self:5000",
+			maxHops:        2,
+			expectedStatus: http.StatusLoopDetected,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			reg := NewRegistry(oci.NewMockClient(nil), routing.NewMemoryRouter(resolver, netip.AddrPort{}), WithLocalAddress("self:5000"), WithMaxHops(tt.maxHops))
+			m, err := mux.NewServeMux(reg.handle)
+			require.NoError(t, err)
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://self:5000/v2/foo/bar/blobs/%s", dgst.String()), nil)
+			if tt.via != "" {
+				req.Header.Set(ViaHeaderKey, tt.via)
+			}
+			m.ServeHTTP(rw, req)
+			resp := rw.Result()
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+		})
+	}
+}
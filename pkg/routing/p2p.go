@@ -22,12 +22,18 @@ import (
 	mc "github.com/multiformats/go-multicodec"
 	mh "github.com/multiformats/go-multihash"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/spegel-org/spegel/pkg/metrics"
 )
 
 const KeyTTL = 10 * time.Minute
 
+var tracer = otel.Tracer("github.com/spegel-org/spegel/pkg/routing")
+
 type P2PRouter struct {
 	bootstrapper Bootstrapper
 	host         host.Host
@@ -155,8 +161,14 @@ func (r *P2PRouter) Ready(ctx context.Context) (bool, error) {
 
 func (r *P2PRouter) Resolve(ctx context.Context, key string, allowSelf bool, count int) (<-chan netip.AddrPort, error) {
 	log := logr.FromContextOrDiscard(ctx).WithValues("host", r.host.ID().String(), "key", key)
+	ctx, span := tracer.Start(ctx, "Router.Resolve", trace.WithAttributes(
+		attribute.String("key", key),
+		attribute.Int("count", count),
+	))
 	c, err := createCid(key)
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
 		return nil, err
 	}
 	// If using unlimited retries (count=0), ensure that the peer address channel
@@ -168,9 +180,18 @@ func (r *P2PRouter) Resolve(ctx context.Context, key string, allowSelf bool, cou
 	addrCh := r.rd.FindProvidersAsync(ctx, c, count)
 	peerCh := make(chan netip.AddrPort, peerBufferSize)
 	go func() {
+		// The span ends when all providers have been found, the event marks when the first was found.
+		peerCount := 0
+		defer func() {
+			span.SetAttributes(attribute.Int("peers", peerCount))
+			span.End()
+		}()
 		resolveTimer := prometheus.NewTimer(metrics.ResolveDurHistogram.WithLabelValues("libp2p"))
 		for info := range addrCh {
 			resolveTimer.ObserveDuration()
+			if peerCount == 0 {
+				span.AddEvent("provider found")
+			}
 			if !allowSelf && info.ID == r.host.ID() {
 				continue
 			}
@@ -191,6 +212,7 @@ func (r *P2PRouter) Resolve(ctx context.Context, key string, allowSelf bool, cou
 			// Don't block if the client has disconnected before reading all values from the channel
 			select {
 			case peerCh <- peer:
+				peerCount++
 			default:
 				log.V(4).Info("mirror endpoint dropped: peer channel is full")
 			}
@@ -202,19 +224,64 @@ func (r *P2PRouter) Resolve(ctx context.Context, key string, allowSelf bool, cou
 
 func (r *P2PRouter) Advertise(ctx context.Context, keys []string) error {
 	logr.FromContextOrDiscard(ctx).V(4).Info("advertising keys", "host", r.host.ID().String(), "keys", keys)
+	ctx, span := tracer.Start(ctx, "Router.Advertise", trace.WithAttributes(attribute.Int("keys", len(keys))))
+	defer span.End()
 	for _, key := range keys {
 		c, err := createCid(key)
 		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
 			return err
 		}
 		err = r.rd.Provide(ctx, c, false)
 		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
 			return err
 		}
 	}
 	return nil
 }
 
+// PeerInfo describes a libp2p peer and the addresses it is known by.
+type PeerInfo struct {
+	ID        string   `json:"id"`
+	Addresses []string `json:"addresses"`
+}
+
+// NewPeerInfo converts libp2p address info to peer info.
+func NewPeerInfo(addrInfo peer.AddrInfo) PeerInfo {
+	addrs := []string{}
+	for _, addr := range addrInfo.Addrs {
+		addrs = append(addrs, addr.String())
+	}
+	return PeerInfo{
+		ID:        addrInfo.ID.String(),
+		Addresses: addrs,
+	}
+}
+
+// Self returns the peer info of the local host.
+func (r *P2PRouter) Self() PeerInfo {
+	return NewPeerInfo(peer.AddrInfo{ID: r.host.ID(), Addrs: r.host.Addrs()})
+}
+
+// RoutingTable returns the peers in the routing table of the distributed hash table.
+func (r *P2PRouter) RoutingTable() []PeerInfo {
+	peers := []PeerInfo{}
+	for _, id := range r.kdht.RoutingTable().ListPeers() {
+		peers = append(peers, NewPeerInfo(r.host.Peerstore().PeerInfo(id)))
+	}
+	return peers
+}
+
+// ConnectedPeers returns the peers which the host has an open connection to.
+func (r *P2PRouter) ConnectedPeers() []PeerInfo {
+	peers := []PeerInfo{}
+	for _, id := range r.host.Network().Peers() {
+		peers = append(peers, NewPeerInfo(r.host.Peerstore().PeerInfo(id)))
+	}
+	return peers
+}
+
 func listenMultiaddrs(addr string) ([]ma.Multiaddr, error) {
 	h, p, err := net.SplitHostPort(addr)
 	if err != nil {
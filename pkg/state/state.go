@@ -4,9 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
 
 	"github.com/spegel-org/spegel/internal/channel"
 	"github.com/spegel-org/spegel/pkg/metrics"
@@ -14,7 +19,32 @@ import (
 	"github.com/spegel-org/spegel/pkg/routing"
 )
 
-func Track(ctx context.Context, ociClient oci.Client, router routing.Router, resolveLatestTag bool) error {
+type TrackOption func(*trackConfig)
+
+type trackConfig struct {
+	contentKeys    *ContentKeys
+	repositoryKeys bool
+}
+
+// WithContentKeys advertises the content keys together with the keys of the images.
+func WithContentKeys(contentKeys *ContentKeys) TrackOption {
+	return func(cfg *trackConfig) {
+		cfg.contentKeys = contentKeys
+	}
+}
+
+// WithRepositoryKeys advertises the repositories of tagged images, which peers use to list tags.
+func WithRepositoryKeys(repositoryKeys bool) TrackOption {
+	return func(cfg *trackConfig) {
+		cfg.repositoryKeys = repositoryKeys
+	}
+}
+
+func Track(ctx context.Context, ociClient oci.Client, router routing.Router, resolveLatestTag bool, opts ...TrackOption) error {
+	cfg := trackConfig{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 	log := logr.FromContextOrDiscard(ctx)
 	eventCh, errCh, err := ociClient.Subscribe(ctx)
 	if err != nil {
@@ -32,7 +62,10 @@ func Track(ctx context.Context, ociClient oci.Client, router routing.Router, res
 			return nil
 		case <-tickerCh:
 			log.Info("running scheduled image state update")
-			if err := all(ctx, ociClient, router, resolveLatestTag); err != nil {
+			if err := cfg.contentKeys.advertise(ctx, ociClient, router); err != nil {
+				log.Error(err, "received error when advertising content")
+			}
+			if err := all(ctx, ociClient, router, resolveLatestTag, cfg.repositoryKeys); err != nil {
 				log.Error(err, "received errors when updating all images")
 				continue
 			}
@@ -41,7 +74,7 @@ func Track(ctx context.Context, ociClient oci.Client, router routing.Router, res
 				return errors.New("image event channel closed")
 			}
 			log.Info("received image event", "image", event.Image.String(), "type", event.Type)
-			if _, err := update(ctx, ociClient, router, event, false, resolveLatestTag); err != nil {
+			if _, err := update(ctx, ociClient, router, event, false, resolveLatestTag, cfg.repositoryKeys); err != nil {
 				log.Error(err, "received error when updating image")
 				continue
 			}
@@ -50,11 +83,19 @@ func Track(ctx context.Context, ociClient oci.Client, router routing.Router, res
 				return errors.New("image error channel closed")
 			}
 			log.Error(err, "event channel error")
+			if !errors.Is(err, oci.ErrResyncRequired) {
+				continue
+			}
+			log.Info("running full image state update after missed events")
+			if err := all(ctx, ociClient, router, resolveLatestTag, cfg.repositoryKeys); err != nil {
+				log.Error(err, "received errors when updating all images")
+				continue
+			}
 		}
 	}
 }
 
-func all(ctx context.Context, ociClient oci.Client, router routing.Router, resolveLatestTag bool) error {
+func all(ctx context.Context, ociClient oci.Client, router routing.Router, resolveLatestTag, repositoryKeys bool) error {
 	log := logr.FromContextOrDiscard(ctx).V(4)
 	imgs, err := ociClient.ListImages(ctx)
 	if err != nil {
@@ -74,58 +115,152 @@ func all(ctx context.Context, ociClient oci.Client, router routing.Router, resol
 		// update function from setting metrics values.
 		event := oci.ImageEvent{Image: img, Type: oci.UpdateEvent}
 		log.Info("sync image event", "image", event.Image.String(), "type", event.Type)
-		keyTotal, err := update(ctx, ociClient, router, event, skipDigests, resolveLatestTag)
+		keyTotal, err := update(ctx, ociClient, router, event, skipDigests, resolveLatestTag, repositoryKeys)
 		if err != nil {
 			errs = append(errs, err)
 			continue
 		}
 		targets[img.Digest.String()] = nil
-		metrics.AdvertisedKeys.WithLabelValues(img.Registry).Add(float64(keyTotal))
-		metrics.AdvertisedImages.WithLabelValues(img.Registry).Add(1)
+		metrics.AdvertisedKeys.WithLabelValues(img.Registry, img.Namespace).Add(float64(keyTotal))
+		metrics.AdvertisedImages.WithLabelValues(img.Registry, img.Namespace).Add(1)
 		if img.Tag == "" {
-			metrics.AdvertisedImageDigests.WithLabelValues(event.Image.Registry).Add(1)
+			metrics.AdvertisedImageDigests.WithLabelValues(event.Image.Registry, event.Image.Namespace).Add(1)
 		} else {
-			metrics.AdvertisedImageTags.WithLabelValues(event.Image.Registry).Add(1)
+			metrics.AdvertisedImageTags.WithLabelValues(event.Image.Registry, event.Image.Namespace).Add(1)
 		}
 	}
 	return errors.Join(errs...)
 }
 
-func update(ctx context.Context, ociClient oci.Client, router routing.Router, event oci.ImageEvent, skipDigests, resolveLatestTag bool) (int, error) {
-	keys := []string{}
-	if !(!resolveLatestTag && event.Image.IsLatestTag()) {
-		if tagRef, ok := event.Image.TagName(); ok {
-			keys = append(keys, tagRef)
-		}
-	}
+func update(ctx context.Context, ociClient oci.Client, router routing.Router, event oci.ImageEvent, skipDigests, resolveLatestTag, repositoryKeys bool) (int, error) {
 	if event.Type == oci.DeleteEvent {
 		// We don't know how many digest keys were associated with the deleted image;
 		// that can only be updated by the full image list sync in all().
-		metrics.AdvertisedImages.WithLabelValues(event.Image.Registry).Sub(1)
+		metrics.AdvertisedImages.WithLabelValues(event.Image.Registry, event.Image.Namespace).Sub(1)
 		// DHT doesn't actually have any way to stop providing a key, you just have to wait for the record to expire
 		// from the datastore. Record TTL is a datastore-level value, so we can't even re-provide with a shorter TTL.
 		return 0, nil
 	}
-	if !skipDigests {
-		dgsts, err := ociClient.AllIdentifiers(ctx, event.Image)
-		if err != nil {
-			return 0, fmt.Errorf("could not get digests for image %s: %w", event.Image.String(), err)
-		}
-		keys = append(keys, dgsts...)
+	keys, err := imageKeys(ctx, ociClient, event.Image, skipDigests, resolveLatestTag, repositoryKeys)
+	if err != nil {
+		return 0, err
 	}
-	err := router.Advertise(ctx, keys)
+	err = router.Advertise(ctx, keys)
 	if err != nil {
 		return 0, fmt.Errorf("could not advertise image %s: %w", event.Image.String(), err)
 	}
 	if event.Type == oci.CreateEvent {
 		// We don't know how many unique digest keys will be associated with the new image;
 		// that can only be updated by the full image list sync in all().
-		metrics.AdvertisedImages.WithLabelValues(event.Image.Registry).Add(1)
+		metrics.AdvertisedImages.WithLabelValues(event.Image.Registry, event.Image.Namespace).Add(1)
 		if event.Image.Tag == "" {
-			metrics.AdvertisedImageDigests.WithLabelValues(event.Image.Registry).Add(1)
+			metrics.AdvertisedImageDigests.WithLabelValues(event.Image.Registry, event.Image.Namespace).Add(1)
 		} else {
-			metrics.AdvertisedImageTags.WithLabelValues(event.Image.Registry).Add(1)
+			metrics.AdvertisedImageTags.WithLabelValues(event.Image.Registry, event.Image.Namespace).Add(1)
 		}
 	}
 	return len(keys), nil
 }
+
+// ContentKeys are the digests of stored content which is not part of any image, for example content
+// pulled through from the original registry. The digests are advertised for as long as the content is stored.
+type ContentKeys struct {
+	dgsts map[digest.Digest]struct{}
+	mx    sync.Mutex
+}
+
+func NewContentKeys() *ContentKeys {
+	return &ContentKeys{
+		dgsts: map[digest.Digest]struct{}{},
+	}
+}
+
+func (c *ContentKeys) Add(dgst digest.Digest) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.dgsts[dgst] = struct{}{}
+}
+
+// advertise advertises the digests of content which is still stored, and forgets content which has been removed.
+func (c *ContentKeys) advertise(ctx context.Context, ociClient oci.Client, router routing.Router) error {
+	if c == nil {
+		return nil
+	}
+	c.mx.Lock()
+	dgsts := []digest.Digest{}
+	for dgst := range c.dgsts {
+		dgsts = append(dgsts, dgst)
+	}
+	c.mx.Unlock()
+
+	keys := []string{}
+	for _, dgst := range dgsts {
+		_, err := ociClient.Size(ctx, dgst)
+		if errdefs.IsNotFound(err) {
+			c.mx.Lock()
+			delete(c.dgsts, dgst)
+			c.mx.Unlock()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		keys = append(keys, dgst.String())
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return router.Advertise(ctx, keys)
+}
+
+// Key is a key advertised by the node together with the images it was derived from.
+type Key struct {
+	Key    string   `json:"key"`
+	Images []string `json:"images"`
+}
+
+// Keys returns the keys advertised for the images stored in the OCI client, sorted by key.
+func Keys(ctx context.Context, ociClient oci.Client, resolveLatestTag, repositoryKeys bool) ([]Key, error) {
+	imgs, err := ociClient.ListImages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keyImages := map[string][]string{}
+	for _, img := range imgs {
+		keys, err := imageKeys(ctx, ociClient, img, false, resolveLatestTag, repositoryKeys)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			keyImages[key] = append(keyImages[key], img.String())
+		}
+	}
+	result := []Key{}
+	for key, images := range keyImages {
+		result = append(result, Key{Key: key, Images: images})
+	}
+	slices.SortFunc(result, func(a, b Key) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return result, nil
+}
+
+func imageKeys(ctx context.Context, ociClient oci.Client, img oci.Image, skipDigests, resolveLatestTag, repositoryKeys bool) ([]string, error) {
+	keys := []string{}
+	if !(!resolveLatestTag && img.IsLatestTag()) {
+		if tagRef, ok := img.TagName(); ok {
+			keys = append(keys, tagRef)
+			if repositoryKeys {
+				keys = append(keys, oci.RepositoryKey(img.Registry, img.Repository))
+			}
+		}
+	}
+	if !skipDigests {
+		dgsts, err := ociClient.AllIdentifiers(ctx, img)
+		if err != nil {
+			return nil, fmt.Errorf("could not get digests for image %s: %w", img.String(), err)
+		}
+		keys = append(keys, dgsts...)
+	}
+	return keys, nil
+}
@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/require"
 
 	"github.com/spegel-org/spegel/pkg/oci"
@@ -18,14 +19,22 @@ func TestBasic(t *testing.T) {
 	tests := []struct {
 		name             string
 		resolveLatestTag bool
+		repositoryKeys   bool
 	}{
 		{
 			name:             "resolve latest",
 			resolveLatestTag: true,
+			repositoryKeys:   true,
 		},
 		{
 			name:             "do not resolve latest",
 			resolveLatestTag: false,
+			repositoryKeys:   true,
+		},
+		{
+			name:             "without repository keys",
+			resolveLatestTag: true,
+			repositoryKeys:   false,
 		},
 	}
 
@@ -53,7 +62,7 @@ func TestBasic(t *testing.T) {
 				time.Sleep(2 * time.Second)
 				cancel()
 			}()
-			err := Track(ctx, ociClient, router, tt.resolveLatestTag)
+			err := Track(ctx, ociClient, router, tt.resolveLatestTag, WithRepositoryKeys(tt.repositoryKeys))
 			require.NoError(t, err)
 
 			for _, img := range imgs {
@@ -71,7 +80,30 @@ func TestBasic(t *testing.T) {
 				}
 				require.True(t, ok)
 				require.Len(t, peers, 1)
+				_, ok = router.Lookup(oci.RepositoryKey(img.Registry, img.Repository))
+				require.Equal(t, tt.repositoryKeys, ok)
 			}
 		})
 	}
 }
+
+func TestContentKeys(t *testing.T) {
+	t.Parallel()
+
+	ociClient := oci.NewMockClient(nil)
+	storedDgst := ociClient.AddBlob([]byte("hello world"))
+	removedDgst := digest.FromString("removed")
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("127.0.0.1:5000"))
+	contentKeys := NewContentKeys()
+	contentKeys.Add(storedDgst)
+	contentKeys.Add(removedDgst)
+
+	err := contentKeys.advertise(context.Background(), ociClient, router)
+	require.NoError(t, err)
+	peers, ok := router.Lookup(storedDgst.String())
+	require.True(t, ok)
+	require.Len(t, peers, 1)
+	_, ok = router.Lookup(removedDgst.String())
+	require.False(t, ok)
+	require.Equal(t, map[digest.Digest]struct{}{storedDgst: {}}, contentKeys.dgsts)
+}
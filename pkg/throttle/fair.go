@@ -0,0 +1,218 @@
+package throttle
+
+import (
+	"container/heap"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/spegel-org/spegel/pkg/metrics"
+)
+
+// fairChunkSize is the max amount of bytes written for each grant from the fair limiter.
+const fairChunkSize = 64 * 1024
+
+// FairLimiter limits the total write speed of all writers it creates. Bandwidth is
+// shared between requesters with weighted fair queueing, so that each active requester
+// receives a share of the bandwidth proportional to its weight independent of how many
+// writers it has. Writers of the same requester share the requesters bandwidth.
+type FairLimiter struct {
+	limiter     *rate.Limiter
+	flows       map[string]*flow
+	weights     map[string]float64
+	queue       grantQueue
+	virtualTime float64
+	seq         uint64
+	mx          sync.Mutex
+	dispatching bool
+}
+
+type flow struct {
+	finish float64
+	queued int
+}
+
+type grant struct {
+	done      chan struct{}
+	requester string
+	tag       float64
+	seq       uint64
+	n         int
+	cancelled bool
+}
+
+func NewFairLimiter(br Byterate) *FairLimiter {
+	return &FairLimiter{
+		limiter: rate.NewLimiter(rate.Limit(br), fairChunkSize),
+		flows:   map[string]*flow{},
+		weights: map[string]float64{},
+	}
+}
+
+// SetWeight sets the weight of the requester. Requesters have a weight of one by default.
+func (f *FairLimiter) SetWeight(requester string, weight float64) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.weights[requester] = weight
+}
+
+// Writer returns a writer which waits for its share of bandwidth before writing. Writes
+// return the context error when the context is cancelled while waiting.
+func (f *FairLimiter) Writer(ctx context.Context, w io.Writer, requester string) io.Writer {
+	return &fairWriter{
+		ctx:       ctx,
+		limiter:   f,
+		writer:    w,
+		requester: requester,
+	}
+}
+
+// wait blocks until the requester has been granted n bytes or the context is cancelled.
+func (f *FairLimiter) wait(ctx context.Context, requester string, n int) error {
+	start := time.Now()
+	g := f.enqueue(requester, n)
+	metrics.EgressQueuedBytes.Add(float64(n))
+	defer metrics.EgressQueuedBytes.Sub(float64(n))
+	select {
+	case <-g.done:
+		metrics.EgressWaitDuration.Observe(time.Since(start).Seconds())
+		return nil
+	case <-ctx.Done():
+	}
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	select {
+	case <-g.done:
+		// The grant was dispatched before it could be cancelled.
+		return nil
+	default:
+	}
+	// Cancelled grants are skipped by the dispatcher without using bandwidth.
+	g.cancelled = true
+	return ctx.Err()
+}
+
+// enqueue queues a grant of n bytes for the requester.
+func (f *FairLimiter) enqueue(requester string, n int) *grant {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	fl, ok := f.flows[requester]
+	if !ok {
+		fl = &flow{}
+		f.flows[requester] = fl
+	}
+	weight, ok := f.weights[requester]
+	if !ok || weight <= 0 {
+		weight = 1
+	}
+	// Grants are ordered by their virtual finish time, which for a requester with
+	// queued grants continues from the finish time of its last grant.
+	fl.finish = max(f.virtualTime, fl.finish) + float64(n)/weight
+	fl.queued++
+	f.seq++
+	g := &grant{
+		requester: requester,
+		tag:       fl.finish,
+		seq:       f.seq,
+		n:         n,
+		done:      make(chan struct{}),
+	}
+	heap.Push(&f.queue, g)
+	if !f.dispatching {
+		f.dispatching = true
+		go f.dispatch()
+	}
+	return g
+}
+
+// dispatch grants queued bytes in order of virtual finish time at the rate of the limiter.
+func (f *FairLimiter) dispatch() {
+	for {
+		f.mx.Lock()
+		if f.queue.Len() == 0 {
+			f.dispatching = false
+			f.mx.Unlock()
+			return
+		}
+		//nolint:errcheck // Queue only contains grants.
+		g := heap.Pop(&f.queue).(*grant)
+		f.virtualTime = g.tag
+		fl := f.flows[g.requester]
+		fl.queued--
+		if fl.queued == 0 {
+			delete(f.flows, g.requester)
+		}
+		if g.cancelled {
+			f.mx.Unlock()
+			continue
+		}
+		f.mx.Unlock()
+
+		// The grant is released before waiting for its bytes, so that the writer has time to
+		// queue its next grant before the next grant is chosen.
+		close(g.done)
+		r := f.limiter.ReserveN(time.Now(), g.n)
+		time.Sleep(r.Delay())
+	}
+}
+
+type fairWriter struct {
+	ctx       context.Context
+	limiter   *FairLimiter
+	writer    io.Writer
+	requester string
+}
+
+func (w *fairWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), fairChunkSize)
+		err := w.limiter.wait(w.ctx, w.requester, n)
+		if err != nil {
+			return written, err
+		}
+		n, err = w.writer.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// grantQueue is a priority queue of grants ordered by virtual finish time.
+type grantQueue []*grant
+
+func (q grantQueue) Len() int {
+	return len(q)
+}
+
+func (q grantQueue) Less(i, j int) bool {
+	if q[i].tag != q[j].tag {
+		return q[i].tag < q[j].tag
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q grantQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *grantQueue) Push(x any) {
+	//nolint:errcheck // Queue only contains grants.
+	*q = append(*q, x.(*grant))
+}
+
+func (q *grantQueue) Pop() any {
+	old := *q
+	n := len(old)
+	g := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return g
+}
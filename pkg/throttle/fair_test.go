@@ -0,0 +1,89 @@
+package throttle
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFairLimiter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		expectedOrder []string
+		weightB       float64
+	}{
+		{
+			name:          "equal weights",
+			weightB:       1,
+			expectedOrder: []string{"a", "b", "a", "b", "a", "b"},
+		},
+		{
+			name:          "weighted requester",
+			weightB:       3,
+			expectedOrder: []string{"b", "b", "a", "b", "a", "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			limiter := NewFairLimiter(512 * KBps)
+			limiter.SetWeight("b", tt.weightB)
+			// Grants are not dispatched so that the order of the queue can be checked.
+			limiter.dispatching = true
+
+			// Requester a queues all of its grants first which should not give it a larger share.
+			for _, requester := range []string{"a", "a", "a", "b", "b", "b"} {
+				limiter.enqueue(requester, fairChunkSize)
+			}
+			order := []string{}
+			for limiter.queue.Len() > 0 {
+				//nolint:errcheck // Queue only contains grants.
+				g := heap.Pop(&limiter.queue).(*grant)
+				order = append(order, g.requester)
+			}
+			require.Equal(t, tt.expectedOrder, order)
+		})
+	}
+}
+
+func TestFairLimiterWriter(t *testing.T) {
+	t.Parallel()
+
+	limiter := NewFairLimiter(512 * KBps)
+	buf := bytes.NewBuffer(nil)
+	w := limiter.Writer(context.Background(), buf, "a")
+	n, err := w.Write(make([]byte, 2*fairChunkSize+1))
+	require.NoError(t, err)
+	require.Equal(t, 2*fairChunkSize+1, n)
+	require.Equal(t, 2*fairChunkSize+1, buf.Len())
+}
+
+func TestFairLimiterCancel(t *testing.T) {
+	t.Parallel()
+
+	limiter := NewFairLimiter(512 * KBps)
+	// Grants are not dispatched so that the writer keeps waiting until cancelled.
+	limiter.dispatching = true
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	buf := bytes.NewBuffer(nil)
+	w := limiter.Writer(ctx, buf, "a")
+	n, err := w.Write(make([]byte, fairChunkSize))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 0, n)
+	require.Equal(t, 0, buf.Len())
+	require.Equal(t, 1, limiter.queue.Len())
+	require.True(t, limiter.queue[0].cancelled)
+
+	// Cancelled grants are skipped when dispatched.
+	limiter.dispatch()
+	require.Equal(t, 0, limiter.queue.Len())
+	require.Empty(t, limiter.flows)
+}
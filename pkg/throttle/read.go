@@ -0,0 +1,57 @@
+package throttle
+
+import (
+	"io"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/spegel-org/spegel/pkg/metrics"
+)
+
+// readChunkSize is the max amount of bytes read at a time by a limited reader.
+const readChunkSize = 64 * 1024
+
+// ReadLimiter limits the total read speed of all readers it creates.
+type ReadLimiter struct {
+	limiter *rate.Limiter
+}
+
+func NewReadLimiter(br Byterate) *ReadLimiter {
+	return &ReadLimiter{
+		limiter: rate.NewLimiter(rate.Limit(br), readChunkSize),
+	}
+}
+
+// ReadCloser returns a reader which waits after each read until the bytes read are within the limit.
+func (l *ReadLimiter) ReadCloser(rc io.ReadCloser) io.ReadCloser {
+	return &reader{
+		limiter: l.limiter,
+		rc:      rc,
+	}
+}
+
+type reader struct {
+	limiter *rate.Limiter
+	rc      io.ReadCloser
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > readChunkSize {
+		p = p[:readChunkSize]
+	}
+	n, err := r.rc.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	delay := r.limiter.ReserveN(time.Now(), n).Delay()
+	if delay > 0 {
+		metrics.IngressThrottledBytesTotal.Add(float64(n))
+		time.Sleep(delay)
+	}
+	return n, err
+}
+
+func (r *reader) Close() error {
+	return r.rc.Close()
+}
@@ -0,0 +1,28 @@
+package throttle
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadLimiter(t *testing.T) {
+	t.Parallel()
+
+	limiter := NewReadLimiter(100 * KBps)
+	start := time.Now()
+	// The limit is shared between all readers.
+	for range 2 {
+		rc := limiter.ReadCloser(io.NopCloser(bytes.NewReader(make([]byte, 100*1024))))
+		b, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.Len(t, b, 100*1024)
+		require.NoError(t, rc.Close())
+	}
+	d := time.Since(start)
+	require.Greater(t, d, 1*time.Second)
+	require.Less(t, d, 2*time.Second)
+}
@@ -1,30 +1,34 @@
 package throttle
 
 import (
-	"fmt"
 	"io"
 	"time"
 
 	"golang.org/x/time/rate"
 )
 
-const burstLimit = 1024 * 1024 * 1024 // 1GB
+// writeChunkSize is the largest write passed on at once, which also sizes the burst of the limiter.
+const writeChunkSize = 32 * 1024
 
+// Throttler limits the write speed of each writer it creates.
 type Throttler struct {
-	limiter *rate.Limiter
+	br Byterate
 }
 
 func NewThrottler(br Byterate) *Throttler {
-	limiter := rate.NewLimiter(rate.Limit(br), burstLimit)
-	limiter.AllowN(time.Now(), burstLimit)
 	return &Throttler{
-		limiter: limiter,
+		br: br,
 	}
 }
 
+// Writer returns a writer with its own limiter, so that the rate applies to each writer separately.
+// The burst is drained up front so that short writes are limited as well.
 func (t *Throttler) Writer(w io.Writer) io.Writer {
+	burst := max(1, min(writeChunkSize, int(t.br)))
+	limiter := rate.NewLimiter(rate.Limit(t.br), burst)
+	limiter.AllowN(time.Now(), burst)
 	return &writer{
-		limiter: t.limiter,
+		limiter: limiter,
 		writer:  w,
 	}
 }
@@ -35,14 +39,15 @@ type writer struct {
 }
 
 func (w *writer) Write(p []byte) (int, error) {
-	n, err := w.writer.Write(p)
-	if err != nil {
-		return 0, err
-	}
-	r := w.limiter.ReserveN(time.Now(), n)
-	if !r.OK() {
-		return n, fmt.Errorf("write size %d exceeds limiters burst %d", n, w.limiter.Burst())
+	written := 0
+	for len(p) > 0 {
+		n, err := w.writer.Write(p[:min(len(p), w.limiter.Burst())])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		time.Sleep(w.limiter.ReserveN(time.Now(), n).Delay())
+		p = p[n:]
 	}
-	time.Sleep(r.Delay())
-	return n, nil
+	return written, nil
 }
@@ -2,6 +2,7 @@ package throttle
 
 import (
 	"bytes"
+	"sync"
 	"testing"
 	"time"
 
@@ -26,3 +27,42 @@ func TestThrottler(t *testing.T) {
 	require.Greater(t, d, 2*time.Second)
 	require.Less(t, d, 3*time.Second)
 }
+
+func TestThrottlerPerWriter(t *testing.T) {
+	t.Parallel()
+
+	throttler := NewThrottler(500 * Bps)
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := throttler.Writer(bytes.NewBuffer([]byte{}))
+			for range 5 {
+				//nolint:errcheck // ignore
+				w.Write(make([]byte, 100))
+			}
+		}()
+	}
+	wg.Wait()
+	d := time.Since(start)
+	require.Greater(t, d, 1*time.Second)
+	require.Less(t, d, 2*time.Second)
+}
+
+func TestThrottlerLargeWrite(t *testing.T) {
+	t.Parallel()
+
+	throttler := NewThrottler(1 * KBps)
+	buf := bytes.NewBuffer([]byte{})
+	w := throttler.Writer(buf)
+	start := time.Now()
+	n, err := w.Write(make([]byte, 1536))
+	require.NoError(t, err)
+	require.Equal(t, 1536, n)
+	require.Equal(t, 1536, buf.Len())
+	d := time.Since(start)
+	require.Greater(t, d, 1*time.Second)
+	require.Less(t, d, 2*time.Second)
+}
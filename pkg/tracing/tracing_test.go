@@ -0,0 +1,32 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetup(t *testing.T) {
+	t.Parallel()
+
+	reqCh := make(chan string, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		reqCh <- req.Method + " " + req.URL.Path
+		rw.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(func() {
+		collector.Close()
+	})
+
+	shutdown, err := Setup(context.Background(), collector.URL)
+	require.NoError(t, err)
+	_, span := otel.Tracer("test").Start(context.Background(), "test")
+	span.End()
+	err = shutdown(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "POST /v1/traces", <-reqCh)
+}